@@ -18,9 +18,11 @@ package main
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"github.com/go-logr/logr"
 	"github.com/go-logr/zapr"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 	raptorApi "github.com/raptor-ml/raptor/api/v1alpha1"
 	"github.com/raptor-ml/raptor/pkg/runtimemanager"
 	_ "github.com/raptor-ml/streaming-runner/internal/brokers"
@@ -30,12 +32,15 @@ import (
 	"go.uber.org/zap"
 	utilruntime "k8s.io/apimachinery/pkg/util/runtime"
 	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
+	"net/http"
 	"os"
 	"os/signal"
 	ctrl "sigs.k8s.io/controller-runtime"
 	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/metrics"
 	"strings"
 	"syscall"
+	"time"
 )
 
 // version is being overridden in build time
@@ -54,6 +59,8 @@ func main() {
 	pflag.Bool("production", true, "Set as production")
 	pflag.String("data-source-resource", "", "The resource name of the DataSource")
 	pflag.String("data-source-namespace", "", "The namespace name of the DataSource")
+	// :8080 and :9090 are the default addresses of the http and grpc brokers
+	pflag.String("metrics-bind-address", ":8081", "The address the Prometheus metrics endpoint (/metrics) binds to. Set to `0` to disable.")
 	pflag.Parse()
 	must(viper.BindPFlags(pflag.CommandLine))
 
@@ -80,12 +87,32 @@ func main() {
 
 	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
 
+	if addr := viper.GetString("metrics-bind-address"); addr != "0" {
+		go serveMetrics(ctx, addr)
+	}
+
 	setupLog.Info("Starting streaming-runner", "version", version)
 	err = mgr.Start(ctx)
 	must(err)
 	defer cancel()
 
 }
+
+// serveMetrics exposes the metrics registered with the controller-runtime registry
+func serveMetrics(ctx context.Context, addr string) {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.HandlerFor(metrics.Registry, promhttp.HandlerOpts{}))
+	srv := &http.Server{Addr: addr, Handler: mux, ReadHeaderTimeout: 10 * time.Second}
+	go func() {
+		<-ctx.Done()
+		_ = srv.Close()
+	}()
+
+	if err := srv.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		setupLog.Error(err, "failed to serve metrics")
+	}
+}
+
 func logger() *zap.Logger {
 	var l *zap.Logger
 	var err error
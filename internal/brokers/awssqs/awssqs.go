@@ -0,0 +1,113 @@
+/*
+Copyright (c) 2022 RaptorML authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package awssqs
+
+import (
+	"context"
+	"fmt"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	awsConfig "github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/credentials"
+	"github.com/aws/aws-sdk-go-v2/service/sqs"
+	sqsTypes "github.com/aws/aws-sdk-go-v2/service/sqs/types"
+	"github.com/raptor-ml/raptor/api/v1alpha1"
+	"github.com/raptor-ml/streaming-runner/pkg/brokers"
+	"gocloud.dev/pubsub"
+	"gocloud.dev/pubsub/awssnssqs"
+	"gocloud.dev/pubsub/batcher"
+	"strconv"
+	"time"
+)
+
+func init() {
+	brokers.Register("aws_sqs", &provider{})
+}
+
+type provider struct{}
+type ContextKey string
+
+const QueueURLContextKey ContextKey = "queue_url"
+
+func (p *provider) Metadata(ctx context.Context, msg *pubsub.Message) brokers.Metadata {
+	var md brokers.Metadata
+	var m sqsTypes.Message
+	if ok := msg.As(&m); ok {
+		md.ID = aws.ToString(m.MessageId)
+		md.Topic = ctx.Value(QueueURLContextKey).(string)
+		if ts, err := strconv.ParseInt(m.Attributes[string(sqsTypes.MessageSystemAttributeNameSentTimestamp)], 10, 64); err == nil {
+			md.Timestamp = time.UnixMilli(ts)
+		}
+	}
+	return md
+}
+
+type config struct {
+	QueueURL string `mapstructure:"queue_url"`
+	Region   string `mapstructure:"region"`
+	// Endpoint overrides the SQS endpoint, e.g. for a local SQS-compatible server.
+	Endpoint string `mapstructure:"endpoint"`
+
+	AccessKeyID     string `mapstructure:"access_key_id"`
+	SecretAccessKey string `mapstructure:"secret_access_key"`
+	SessionToken    string `mapstructure:"session_token"`
+
+	// SNSEnvelope unwraps messages delivered by an SNS subscription without raw delivery.
+	SNSEnvelope  bool          `mapstructure:"sns_envelope"`
+	WaitTime     time.Duration `mapstructure:"wait_time"`
+	MaxBatchSize int           `mapstructure:"max_batch_size"`
+}
+
+func (p *provider) Subscribe(ctx context.Context, c v1alpha1.ParsedConfig) (context.Context, *pubsub.Subscription, error) {
+	cfg := config{}
+	err := c.Unmarshal(&cfg)
+	if err != nil {
+		return ctx, nil, fmt.Errorf("failed to unmarshal config: %w", err)
+	}
+
+	if cfg.QueueURL == "" {
+		return ctx, nil, fmt.Errorf("queue_url required to connect to sqs")
+	}
+
+	ctx = context.WithValue(ctx, QueueURLContextKey, cfg.QueueURL)
+
+	var opts []func(*awsConfig.LoadOptions) error
+	if cfg.Region != "" {
+		opts = append(opts, awsConfig.WithRegion(cfg.Region))
+	}
+	if cfg.AccessKeyID != "" && cfg.SecretAccessKey != "" {
+		opts = append(opts, awsConfig.WithCredentialsProvider(
+			credentials.NewStaticCredentialsProvider(cfg.AccessKeyID, cfg.SecretAccessKey, cfg.SessionToken),
+		))
+	}
+	awsCfg, err := awsConfig.LoadDefaultConfig(ctx, opts...)
+	if err != nil {
+		return ctx, nil, fmt.Errorf("failed to load aws config: %w", err)
+	}
+
+	client := sqs.NewFromConfig(awsCfg, func(o *sqs.Options) {
+		if cfg.Endpoint != "" {
+			o.BaseEndpoint = aws.String(cfg.Endpoint)
+		}
+	})
+
+	sub := awssnssqs.OpenSubscriptionV2(ctx, client, cfg.QueueURL, &awssnssqs.SubscriptionOptions{
+		Raw:                   !cfg.SNSEnvelope,
+		WaitTime:              cfg.WaitTime,
+		ReceiveBatcherOptions: batcher.Options{MaxBatchSize: cfg.MaxBatchSize},
+	})
+	return ctx, sub, nil
+}
@@ -0,0 +1,206 @@
+/*
+Copyright (c) 2022 RaptorML authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package awssqs
+
+import (
+	"context"
+	"crypto/md5"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"github.com/raptor-ml/raptor/api/v1alpha1"
+	"github.com/raptor-ml/streaming-runner/internal/brokers/brokertest"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+const testQueueURL = "https://sqs.us-east-1.amazonaws.com/000000000000/test"
+
+type fakeMessage struct {
+	id      string
+	body    string
+	sent    time.Time
+	receipt string
+	// visibleAt is when the message can be received again
+	visibleAt time.Time
+}
+
+// fakeSQS implements the subset of the SQS JSON protocol used by the subscription
+type fakeSQS struct {
+	mu       sync.Mutex
+	messages []*fakeMessage
+	received int
+	deleted  []string
+	nacked   map[string]int32
+}
+
+func newFakeSQS(bodies ...string) *fakeSQS {
+	f := &fakeSQS{nacked: make(map[string]int32)}
+	for i, b := range bodies {
+		f.messages = append(f.messages, &fakeMessage{id: fmt.Sprintf("msg-%d", i), body: b, sent: time.UnixMilli(1700000000000)})
+	}
+	return f
+}
+
+func (f *fakeSQS) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	var in map[string]any
+	if err := json.NewDecoder(r.Body).Decode(&in); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	var out any
+	switch op := strings.TrimPrefix(r.Header.Get("X-Amz-Target"), "AmazonSQS."); op {
+	case "ReceiveMessage":
+		max := 10
+		if v, ok := in["MaxNumberOfMessages"].(float64); ok {
+			max = int(v)
+		}
+		var msgs []map[string]any
+		for _, m := range f.messages {
+			if len(msgs) == max {
+				break
+			}
+			if time.Now().Before(m.visibleAt) {
+				continue
+			}
+			f.received++
+			m.receipt = fmt.Sprintf("%s-%d", m.id, f.received)
+			m.visibleAt = time.Now().Add(time.Hour)
+			sum := md5.Sum([]byte(m.body))
+			msgs = append(msgs, map[string]any{
+				"MessageId":     m.id,
+				"ReceiptHandle": m.receipt,
+				"Body":          m.body,
+				"MD5OfBody":     hex.EncodeToString(sum[:]),
+				"Attributes":    map[string]string{"SentTimestamp": strconv.FormatInt(m.sent.UnixMilli(), 10)},
+			})
+		}
+		out = map[string]any{"Messages": msgs}
+	case "DeleteMessageBatch":
+		var ok []map[string]string
+		for _, e := range in["Entries"].([]any) {
+			e := e.(map[string]any)
+			receipt := e["ReceiptHandle"].(string)
+			for i, m := range f.messages {
+				if m.receipt == receipt {
+					f.deleted = append(f.deleted, m.id)
+					f.messages = append(f.messages[:i], f.messages[i+1:]...)
+					break
+				}
+			}
+			ok = append(ok, map[string]string{"Id": e["Id"].(string)})
+		}
+		out = map[string]any{"Successful": ok, "Failed": []any{}}
+	case "ChangeMessageVisibilityBatch":
+		var ok []map[string]string
+		for _, e := range in["Entries"].([]any) {
+			e := e.(map[string]any)
+			receipt := e["ReceiptHandle"].(string)
+			timeout := int32(e["VisibilityTimeout"].(float64))
+			for _, m := range f.messages {
+				if m.receipt == receipt {
+					f.nacked[m.id] = timeout
+					m.visibleAt = time.Now().Add(time.Duration(timeout) * time.Second)
+				}
+			}
+			ok = append(ok, map[string]string{"Id": e["Id"].(string)})
+		}
+		out = map[string]any{"Successful": ok, "Failed": []any{}}
+	default:
+		http.Error(w, "unsupported operation: "+op, http.StatusBadRequest)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/x-amz-json-1.0")
+	_ = json.NewEncoder(w).Encode(out)
+}
+
+func subscribe(t *testing.T, f *fakeSQS) (context.Context, func(context.Context) (string, func(), func())) {
+	t.Helper()
+	srv := httptest.NewServer(f)
+	t.Cleanup(srv.Close)
+
+	ctx, sub := brokertest.Subscribe(t, &provider{}, v1alpha1.ParsedConfig{
+		"queue_url":         testQueueURL,
+		"region":            "us-east-1",
+		"endpoint":          srv.URL,
+		"access_key_id":     "test",
+		"secret_access_key": "test",
+		"wait_time":         "100ms",
+	})
+
+	return ctx, func(ctx context.Context) (string, func(), func()) {
+		t.Helper()
+		msg, err := sub.Receive(ctx)
+		if err != nil {
+			t.Fatalf("Receive() error = %v", err)
+		}
+		md := (&provider{}).Metadata(ctx, msg)
+		if md.ID == "" || md.Topic != testQueueURL || !md.Timestamp.Equal(time.UnixMilli(1700000000000)) {
+			t.Errorf("Metadata() = %+v", md)
+		}
+		return string(msg.Body), msg.Ack, msg.Nack
+	}
+}
+
+func TestReceiveAndDelete(t *testing.T) {
+	f := newFakeSQS(`{"a":1}`, `{"a":2}`)
+	ctx, receive := subscribe(t, f)
+
+	got := make(map[string]bool)
+	for i := 0; i < 2; i++ {
+		body, ack, _ := receive(ctx)
+		got[body] = true
+		ack()
+	}
+	if !got[`{"a":1}`] || !got[`{"a":2}`] {
+		t.Errorf("received %v", got)
+	}
+	brokertest.Eventually(t, &f.mu, func() bool { return len(f.deleted) == 2 && len(f.messages) == 0 })
+}
+
+func TestNackChangesVisibility(t *testing.T) {
+	f := newFakeSQS(`{"a":1}`)
+	ctx, receive := subscribe(t, f)
+
+	body, _, nack := receive(ctx)
+	nack()
+	brokertest.Eventually(t, &f.mu, func() bool { _, ok := f.nacked["msg-0"]; return ok })
+	if len(f.deleted) != 0 {
+		t.Errorf("nacked message was deleted")
+	}
+	if f.nacked["msg-0"] > 1 {
+		t.Errorf("visibility timeout on nack = %d, want at most 1", f.nacked["msg-0"])
+	}
+
+	// the message becomes visible again once the visibility timeout expires
+	again, ack, _ := receive(ctx)
+	if again != body {
+		t.Errorf("redelivered body = %s, want %s", again, body)
+	}
+	ack()
+	brokertest.Eventually(t, &f.mu, func() bool { return len(f.deleted) == 1 })
+}
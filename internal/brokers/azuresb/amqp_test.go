@@ -0,0 +1,772 @@
+/*
+Copyright (c) 2022 RaptorML authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package azuresb
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"github.com/Azure/go-amqp"
+	"io"
+	"math"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+// This file implements a minimal in-process AMQP 1.0 endpoint that behaves like a Service Bus queue: it accepts
+// anonymous SASL, answers the $cbs and $management requests, and delivers the queued messages in peek-lock mode.
+
+type symbol string
+
+// described is a described AMQP value, such as a performative
+type described struct {
+	descriptor any
+	value      any
+}
+
+// symbolArray is encoded as an AMQP array of symbols
+type symbolArray []symbol
+
+const (
+	frameAMQP = 0x0
+	frameSASL = 0x1
+
+	perfOpen        = 0x10
+	perfBegin       = 0x11
+	perfAttach      = 0x12
+	perfFlow        = 0x13
+	perfTransfer    = 0x14
+	perfDisposition = 0x15
+	perfDetach      = 0x16
+	perfEnd         = 0x17
+	perfClose       = 0x18
+
+	saslMechanisms = 0x40
+	saslInit       = 0x41
+	saslOutcome    = 0x44
+
+	typeSource   = 0x28
+	typeTarget   = 0x29
+	typeAccepted = 0x24
+	typeRejected = 0x25
+	typeReleased = 0x26
+	typeModified = 0x27
+)
+
+func encode(buf *bytes.Buffer, v any) {
+	switch v := v.(type) {
+	case nil:
+		buf.WriteByte(0x40)
+	case bool:
+		if v {
+			buf.WriteByte(0x41)
+		} else {
+			buf.WriteByte(0x42)
+		}
+	case uint8:
+		buf.WriteByte(0x50)
+		buf.WriteByte(v)
+	case uint16:
+		buf.WriteByte(0x60)
+		_ = binary.Write(buf, binary.BigEndian, v)
+	case uint32:
+		buf.WriteByte(0x70)
+		_ = binary.Write(buf, binary.BigEndian, v)
+	case uint64:
+		if v <= math.MaxUint8 {
+			// descriptors must use the small encoding
+			buf.WriteByte(0x53)
+			buf.WriteByte(byte(v))
+			return
+		}
+		buf.WriteByte(0x80)
+		_ = binary.Write(buf, binary.BigEndian, v)
+	case int32:
+		buf.WriteByte(0x71)
+		_ = binary.Write(buf, binary.BigEndian, v)
+	case int64:
+		buf.WriteByte(0x81)
+		_ = binary.Write(buf, binary.BigEndian, v)
+	case []byte:
+		buf.WriteByte(0xb0)
+		_ = binary.Write(buf, binary.BigEndian, uint32(len(v)))
+		buf.Write(v)
+	case string:
+		buf.WriteByte(0xb1)
+		_ = binary.Write(buf, binary.BigEndian, uint32(len(v)))
+		buf.WriteString(v)
+	case symbol:
+		buf.WriteByte(0xb3)
+		_ = binary.Write(buf, binary.BigEndian, uint32(len(v)))
+		buf.WriteString(string(v))
+	case symbolArray:
+		var items bytes.Buffer
+		for _, s := range v {
+			_ = binary.Write(&items, binary.BigEndian, uint32(len(s)))
+			items.WriteString(string(s))
+		}
+		buf.WriteByte(0xf0)
+		_ = binary.Write(buf, binary.BigEndian, uint32(4+1+items.Len()))
+		_ = binary.Write(buf, binary.BigEndian, uint32(len(v)))
+		buf.WriteByte(0xb3)
+		buf.Write(items.Bytes())
+	case []any:
+		var items bytes.Buffer
+		for _, item := range v {
+			encode(&items, item)
+		}
+		buf.WriteByte(0xd0)
+		_ = binary.Write(buf, binary.BigEndian, uint32(4+items.Len()))
+		_ = binary.Write(buf, binary.BigEndian, uint32(len(v)))
+		buf.Write(items.Bytes())
+	case map[any]any:
+		var items bytes.Buffer
+		for k, item := range v {
+			encode(&items, k)
+			encode(&items, item)
+		}
+		buf.WriteByte(0xd1)
+		_ = binary.Write(buf, binary.BigEndian, uint32(4+items.Len()))
+		_ = binary.Write(buf, binary.BigEndian, uint32(2*len(v)))
+		buf.Write(items.Bytes())
+	case described:
+		buf.WriteByte(0x00)
+		encode(buf, v.descriptor)
+		encode(buf, v.value)
+	default:
+		panic(fmt.Sprintf("unsupported amqp type %T", v))
+	}
+}
+
+type decoder struct {
+	r *bytes.Reader
+}
+
+func (d *decoder) next(n int) []byte {
+	b := make([]byte, n)
+	if _, err := io.ReadFull(d.r, b); err != nil {
+		panic(err)
+	}
+	return b
+}
+
+func (d *decoder) size(width int) int {
+	if width == 1 {
+		return int(d.next(1)[0])
+	}
+	return int(binary.BigEndian.Uint32(d.next(4)))
+}
+
+func (d *decoder) decode() any {
+	code, err := d.r.ReadByte()
+	if err != nil {
+		panic(err)
+	}
+	if code == 0x00 {
+		desc := d.decode()
+		return described{descriptor: desc, value: d.decode()}
+	}
+	return d.decodeValue(code)
+}
+
+func (d *decoder) decodeValue(code byte) any {
+	switch code {
+	case 0x40:
+		return nil
+	case 0x41:
+		return true
+	case 0x42:
+		return false
+	case 0x56:
+		return d.next(1)[0] != 0
+	case 0x50:
+		return d.next(1)[0]
+	case 0x51:
+		return int8(d.next(1)[0])
+	case 0x60:
+		return binary.BigEndian.Uint16(d.next(2))
+	case 0x61:
+		return int16(binary.BigEndian.Uint16(d.next(2)))
+	case 0x70:
+		return binary.BigEndian.Uint32(d.next(4))
+	case 0x52:
+		return uint32(d.next(1)[0])
+	case 0x43:
+		return uint32(0)
+	case 0x80:
+		return binary.BigEndian.Uint64(d.next(8))
+	case 0x53:
+		return uint64(d.next(1)[0])
+	case 0x44:
+		return uint64(0)
+	case 0x71:
+		return int32(binary.BigEndian.Uint32(d.next(4)))
+	case 0x54:
+		return int32(int8(d.next(1)[0]))
+	case 0x81:
+		return int64(binary.BigEndian.Uint64(d.next(8)))
+	case 0x55:
+		return int64(int8(d.next(1)[0]))
+	case 0x72:
+		return math.Float32frombits(binary.BigEndian.Uint32(d.next(4)))
+	case 0x82:
+		return math.Float64frombits(binary.BigEndian.Uint64(d.next(8)))
+	case 0x73:
+		return int32(binary.BigEndian.Uint32(d.next(4)))
+	case 0x74:
+		return d.next(4)
+	case 0x84:
+		return d.next(8)
+	case 0x94:
+		return d.next(16)
+	case 0x83:
+		return time.UnixMilli(int64(binary.BigEndian.Uint64(d.next(8))))
+	case 0x98:
+		return [16]byte(d.next(16))
+	case 0xa0:
+		return d.next(d.size(1))
+	case 0xb0:
+		return d.next(d.size(4))
+	case 0xa1:
+		return string(d.next(d.size(1)))
+	case 0xb1:
+		return string(d.next(d.size(4)))
+	case 0xa3:
+		return symbol(d.next(d.size(1)))
+	case 0xb3:
+		return symbol(d.next(d.size(4)))
+	case 0x45:
+		return []any{}
+	case 0xc0, 0xd0, 0xc1, 0xd1:
+		width := 1
+		if code == 0xd0 || code == 0xd1 {
+			width = 4
+		}
+		d.size(width)
+		count := d.size(width)
+		items := make([]any, count)
+		for i := range items {
+			items[i] = d.decode()
+		}
+		if code == 0xc0 || code == 0xd0 {
+			return items
+		}
+		m := make(map[any]any, count/2)
+		for i := 0; i+1 < count; i += 2 {
+			if k, ok := items[i].([]byte); ok {
+				items[i] = string(k)
+			}
+			m[items[i]] = items[i+1]
+		}
+		return m
+	case 0xe0, 0xf0:
+		width := 1
+		if code == 0xf0 {
+			width = 4
+		}
+		d.size(width)
+		count := d.size(width)
+		elem, _ := d.r.ReadByte()
+		var desc any
+		if elem == 0x00 {
+			desc = d.decode()
+			elem, _ = d.r.ReadByte()
+		}
+		items := make([]any, count)
+		for i := range items {
+			items[i] = d.decodeValue(elem)
+			if desc != nil {
+				items[i] = described{descriptor: desc, value: items[i]}
+			}
+		}
+		return items
+	}
+	panic(fmt.Sprintf("unsupported amqp type code 0x%x", code))
+}
+
+// field returns the i-th field of a performative, or nil if it's omitted
+func field(fields []any, i int) any {
+	if i < len(fields) {
+		return fields[i]
+	}
+	return nil
+}
+
+func fieldUint32(fields []any, i int) (uint32, bool) {
+	v, ok := field(fields, i).(uint32)
+	return v, ok
+}
+
+// address returns the address of a source or target
+func address(v any) string {
+	d, ok := v.(described)
+	if !ok {
+		return ""
+	}
+	fields, _ := d.value.([]any)
+	s, _ := field(fields, 0).(string)
+	return s
+}
+
+type frame struct {
+	typ       byte
+	channel   uint16
+	performer uint64
+	fields    []any
+	payload   []byte
+}
+
+type fakeMessage struct {
+	id            string
+	body          []byte
+	enqueued      time.Time
+	deliveryCount uint32
+	lockedAt      time.Time
+}
+
+// settlement is how a delivery was settled, and how long after it was locked
+type settlement struct {
+	id      string
+	outcome uint64
+	after   time.Duration
+}
+
+// fakeServiceBus serves a single queue
+type fakeServiceBus struct {
+	t                *testing.T
+	queue            string
+	lockDuration     time.Duration
+	maxDeliveryCount uint32
+	listener         net.Listener
+
+	mu          sync.Mutex
+	available   []*fakeMessage
+	deadLetter  []*fakeMessage
+	completed   []*fakeMessage
+	settlements []settlement
+	claims      []string
+}
+
+func newFakeServiceBus(t *testing.T, queue string, bodies ...string) *fakeServiceBus {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	f := &fakeServiceBus{
+		t:                t,
+		queue:            queue,
+		lockDuration:     30 * time.Second,
+		maxDeliveryCount: 3,
+		listener:         l,
+	}
+	for i, b := range bodies {
+		f.available = append(f.available, &fakeMessage{
+			id:       fmt.Sprintf("msg-%d", i),
+			body:     []byte(b),
+			enqueued: time.UnixMilli(1700000000000 + int64(i)),
+		})
+	}
+	t.Cleanup(func() { _ = l.Close() })
+
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				c := &fakeConn{bus: f, conn: conn, r: bufio.NewReader(conn), sessions: make(map[uint16]*fakeSession)}
+				if err := c.serve(); err != nil && !errors.Is(err, io.EOF) && !errors.Is(err, net.ErrClosed) {
+					t.Logf("fake service bus connection failed: %v", err)
+				}
+				_ = conn.Close()
+			}()
+		}
+	}()
+	return f
+}
+
+func (f *fakeServiceBus) addr() string {
+	return f.listener.Addr().String()
+}
+
+type fakeLink struct {
+	handle uint32
+	// receiver is true for the client's receivers, to which the fake sends messages
+	receiver      bool
+	source        string
+	target        string
+	credit        uint32
+	deliveryCount uint32
+}
+
+type fakeSession struct {
+	channel        uint16
+	nextOutgoingID uint32
+	nextIncomingID uint32
+	links          map[uint32]*fakeLink
+	// unsettled are the queue messages sent to the client, by delivery id
+	unsettled map[uint32]*fakeMessage
+}
+
+type fakeConn struct {
+	bus      *fakeServiceBus
+	conn     net.Conn
+	r        *bufio.Reader
+	sessions map[uint16]*fakeSession
+}
+
+func (c *fakeConn) writeFrame(typ byte, channel uint16, performative uint64, fields []any, payload []byte) error {
+	var body bytes.Buffer
+	encode(&body, described{descriptor: performative, value: fields})
+	body.Write(payload)
+
+	var hdr [8]byte
+	binary.BigEndian.PutUint32(hdr[:4], uint32(8+body.Len()))
+	hdr[4] = 2
+	hdr[5] = typ
+	binary.BigEndian.PutUint16(hdr[6:], channel)
+	_, err := c.conn.Write(append(hdr[:], body.Bytes()...))
+	return err
+}
+
+func (c *fakeConn) readFrame() (*frame, error) {
+	var hdr [8]byte
+	if _, err := io.ReadFull(c.r, hdr[:]); err != nil {
+		return nil, err
+	}
+	size := binary.BigEndian.Uint32(hdr[:4])
+	body := make([]byte, size-8)
+	if _, err := io.ReadFull(c.r, body); err != nil {
+		return nil, err
+	}
+	body = body[int(hdr[4])*4-8:]
+	f := &frame{typ: hdr[5], channel: binary.BigEndian.Uint16(hdr[6:])}
+	if len(body) == 0 {
+		// heartbeat
+		return f, nil
+	}
+
+	d := &decoder{r: bytes.NewReader(body)}
+	perf := d.decode().(described)
+	f.performer = perf.descriptor.(uint64)
+	f.fields, _ = perf.value.([]any)
+	f.payload = body[len(body)-d.r.Len():]
+	return f, nil
+}
+
+// handshake exchanges the protocol headers and authenticates anonymously
+func (c *fakeConn) handshake() error {
+	var hdr [8]byte
+	if _, err := io.ReadFull(c.r, hdr[:]); err != nil {
+		return err
+	}
+	if _, err := c.conn.Write(hdr[:]); err != nil {
+		return err
+	}
+	if hdr[4] == 3 {
+		if err := c.writeFrame(frameSASL, 0, saslMechanisms, []any{symbolArray{"ANONYMOUS"}}, nil); err != nil {
+			return err
+		}
+		if _, err := c.readFrame(); err != nil {
+			return err
+		}
+		if err := c.writeFrame(frameSASL, 0, saslOutcome, []any{uint8(0)}, nil); err != nil {
+			return err
+		}
+		return c.handshake()
+	}
+	return nil
+}
+
+func (c *fakeConn) serve() error {
+	if err := c.handshake(); err != nil {
+		return err
+	}
+
+	for {
+		f, err := c.readFrame()
+		if err != nil {
+			return err
+		}
+		if f.fields == nil && f.performer == 0 {
+			continue
+		}
+
+		done, err := c.handle(f)
+		if err != nil || done {
+			return err
+		}
+		if err := c.deliver(); err != nil {
+			return err
+		}
+	}
+}
+
+func (c *fakeConn) handle(f *frame) (bool, error) {
+	s := c.sessions[f.channel]
+	switch f.performer {
+	case perfOpen:
+		return false, c.writeFrame(frameAMQP, 0, perfOpen, []any{"fake-service-bus", nil, uint32(65536), uint16(65535)}, nil)
+	case perfBegin:
+		nextIncoming, _ := fieldUint32(f.fields, 1)
+		c.sessions[f.channel] = &fakeSession{
+			channel:        f.channel,
+			nextIncomingID: nextIncoming,
+			links:          make(map[uint32]*fakeLink),
+			unsettled:      make(map[uint32]*fakeMessage),
+		}
+		return false, c.writeFrame(frameAMQP, f.channel, perfBegin, []any{f.channel, uint32(0), uint32(5000), uint32(5000), uint32(math.MaxUint32)}, nil)
+	case perfAttach:
+		return false, c.attach(s, f)
+	case perfFlow:
+		return false, c.flow(s, f)
+	case perfTransfer:
+		return false, c.transfer(s, f)
+	case perfDisposition:
+		return false, c.disposition(s, f)
+	case perfDetach:
+		handle, _ := fieldUint32(f.fields, 0)
+		delete(s.links, handle)
+		return false, c.writeFrame(frameAMQP, f.channel, perfDetach, []any{handle, true}, nil)
+	case perfEnd:
+		c.release(s)
+		delete(c.sessions, f.channel)
+		return false, c.writeFrame(frameAMQP, f.channel, perfEnd, []any{}, nil)
+	case perfClose:
+		for _, s := range c.sessions {
+			c.release(s)
+		}
+		return true, c.writeFrame(frameAMQP, 0, perfClose, []any{}, nil)
+	}
+	return false, fmt.Errorf("unexpected performative 0x%x", f.performer)
+}
+
+func (c *fakeConn) attach(s *fakeSession, f *frame) error {
+	name, _ := field(f.fields, 0).(string)
+	handle, _ := fieldUint32(f.fields, 1)
+	receiver, _ := field(f.fields, 2).(bool)
+	l := &fakeLink{
+		handle:   handle,
+		receiver: receiver,
+		source:   address(field(f.fields, 5)),
+		target:   address(field(f.fields, 6)),
+	}
+	s.links[handle] = l
+
+	var initialDeliveryCount any
+	if receiver {
+		initialDeliveryCount = uint32(0)
+	} else {
+		l.deliveryCount, _ = fieldUint32(f.fields, 9)
+	}
+	err := c.writeFrame(frameAMQP, s.channel, perfAttach, []any{
+		name, handle, !receiver, field(f.fields, 3), field(f.fields, 4),
+		described{descriptor: uint64(typeSource), value: []any{l.source}},
+		described{descriptor: uint64(typeTarget), value: []any{l.target}},
+		nil, false, initialDeliveryCount,
+	}, nil)
+	if err != nil || receiver {
+		return err
+	}
+
+	// let the client send requests
+	return c.writeFrame(frameAMQP, s.channel, perfFlow, []any{
+		s.nextIncomingID, uint32(5000), s.nextOutgoingID, uint32(5000), handle, l.deliveryCount, uint32(100),
+	}, nil)
+}
+
+func (c *fakeConn) flow(s *fakeSession, f *frame) error {
+	handle, ok := fieldUint32(f.fields, 4)
+	if !ok {
+		return nil
+	}
+	l := s.links[handle]
+	if l == nil || !l.receiver {
+		return nil
+	}
+	deliveryCount, _ := fieldUint32(f.fields, 5)
+	credit, _ := fieldUint32(f.fields, 6)
+	l.credit = deliveryCount + credit - l.deliveryCount
+	if drain, _ := field(f.fields, 8).(bool); drain {
+		if err := c.deliver(); err != nil {
+			return err
+		}
+		l.deliveryCount += l.credit
+		l.credit = 0
+		return c.writeFrame(frameAMQP, s.channel, perfFlow, []any{
+			s.nextIncomingID, uint32(5000), s.nextOutgoingID, uint32(5000), handle, l.deliveryCount, uint32(0), nil, true,
+		}, nil)
+	}
+	return nil
+}
+
+// transfer answers the requests sent to $cbs and $management
+func (c *fakeConn) transfer(s *fakeSession, f *frame) error {
+	deliveryID, _ := fieldUint32(f.fields, 1)
+	s.nextIncomingID++
+	if settled, _ := field(f.fields, 4).(bool); !settled {
+		err := c.writeFrame(frameAMQP, s.channel, perfDisposition, []any{
+			true, deliveryID, deliveryID, true, described{descriptor: uint64(typeAccepted), value: []any{}},
+		}, nil)
+		if err != nil {
+			return err
+		}
+	}
+
+	handle, _ := fieldUint32(f.fields, 0)
+	l := s.links[handle]
+	var req amqp.Message
+	if err := req.UnmarshalBinary(f.payload); err != nil {
+		return err
+	}
+	if req.Properties == nil || req.Properties.ReplyTo == nil {
+		return nil
+	}
+
+	status := int32(200)
+	if l.target == "$cbs" {
+		c.bus.mu.Lock()
+		c.bus.claims = append(c.bus.claims, fmt.Sprint(req.ApplicationProperties["name"]))
+		c.bus.mu.Unlock()
+		status = 202
+	}
+	res := &amqp.Message{
+		Properties:            &amqp.MessageProperties{CorrelationID: req.Properties.MessageID},
+		ApplicationProperties: map[string]any{"status-code": status, "status-description": "OK"},
+		Value:                 map[string]any{},
+	}
+	for _, reply := range s.links {
+		if reply.receiver && reply.target == *req.Properties.ReplyTo {
+			return c.send(s, reply, res, nil, true)
+		}
+	}
+	return fmt.Errorf("no link for reply to %s", *req.Properties.ReplyTo)
+}
+
+func (c *fakeConn) send(s *fakeSession, l *fakeLink, msg *amqp.Message, tag []byte, settled bool) error {
+	payload, err := msg.MarshalBinary()
+	if err != nil {
+		return err
+	}
+	if tag == nil {
+		tag = binary.BigEndian.AppendUint32(nil, s.nextOutgoingID)
+	}
+	deliveryID := s.nextOutgoingID
+	s.nextOutgoingID++
+	l.deliveryCount++
+	if l.credit > 0 {
+		l.credit--
+	}
+	return c.writeFrame(frameAMQP, s.channel, perfTransfer, []any{
+		l.handle, deliveryID, tag, uint32(0), settled, false,
+	}, payload)
+}
+
+// deliver sends the available messages to the links receiving from the queue that have credit
+func (c *fakeConn) deliver() error {
+	c.bus.mu.Lock()
+	defer c.bus.mu.Unlock()
+
+	for _, s := range c.sessions {
+		for _, l := range s.links {
+			for l.receiver && l.source == c.bus.queue && l.credit > 0 && len(c.bus.available) > 0 {
+				m := c.bus.available[0]
+				c.bus.available = c.bus.available[1:]
+				m.lockedAt = time.Now()
+
+				var lockToken [16]byte
+				copy(lockToken[:], m.id)
+				msg := &amqp.Message{
+					Header: &amqp.MessageHeader{DeliveryCount: m.deliveryCount},
+					Annotations: amqp.Annotations{
+						"x-opt-enqueued-time":   m.enqueued,
+						"x-opt-locked-until":    m.lockedAt.Add(c.bus.lockDuration),
+						"x-opt-sequence-number": int64(len(c.bus.completed) + len(c.bus.available)),
+					},
+					Properties: &amqp.MessageProperties{MessageID: m.id},
+					Data:       [][]byte{m.body},
+				}
+				s.unsettled[s.nextOutgoingID] = m
+				if err := c.send(s, l, msg, lockToken[:], false); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	return nil
+}
+
+func (c *fakeConn) disposition(s *fakeSession, f *frame) error {
+	first, _ := fieldUint32(f.fields, 1)
+	last, ok := fieldUint32(f.fields, 2)
+	if !ok {
+		last = first
+	}
+	settled, _ := field(f.fields, 3).(bool)
+	state, _ := field(f.fields, 4).(described)
+	outcome, _ := state.descriptor.(uint64)
+
+	c.bus.mu.Lock()
+	for id := first; id <= last; id++ {
+		m := s.unsettled[id]
+		if m == nil {
+			continue
+		}
+		delete(s.unsettled, id)
+		c.bus.settlements = append(c.bus.settlements, settlement{id: m.id, outcome: outcome, after: time.Since(m.lockedAt)})
+		switch outcome {
+		case typeAccepted:
+			c.bus.completed = append(c.bus.completed, m)
+		case typeRejected:
+			c.bus.deadLetter = append(c.bus.deadLetter, m)
+		case typeReleased:
+			c.bus.available = append(c.bus.available, m)
+		case typeModified:
+			// abandoning a message increments its delivery count, until it's dead-lettered
+			m.deliveryCount++
+			if m.deliveryCount >= c.bus.maxDeliveryCount {
+				c.bus.deadLetter = append(c.bus.deadLetter, m)
+			} else {
+				c.bus.available = append(c.bus.available, m)
+			}
+		}
+	}
+	c.bus.mu.Unlock()
+
+	if settled {
+		return nil
+	}
+	return c.writeFrame(frameAMQP, s.channel, perfDisposition, []any{
+		false, first, last, true, described{descriptor: outcome, value: []any{}},
+	}, nil)
+}
+
+// release makes the unsettled messages of a session available again, as if their lock expired
+func (c *fakeConn) release(s *fakeSession) {
+	c.bus.mu.Lock()
+	defer c.bus.mu.Unlock()
+	for id, m := range s.unsettled {
+		delete(s.unsettled, id)
+		m.deliveryCount++
+		c.bus.available = append(c.bus.available, m)
+	}
+}
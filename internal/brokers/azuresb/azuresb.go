@@ -0,0 +1,133 @@
+/*
+Copyright (c) 2022 RaptorML authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package azuresb
+
+import (
+	"context"
+	"fmt"
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore"
+	"github.com/Azure/azure-sdk-for-go/sdk/azidentity"
+	servicebus "github.com/Azure/azure-sdk-for-go/sdk/messaging/azservicebus"
+	"github.com/raptor-ml/raptor/api/v1alpha1"
+	"github.com/raptor-ml/streaming-runner/pkg/brokers"
+	"gocloud.dev/pubsub"
+	"gocloud.dev/pubsub/azuresb"
+	"gocloud.dev/pubsub/batcher"
+)
+
+func init() {
+	brokers.Register("azure_servicebus", &provider{})
+}
+
+type provider struct {
+	// clientOptions are passed to the service bus client, e.g. to connect through a custom net.Conn
+	clientOptions *servicebus.ClientOptions
+}
+type ContextKey string
+
+const EntityContextKey ContextKey = "entity"
+
+func (p *provider) Metadata(ctx context.Context, msg *pubsub.Message) brokers.Metadata {
+	var md brokers.Metadata
+	var m *servicebus.ReceivedMessage
+	if ok := msg.As(&m); ok {
+		md.ID = m.MessageID
+		md.Topic = ctx.Value(EntityContextKey).(string)
+		if m.EnqueuedTime != nil {
+			md.Timestamp = *m.EnqueuedTime
+		}
+	}
+	return md
+}
+
+type config struct {
+	ConnectionString string `mapstructure:"connection_string"`
+	// Namespace is the fully qualified namespace (e.g. `<name>.servicebus.windows.net`) used with Azure AD auth.
+	Namespace string `mapstructure:"namespace"`
+	// ManagedIdentityClientID selects a user-assigned managed identity. When empty, the default Azure credential chain is used.
+	ManagedIdentityClientID string `mapstructure:"managed_identity_client_id"`
+
+	Topic        string `mapstructure:"topic"`
+	Subscription string `mapstructure:"subscription"`
+	Queue        string `mapstructure:"queue"`
+
+	MaxBatchSize int `mapstructure:"max_batch_size"`
+}
+
+func (p *provider) Subscribe(ctx context.Context, c v1alpha1.ParsedConfig) (context.Context, *pubsub.Subscription, error) {
+	cfg := config{}
+	err := c.Unmarshal(&cfg)
+	if err != nil {
+		return ctx, nil, fmt.Errorf("failed to unmarshal config: %w", err)
+	}
+
+	if cfg.Queue == "" && (cfg.Topic == "" || cfg.Subscription == "") {
+		return ctx, nil, fmt.Errorf("either queue or topic and subscription are required to connect to service bus")
+	}
+	if cfg.Queue != "" && cfg.Topic != "" {
+		return ctx, nil, fmt.Errorf("queue and topic are mutually exclusive")
+	}
+
+	client, err := newClient(cfg, p.clientOptions)
+	if err != nil {
+		return ctx, nil, fmt.Errorf("failed to create service bus client: %w", err)
+	}
+	go func(ctx context.Context) {
+		<-ctx.Done()
+		_ = client.Close(context.Background())
+	}(ctx)
+
+	var receiver *servicebus.Receiver
+	if cfg.Queue != "" {
+		ctx = context.WithValue(ctx, EntityContextKey, cfg.Queue)
+		receiver, err = client.NewReceiverForQueue(cfg.Queue, nil)
+	} else {
+		ctx = context.WithValue(ctx, EntityContextKey, cfg.Topic)
+		receiver, err = azuresb.NewReceiver(client, cfg.Topic, cfg.Subscription, nil)
+	}
+	if err != nil {
+		return ctx, nil, fmt.Errorf("failed to create service bus receiver: %w", err)
+	}
+
+	sub, err := azuresb.OpenSubscription(ctx, client, receiver, &azuresb.SubscriptionOptions{
+		ReceiveBatcherOptions: batcher.Options{MaxBatchSize: cfg.MaxBatchSize},
+	})
+	return ctx, sub, err
+}
+
+func newClient(cfg config, opts *servicebus.ClientOptions) (*servicebus.Client, error) {
+	if cfg.ConnectionString != "" {
+		return azuresb.NewClientFromConnectionString(cfg.ConnectionString, opts)
+	}
+	if cfg.Namespace == "" {
+		return nil, fmt.Errorf("either connection_string or namespace is required")
+	}
+
+	var cred azcore.TokenCredential
+	var err error
+	if cfg.ManagedIdentityClientID != "" {
+		cred, err = azidentity.NewManagedIdentityCredential(&azidentity.ManagedIdentityCredentialOptions{
+			ID: azidentity.ClientID(cfg.ManagedIdentityClientID),
+		})
+	} else {
+		cred, err = azidentity.NewDefaultAzureCredential(nil)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to create azure credential: %w", err)
+	}
+	return servicebus.NewClient(cfg.Namespace, cred, opts)
+}
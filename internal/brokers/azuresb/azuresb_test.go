@@ -0,0 +1,105 @@
+/*
+Copyright (c) 2022 RaptorML authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package azuresb
+
+import (
+	"context"
+	servicebus "github.com/Azure/azure-sdk-for-go/sdk/messaging/azservicebus"
+	"github.com/raptor-ml/raptor/api/v1alpha1"
+	"github.com/raptor-ml/streaming-runner/internal/brokers/brokertest"
+	"gocloud.dev/pubsub"
+	"net"
+	"testing"
+	"time"
+)
+
+const testConnectionString = "Endpoint=sb://fake.servicebus.windows.net/;SharedAccessKeyName=test;SharedAccessKey=dGVzdA=="
+
+func subscribe(t *testing.T, f *fakeServiceBus) (context.Context, *pubsub.Subscription) {
+	t.Helper()
+	p := &provider{clientOptions: &servicebus.ClientOptions{
+		NewWebSocketConn: func(ctx context.Context, _ servicebus.NewWebSocketConnArgs) (net.Conn, error) {
+			var d net.Dialer
+			return d.DialContext(ctx, "tcp", f.addr())
+		},
+	}}
+	return brokertest.Subscribe(t, p, v1alpha1.ParsedConfig{
+		"connection_string": testConnectionString,
+		"queue":             f.queue,
+	})
+}
+
+func TestReceiveAndComplete(t *testing.T) {
+	f := newFakeServiceBus(t, "orders", `{"a":1}`)
+	ctx, sub := subscribe(t, f)
+
+	msg, err := sub.Receive(ctx)
+	if err != nil {
+		t.Fatalf("Receive() error = %v", err)
+	}
+	if string(msg.Body) != `{"a":1}` {
+		t.Errorf("Body = %s", msg.Body)
+	}
+	md := (&provider{}).Metadata(ctx, msg)
+	if md.ID != "msg-0" || md.Topic != "orders" || !md.Timestamp.Equal(time.UnixMilli(1700000000000)) {
+		t.Errorf("Metadata() = %+v", md)
+	}
+
+	msg.Ack()
+	brokertest.Eventually(t, &f.mu, func() bool { return len(f.completed) == 1 })
+	if len(f.available) != 0 || len(f.deadLetter) != 0 {
+		t.Errorf("available = %d, dead-lettered = %d after complete", len(f.available), len(f.deadLetter))
+	}
+	if len(f.claims) == 0 {
+		t.Errorf("no claims were negotiated")
+	}
+}
+
+func TestAbandonUntilDeadLetter(t *testing.T) {
+	f := newFakeServiceBus(t, "orders", `{"a":1}`)
+	ctx, sub := subscribe(t, f)
+
+	// every failure abandons the message, until service bus dead-letters it after the max delivery count
+	for i := uint32(0); i < f.maxDeliveryCount; i++ {
+		msg, err := sub.Receive(ctx)
+		if err != nil {
+			t.Fatalf("Receive() error = %v", err)
+		}
+		var sbmsg *servicebus.ReceivedMessage
+		if !msg.As(&sbmsg) || sbmsg.DeliveryCount != i+1 {
+			t.Fatalf("delivery %d has delivery count %d", i, sbmsg.DeliveryCount)
+		}
+		msg.Nack()
+		brokertest.Eventually(t, &f.mu, func() bool { return len(f.settlements) == int(i)+1 })
+	}
+	brokertest.Eventually(t, &f.mu, func() bool { return len(f.deadLetter) == 1 })
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if len(f.completed) != 0 || len(f.available) != 0 {
+		t.Errorf("completed = %d, available = %d after dead-lettering", len(f.completed), len(f.available))
+	}
+	for _, s := range f.settlements {
+		if s.outcome != typeModified {
+			t.Errorf("message %s settled with 0x%x, want abandon (modified)", s.id, s.outcome)
+		}
+		// the message must be abandoned while it's still locked, or the lock expiry would redeliver it instead
+		if s.after >= f.lockDuration {
+			t.Errorf("message %s was abandoned %s after it was locked, beyond the lock duration of %s", s.id, s.after, f.lockDuration)
+		}
+	}
+}
@@ -0,0 +1,65 @@
+/*
+Copyright (c) 2022 RaptorML authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package brokertest provides helpers for testing broker drivers against fake brokers.
+package brokertest
+
+import (
+	"context"
+	"github.com/raptor-ml/raptor/api/v1alpha1"
+	"github.com/raptor-ml/streaming-runner/pkg/brokers"
+	"gocloud.dev/pubsub"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sync"
+	"testing"
+	"time"
+)
+
+// Timeout bounds each test using Subscribe
+const Timeout = 30 * time.Second
+
+// Subscribe subscribes to the broker with the config for the rest of the test.
+// The returned context carries a test DataSource and expires after Timeout.
+func Subscribe(t *testing.T, b brokers.Broker, config v1alpha1.ParsedConfig) (context.Context, *pubsub.Subscription) {
+	t.Helper()
+	ctx, cancel := context.WithTimeout(context.Background(), Timeout)
+	t.Cleanup(cancel)
+	ctx = brokers.ContextWithDataSource(ctx, &v1alpha1.DataSource{ObjectMeta: metav1.ObjectMeta{Name: "test", Namespace: "default"}})
+
+	ctx, sub, err := b.Subscribe(ctx, config)
+	if err != nil {
+		t.Fatalf("Subscribe() error = %v", err)
+	}
+	t.Cleanup(func() { _ = sub.Shutdown(context.Background()) })
+	return ctx, sub
+}
+
+// Eventually waits for the condition, which is checked while holding mu. Acks and nacks are sent in the
+// background, so tests wait for the fake broker to observe them.
+func Eventually(t *testing.T, mu sync.Locker, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(10 * time.Second)
+	for time.Now().Before(deadline) {
+		mu.Lock()
+		ok := cond()
+		mu.Unlock()
+		if ok {
+			return
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	t.Fatal("condition not met before the deadline")
+}
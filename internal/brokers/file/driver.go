@@ -0,0 +1,321 @@
+/*
+Copyright (c) 2022 RaptorML authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package file
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/go-logr/logr"
+	"gocloud.dev/gcerrors"
+	"gocloud.dev/pubsub/driver"
+	"io"
+	"os"
+	"strings"
+	"time"
+)
+
+// record is a single message read from a file
+type record struct {
+	file      string
+	index     int
+	body      []byte
+	timestamp time.Time
+}
+
+// subscription implements driver.Subscription by reading the files sequentially.
+// Acks are no-ops, and once all the files were replayed the subscription stays idle.
+// Files that can't be read and records that can't be parsed are logged and skipped.
+type subscription struct {
+	files          []string
+	format         string
+	timestampField string
+	speed          float64
+	maxMessageSize int
+	logger         logr.Logger
+
+	cur     int
+	f       *os.File
+	gz      *gzip.Reader
+	r       *bufio.Reader
+	index   int
+	pending *record
+
+	// replay clock: the wall time at which the first timestamped record was emitted and its timestamp
+	wallStart   time.Time
+	recordStart time.Time
+}
+
+func (s *subscription) ReceiveBatch(ctx context.Context, maxMessages int) ([]*driver.Message, error) {
+	var dms []*driver.Message
+	for len(dms) < maxMessages {
+		rec := s.pending
+		s.pending = nil
+		if rec == nil {
+			var err error
+			rec, err = s.next()
+			if errors.Is(err, io.EOF) {
+				if len(dms) == 0 {
+					// all the files were replayed
+					return nil, sleep(ctx, time.Second)
+				}
+				return dms, nil
+			}
+			if err != nil {
+				return dms, err
+			}
+		}
+
+		if wait := s.delay(rec); wait > 0 {
+			s.pending = rec
+			if len(dms) > 0 {
+				return dms, nil
+			}
+			if wait > time.Second {
+				wait = time.Second
+			}
+			return nil, sleep(ctx, wait)
+		}
+		dms = append(dms, toDriverMessage(rec))
+	}
+	return dms, nil
+}
+
+// delay returns how long to wait before emitting the record, in order to honor the original timestamps
+func (s *subscription) delay(rec *record) time.Duration {
+	if s.speed == 0 || rec.timestamp.IsZero() {
+		return 0
+	}
+	if s.wallStart.IsZero() {
+		s.wallStart = time.Now()
+		s.recordStart = rec.timestamp
+		return 0
+	}
+	offset := time.Duration(float64(rec.timestamp.Sub(s.recordStart)) / s.speed)
+	return time.Until(s.wallStart.Add(offset))
+}
+
+func sleep(ctx context.Context, d time.Duration) error {
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-t.C:
+		return nil
+	}
+}
+
+func toDriverMessage(rec *record) *driver.Message {
+	return &driver.Message{
+		LoggableID: fmt.Sprintf("%s:%d", rec.file, rec.index),
+		Body:       rec.body,
+		AckID:      rec.index,
+		AsFunc: func(i any) bool {
+			p, ok := i.(**record)
+			if !ok {
+				return false
+			}
+			*p = rec
+			return true
+		},
+	}
+}
+
+// next reads the next record, moving to the following file when the current one is exhausted or can't be read.
+// It returns io.EOF once all the files were read.
+func (s *subscription) next() (*record, error) {
+	for {
+		if s.r == nil {
+			if s.cur >= len(s.files) {
+				return nil, io.EOF
+			}
+			if err := s.open(s.files[s.cur]); err != nil {
+				s.logger.Error(err, "skipping file")
+				s.cur++
+				continue
+			}
+		}
+
+		body, err := s.read()
+		if err != nil {
+			// a corrupted or truncated file can't be resynchronized, so the rest of it is skipped
+			if !errors.Is(err, io.EOF) {
+				s.logger.Error(err, "skipping the rest of the file", "file", s.files[s.cur], "index", s.index)
+			}
+			_ = s.closeFile()
+			s.cur++
+			continue
+		}
+
+		s.index++
+		rec := &record{file: s.files[s.cur], index: s.index, body: body}
+		if s.timestampField != "" {
+			rec.timestamp, err = extractTimestamp(body, s.timestampField)
+			if err != nil {
+				s.logger.Error(err, "skipping record without a valid timestamp", "file", rec.file, "index", rec.index)
+				continue
+			}
+		}
+		return rec, nil
+	}
+}
+
+func (s *subscription) open(name string) error {
+	f, err := os.Open(name)
+	if err != nil {
+		return fmt.Errorf("failed to open %s: %w", name, err)
+	}
+	br := bufio.NewReader(f)
+
+	// detect gzip by its magic bytes
+	if magic, err := br.Peek(2); err == nil && magic[0] == 0x1f && magic[1] == 0x8b {
+		gz, err := gzip.NewReader(br)
+		if err != nil {
+			_ = f.Close()
+			return fmt.Errorf("failed to decompress %s: %w", name, err)
+		}
+		s.gz = gz
+		br = bufio.NewReader(gz)
+	}
+
+	s.f, s.r, s.index = f, br, 0
+	return nil
+}
+
+// closeFile closes the current file, and its gzip reader if it's compressed
+func (s *subscription) closeFile() error {
+	var err error
+	if s.gz != nil {
+		err = s.gz.Close()
+	}
+	if ferr := s.f.Close(); err == nil {
+		err = ferr
+	}
+	s.f, s.gz, s.r = nil, nil, nil
+	return err
+}
+
+func (s *subscription) read() ([]byte, error) {
+	if s.format == formatProtobuf {
+		size, err := binary.ReadUvarint(s.r)
+		if err != nil {
+			return nil, err
+		}
+		if size > uint64(s.maxMessageSize) {
+			return nil, fmt.Errorf("message of %d bytes exceeds max_message_size", size)
+		}
+		body := make([]byte, size)
+		if _, err := io.ReadFull(s.r, body); err != nil {
+			return nil, fmt.Errorf("truncated message: %w", err)
+		}
+		return body, nil
+	}
+
+	for {
+		line, err := s.readLine()
+		line = bytes.TrimSpace(line)
+		if len(line) > 0 {
+			return line, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+}
+
+// readLine reads up to the next newline, failing once the line exceeds the max message size
+func (s *subscription) readLine() ([]byte, error) {
+	var line []byte
+	for {
+		frag, err := s.r.ReadSlice('\n')
+		if len(line)+len(frag) > s.maxMessageSize {
+			return nil, fmt.Errorf("line exceeds max_message_size of %d bytes", s.maxMessageSize)
+		}
+		line = append(line, frag...)
+		if !errors.Is(err, bufio.ErrBufferFull) {
+			return line, err
+		}
+	}
+}
+
+func extractTimestamp(body []byte, field string) (time.Time, error) {
+	var v any
+	if err := json.Unmarshal(body, &v); err != nil {
+		return time.Time{}, err
+	}
+	for _, k := range strings.Split(field, ".") {
+		m, ok := v.(map[string]any)
+		if !ok {
+			return time.Time{}, fmt.Errorf("field %s is missing", field)
+		}
+		v = m[k]
+	}
+
+	switch ts := v.(type) {
+	case string:
+		return time.Parse(time.RFC3339Nano, ts)
+	case float64:
+		return time.UnixMilli(int64(ts)), nil
+	case nil:
+		return time.Time{}, fmt.Errorf("field %s is missing", field)
+	}
+	return time.Time{}, fmt.Errorf("field %s is not a timestamp", field)
+}
+
+func (s *subscription) SendAcks(context.Context, []driver.AckID) error {
+	return nil
+}
+
+func (s *subscription) CanNack() bool {
+	return false
+}
+
+func (s *subscription) SendNacks(context.Context, []driver.AckID) error {
+	panic("unreachable")
+}
+
+func (s *subscription) IsRetryable(error) bool {
+	return false
+}
+
+func (s *subscription) As(any) bool {
+	return false
+}
+
+func (s *subscription) ErrorAs(error, any) bool {
+	return false
+}
+
+func (s *subscription) ErrorCode(err error) gcerrors.ErrorCode {
+	if errors.Is(err, os.ErrNotExist) {
+		return gcerrors.NotFound
+	}
+	return gcerrors.Unknown
+}
+
+func (s *subscription) Close() error {
+	if s.f != nil {
+		return s.closeFile()
+	}
+	return nil
+}
@@ -0,0 +1,140 @@
+/*
+Copyright (c) 2022 RaptorML authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package file implements a broker that replays captured traffic from local files.
+package file
+
+import (
+	"context"
+	"fmt"
+	"github.com/go-logr/logr"
+	"github.com/raptor-ml/raptor/api/v1alpha1"
+	"github.com/raptor-ml/streaming-runner/pkg/brokers"
+	"gocloud.dev/pubsub"
+	"gocloud.dev/pubsub/batcher"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+func init() {
+	brokers.Register("file", &provider{})
+}
+
+type provider struct{}
+
+func (p *provider) Metadata(_ context.Context, msg *pubsub.Message) brokers.Metadata {
+	var md brokers.Metadata
+	var r *record
+	if ok := msg.As(&r); ok {
+		md.Topic = r.file
+		md.ID = fmt.Sprintf("%s:%d", r.file, r.index)
+		md.Timestamp = r.timestamp
+		if md.Timestamp.IsZero() {
+			md.Timestamp = time.Now()
+		}
+	}
+	return md
+}
+
+const (
+	formatNDJSON   = "ndjson"
+	formatProtobuf = "protobuf"
+
+	defaultMaxMessageSize = 10 << 20
+)
+
+type config struct {
+	// Path is a file path or a glob pattern. Matching files are replayed in lexical order.
+	// Gzip compressed files are detected automatically.
+	Path string `mapstructure:"path"`
+	// Format is either `ndjson` (default) or `protobuf` for uvarint length-prefixed protobuf messages.
+	Format string `mapstructure:"format"`
+
+	// TimestampField is the (dot separated) field of NDJSON records holding the original event time,
+	// either as an RFC3339 string or as unix epoch milliseconds. Records without a valid timestamp are skipped.
+	// Protobuf records can't be inspected, so they don't support it.
+	TimestampField string `mapstructure:"timestamp_field"`
+	// Speed replays the records honoring their original timestamps, e.g. `1` for real-time or `10` for 10x faster.
+	// When zero, records are replayed as fast as possible.
+	Speed float64 `mapstructure:"speed"`
+	// MaxMessageSize bounds the size of a record. A larger record is considered corrupted, so the rest of its file is
+	// skipped.
+	MaxMessageSize int `mapstructure:"max_message_size"`
+
+	MaxBatchSize int `mapstructure:"max_batch_size"`
+}
+
+func (p *provider) Subscribe(ctx context.Context, c v1alpha1.ParsedConfig) (context.Context, *pubsub.Subscription, error) {
+	cfg := config{}
+	err := c.Unmarshal(&cfg)
+	if err != nil {
+		return ctx, nil, fmt.Errorf("failed to unmarshal config: %w", err)
+	}
+
+	if cfg.Path == "" {
+		return ctx, nil, fmt.Errorf("path required to replay files")
+	}
+	cfg.Format = strings.ToLower(cfg.Format)
+	if cfg.Format == "" {
+		cfg.Format = formatNDJSON
+	}
+	if cfg.Format != formatNDJSON && cfg.Format != formatProtobuf {
+		return ctx, nil, fmt.Errorf("file error: invalid format: %s", cfg.Format)
+	}
+	if cfg.Speed < 0 {
+		return ctx, nil, fmt.Errorf("file error: invalid speed: %s", strconv.FormatFloat(cfg.Speed, 'f', -1, 64))
+	}
+	if cfg.Speed > 0 && cfg.TimestampField == "" {
+		return ctx, nil, fmt.Errorf("timestamp_field required to replay with speed")
+	}
+	if cfg.Format == formatProtobuf && cfg.TimestampField != "" {
+		return ctx, nil, fmt.Errorf("file error: timestamp_field and speed are not supported with the protobuf format")
+	}
+	if cfg.MaxMessageSize < 0 {
+		return ctx, nil, fmt.Errorf("file error: invalid max_message_size: %d", cfg.MaxMessageSize)
+	}
+	if cfg.MaxMessageSize == 0 {
+		cfg.MaxMessageSize = defaultMaxMessageSize
+	}
+	if cfg.MaxBatchSize == 0 {
+		cfg.MaxBatchSize = 100
+	}
+
+	files, err := filepath.Glob(cfg.Path)
+	if err != nil {
+		return ctx, nil, fmt.Errorf("invalid path: %w", err)
+	}
+	if len(files) == 0 {
+		return ctx, nil, fmt.Errorf("no files match %s", cfg.Path)
+	}
+	sort.Strings(files)
+
+	sub := pubsub.NewSubscription(&subscription{
+		files:          files,
+		format:         cfg.Format,
+		timestampField: cfg.TimestampField,
+		speed:          cfg.Speed,
+		maxMessageSize: cfg.MaxMessageSize,
+		logger:         logr.FromContextOrDiscard(ctx),
+	}, &batcher.Options{
+		MaxBatchSize: cfg.MaxBatchSize,
+		MaxHandlers:  1,
+	}, nil)
+	return ctx, sub, nil
+}
@@ -0,0 +1,212 @@
+/*
+Copyright (c) 2022 RaptorML authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package file
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/binary"
+	"errors"
+	"github.com/go-logr/logr"
+	"github.com/raptor-ml/raptor/api/v1alpha1"
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func gzipped(t *testing.T, data string) string {
+	t.Helper()
+	var buf bytes.Buffer
+	w := gzip.NewWriter(&buf)
+	if _, err := w.Write([]byte(data)); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.String()
+}
+
+func lengthPrefixed(msgs ...string) string {
+	var buf bytes.Buffer
+	for _, m := range msgs {
+		buf.Write(binary.AppendUvarint(nil, uint64(len(m))))
+		buf.WriteString(m)
+	}
+	return buf.String()
+}
+
+func TestSubscribeValidation(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "capture.ndjson")
+	if err := os.WriteFile(path, []byte(`{"a":1}`), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		cfg     v1alpha1.ParsedConfig
+		wantErr bool
+	}{
+		{"ndjson", v1alpha1.ParsedConfig{"path": path}, false},
+		{"ndjson with speed", v1alpha1.ParsedConfig{"path": path, "timestamp_field": "ts", "speed": "2"}, false},
+		{"speed without timestamp field", v1alpha1.ParsedConfig{"path": path, "speed": "2"}, true},
+		{"protobuf", v1alpha1.ParsedConfig{"path": path, "format": "protobuf"}, false},
+		{"protobuf with timestamp field", v1alpha1.ParsedConfig{"path": path, "format": "protobuf", "timestamp_field": "ts"}, true},
+		{"protobuf with speed", v1alpha1.ParsedConfig{"path": path, "format": "protobuf", "timestamp_field": "ts", "speed": "1"}, true},
+		{"no matching files", v1alpha1.ParsedConfig{"path": path + ".missing"}, true},
+		{"negative max message size", v1alpha1.ParsedConfig{"path": path, "max_message_size": "-1"}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, sub, err := (&provider{}).Subscribe(context.Background(), tt.cfg)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Subscribe() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if sub != nil {
+				_ = sub.Shutdown(context.Background())
+			}
+		})
+	}
+}
+
+func TestReplaySkipsBadRecords(t *testing.T) {
+	tests := []struct {
+		name           string
+		format         string
+		timestampField string
+		maxMessageSize int
+		// files are replayed in the order of their names
+		files map[string]string
+		want  []string
+	}{
+		{
+			name:  "ndjson",
+			files: map[string]string{"a": "{\"a\":1}\n\n{\"a\":2}\n"},
+			want:  []string{`{"a":1}`, `{"a":2}`},
+		},
+		{
+			name:           "records without a valid timestamp",
+			timestampField: "ts",
+			files: map[string]string{"a": `{"ts":1700000000000,"a":1}
+{"a":2}
+{"ts":"yesterday","a":3}
+not json
+{"ts":"2023-11-14T22:13:20Z","a":4}
+`},
+			want: []string{`{"ts":1700000000000,"a":1}`, `{"ts":"2023-11-14T22:13:20Z","a":4}`},
+		},
+		{
+			name:  "gzip",
+			files: map[string]string{"a.gz": gzipped(t, "{\"a\":1}\n{\"a\":2}\n"), "b": `{"a":3}`},
+			want:  []string{`{"a":1}`, `{"a":2}`, `{"a":3}`},
+		},
+		{
+			name:  "corrupted gzip",
+			files: map[string]string{"a.gz": gzipped(t, "{\"a\":1}\n")[:12], "b": `{"a":2}`},
+			want:  []string{`{"a":2}`},
+		},
+		{
+			name:   "protobuf",
+			format: formatProtobuf,
+			files:  map[string]string{"a": lengthPrefixed("one", "two"), "b.gz": gzipped(t, lengthPrefixed("three"))},
+			want:   []string{"one", "two", "three"},
+		},
+		{
+			name:   "truncated protobuf",
+			format: formatProtobuf,
+			files:  map[string]string{"a": lengthPrefixed("one", "two")[:6], "b": lengthPrefixed("three")},
+			want:   []string{"one", "three"},
+		},
+		{
+			name:   "oversized protobuf",
+			format: formatProtobuf,
+			// a corrupted size must not be allocated
+			files: map[string]string{"a": lengthPrefixed("one") + string(binary.AppendUvarint(nil, 1<<62)) + "two", "b": lengthPrefixed("three")},
+			want:  []string{"one", "three"},
+		},
+		{
+			name:           "protobuf over max_message_size",
+			format:         formatProtobuf,
+			maxMessageSize: 4,
+			files:          map[string]string{"a": lengthPrefixed("one", "three", "four"), "b": lengthPrefixed("five")},
+			want:           []string{"one", "five"},
+		},
+		{
+			name:           "ndjson over max_message_size",
+			maxMessageSize: 8,
+			files:          map[string]string{"a": "{\"a\":1}\n{\"a\":100}\n{\"a\":2}\n", "b": `{"a":3}`},
+			want:           []string{`{"a":1}`, `{"a":3}`},
+		},
+		{
+			name:  "unreadable file",
+			files: map[string]string{"a/": "", "b": `{"a":1}`},
+			want:  []string{`{"a":1}`},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			for name, data := range tt.files {
+				path := filepath.Join(dir, name)
+				if name[len(name)-1] == '/' {
+					if err := os.Mkdir(path, 0o700); err != nil {
+						t.Fatal(err)
+					}
+				} else if err := os.WriteFile(path, []byte(data), 0o600); err != nil {
+					t.Fatal(err)
+				}
+			}
+			files, _ := filepath.Glob(filepath.Join(dir, "*"))
+
+			format := tt.format
+			if format == "" {
+				format = formatNDJSON
+			}
+			maxMessageSize := tt.maxMessageSize
+			if maxMessageSize == 0 {
+				maxMessageSize = defaultMaxMessageSize
+			}
+			s := &subscription{
+				files:          files,
+				format:         format,
+				timestampField: tt.timestampField,
+				maxMessageSize: maxMessageSize,
+				logger:         logr.Discard(),
+			}
+			var got []string
+			for {
+				rec, err := s.next()
+				if errors.Is(err, io.EOF) {
+					break
+				}
+				if err != nil {
+					t.Fatalf("next() error = %v", err)
+				}
+				got = append(got, string(rec.body))
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("replayed %q, want %q", got, tt.want)
+			}
+			if s.f != nil || s.gz != nil {
+				t.Errorf("the last file wasn't closed")
+			}
+		})
+	}
+}
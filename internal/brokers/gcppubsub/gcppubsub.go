@@ -46,6 +46,8 @@ func (p *provider) Metadata(ctx context.Context, msg *pubsub.Message) brokers.Me
 		md.Timestamp = m.GetPublishTime().AsTime()
 		md.ID = m.GetMessageId()
 		md.Topic = ctx.Value(TopicContextKey).(string)
+		md.Key = m.GetOrderingKey()
+		md.Headers = m.GetAttributes()
 	}
 	return md
 }
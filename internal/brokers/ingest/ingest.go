@@ -0,0 +1,173 @@
+/*
+Copyright (c) 2022 RaptorML authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package ingest implements the `grpc` broker, serving the IngestService API.
+package ingest
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/raptor-ml/raptor/api/v1alpha1"
+	"github.com/raptor-ml/streaming-runner/internal/brokers/listener"
+	"github.com/raptor-ml/streaming-runner/internal/brokers/push"
+	"github.com/raptor-ml/streaming-runner/pkg/brokers"
+	"github.com/raptor-ml/streaming-runner/pkg/ingestpb"
+	"gocloud.dev/pubsub"
+	"google.golang.org/grpc"
+	"io"
+	"sync"
+	"time"
+)
+
+func init() {
+	brokers.Register("grpc", &provider{})
+}
+
+type provider struct{}
+
+// shutdownTimeout bounds the time streams have to complete once the subscription ends
+const shutdownTimeout = 10 * time.Second
+
+const topic = "raptor.streaming.ingest.v1alpha1.IngestService"
+
+func (p *provider) Metadata(_ context.Context, msg *pubsub.Message) brokers.Metadata {
+	var md brokers.Metadata
+	var m *push.Message
+	if ok := msg.As(&m); ok {
+		md.ID = m.ID
+		md.Timestamp = m.Timestamp
+		md.Topic = topic
+		md.Attributes = m.Metadata
+	}
+	return md
+}
+
+type config struct {
+	Addr string `mapstructure:"addr"`
+	// MaxInFlight is the number of events of a single stream that may wait for acknowledgement.
+	// Once reached, the server stops reading from the stream until events are acknowledged.
+	MaxInFlight int `mapstructure:"max_in_flight"`
+
+	MaxBatchSize int `mapstructure:"max_batch_size"`
+}
+
+func (p *provider) Subscribe(ctx context.Context, c v1alpha1.ParsedConfig) (context.Context, *pubsub.Subscription, error) {
+	cfg := config{}
+	err := c.Unmarshal(&cfg)
+	if err != nil {
+		return ctx, nil, fmt.Errorf("failed to unmarshal config: %w", err)
+	}
+
+	if cfg.Addr == "" {
+		cfg.Addr = ":9090"
+	}
+	if cfg.MaxInFlight == 0 {
+		cfg.MaxInFlight = 100
+	}
+	if cfg.MaxBatchSize == 0 {
+		cfg.MaxBatchSize = 100
+	}
+
+	l, err := listener.Listen(cfg.Addr)
+	if err != nil {
+		return ctx, nil, fmt.Errorf("failed to listen on %s: %w", cfg.Addr, err)
+	}
+
+	ps := push.New(cfg.MaxBatchSize)
+	srv := grpc.NewServer()
+	ingestpb.RegisterIngestServiceServer(srv, &server{sub: ps, maxInFlight: cfg.MaxInFlight})
+	go func() {
+		_ = srv.Serve(l)
+	}()
+	go func() {
+		<-ctx.Done()
+		// events waiting to be handled fail right away, but open streams are only closed by their clients, so the
+		// graceful stop is bounded
+		ps.Close()
+		stopped := make(chan struct{})
+		go func() {
+			srv.GracefulStop()
+			close(stopped)
+		}()
+		t := time.NewTimer(shutdownTimeout)
+		defer t.Stop()
+		select {
+		case <-stopped:
+		case <-t.C:
+			srv.Stop()
+		}
+	}()
+
+	return ctx, ps.Open(cfg.MaxBatchSize), nil
+}
+
+type server struct {
+	ingestpb.UnimplementedIngestServiceServer
+	sub         *push.Subscription
+	maxInFlight int
+}
+
+func (s *server) Ingest(stream ingestpb.IngestService_IngestServer) error {
+	ctx := stream.Context()
+
+	var sendMu sync.Mutex
+	var wg sync.WaitGroup
+	defer wg.Wait()
+	inFlight := make(chan struct{}, s.maxInFlight)
+
+	for {
+		req, err := stream.Recv()
+		if errors.Is(err, io.EOF) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		select {
+		case inFlight <- struct{}{}:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+
+		m := &push.Message{
+			ID:        req.GetId(),
+			Body:      req.GetPayload(),
+			Timestamp: time.Now(),
+			Metadata:  req.GetMetadata(),
+		}
+		if req.GetTimestamp() != nil {
+			m.Timestamp = req.GetTimestamp().AsTime()
+		}
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer func() { <-inFlight }()
+
+			resp := &ingestpb.IngestResponse{Id: m.ID, Ok: true}
+			if err := s.sub.Push(ctx, m); err != nil {
+				resp.Ok = false
+				resp.Error = err.Error()
+			}
+
+			sendMu.Lock()
+			defer sendMu.Unlock()
+			_ = stream.Send(resp)
+		}()
+	}
+}
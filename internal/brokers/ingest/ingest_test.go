@@ -0,0 +1,191 @@
+/*
+Copyright (c) 2022 RaptorML authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package ingest
+
+import (
+	"context"
+	"github.com/raptor-ml/raptor/api/v1alpha1"
+	"github.com/raptor-ml/streaming-runner/internal/brokers/brokertest"
+	"github.com/raptor-ml/streaming-runner/internal/brokers/push"
+	"github.com/raptor-ml/streaming-runner/pkg/ingestpb"
+	"gocloud.dev/pubsub"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+	"net"
+	"testing"
+	"time"
+)
+
+func freeAddr(t *testing.T) string {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = ln.Close() }()
+	return ln.Addr().String()
+}
+
+func openStream(t *testing.T, addr string) ingestpb.IngestService_IngestClient {
+	t.Helper()
+	conn, err := grpc.Dial(addr, grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		t.Fatalf("Dial() error = %v", err)
+	}
+	t.Cleanup(func() { _ = conn.Close() })
+
+	ctx, cancel := context.WithTimeout(context.Background(), brokertest.Timeout)
+	t.Cleanup(cancel)
+	stream, err := ingestpb.NewIngestServiceClient(conn).Ingest(ctx)
+	if err != nil {
+		t.Fatalf("Ingest() error = %v", err)
+	}
+	return stream
+}
+
+func send(t *testing.T, stream ingestpb.IngestService_IngestClient, ids ...string) {
+	t.Helper()
+	for _, id := range ids {
+		if err := stream.Send(&ingestpb.IngestRequest{Id: id, Payload: []byte(id)}); err != nil {
+			t.Fatalf("Send() error = %v", err)
+		}
+	}
+}
+
+// responses reads n responses of the stream by event id
+func responses(t *testing.T, stream ingestpb.IngestService_IngestClient, n int) map[string]*ingestpb.IngestResponse {
+	t.Helper()
+	ret := make(map[string]*ingestpb.IngestResponse)
+	for i := 0; i < n; i++ {
+		resp, err := stream.Recv()
+		if err != nil {
+			t.Fatalf("Recv() error = %v", err)
+		}
+		ret[resp.GetId()] = resp
+	}
+	return ret
+}
+
+func receiveMessage(ctx context.Context, t *testing.T, sub *pubsub.Subscription) *pubsub.Message {
+	t.Helper()
+	msg, err := sub.Receive(ctx)
+	if err != nil {
+		t.Fatalf("Receive() error = %v", err)
+	}
+	return msg
+}
+
+func TestAcks(t *testing.T) {
+	addr := freeAddr(t)
+	ctx, sub := brokertest.Subscribe(t, &provider{}, v1alpha1.ParsedConfig{"addr": addr})
+	stream := openStream(t, addr)
+	send(t, stream, "ok", "fail")
+
+	for i := 0; i < 2; i++ {
+		msg := receiveMessage(ctx, t, sub)
+		md := (&provider{}).Metadata(ctx, msg)
+		if md.ID != string(msg.Body) || md.Topic != topic || md.Timestamp.IsZero() {
+			t.Errorf("Metadata() = %+v", md)
+		}
+		if md.ID == "fail" {
+			msg.Nack()
+		} else {
+			msg.Ack()
+		}
+	}
+
+	resps := responses(t, stream, 2)
+	if r := resps["ok"]; r == nil || !r.GetOk() {
+		t.Errorf("response of the acked event = %v", r)
+	}
+	if r := resps["fail"]; r == nil || r.GetOk() || r.GetError() != push.ErrNacked.Error() {
+		t.Errorf("response of the nacked event = %v", r)
+	}
+
+	if err := stream.CloseSend(); err != nil {
+		t.Fatalf("CloseSend() error = %v", err)
+	}
+}
+
+func TestBackpressure(t *testing.T) {
+	addr := freeAddr(t)
+	ctx, sub := brokertest.Subscribe(t, &provider{}, v1alpha1.ParsedConfig{"addr": addr, "max_in_flight": "2"})
+	stream := openStream(t, addr)
+	send(t, stream, "a", "b", "c")
+
+	// the third event isn't read from the stream until one of the first two is acknowledged
+	first := receiveMessage(ctx, t, sub)
+	receiveMessage(ctx, t, sub).Ack()
+	msg := receiveMessage(ctx, t, sub)
+	if string(msg.Body) != "c" {
+		t.Fatalf("third message = %s, want c", msg.Body)
+	}
+
+	rctx, cancel := context.WithTimeout(ctx, 200*time.Millisecond)
+	defer cancel()
+	send(t, stream, "d")
+	if extra, err := sub.Receive(rctx); err == nil {
+		t.Fatalf("Receive() = %s while max_in_flight events wait for acknowledgement", extra.Body)
+	}
+	first.Ack()
+	msg.Ack()
+	if got := receiveMessage(ctx, t, sub); string(got.Body) != "d" {
+		t.Errorf("message after the acks = %s, want d", got.Body)
+	}
+}
+
+func TestShutdownWithPendingEvent(t *testing.T) {
+	addr := freeAddr(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	if _, _, err := (&provider{}).Subscribe(ctx, v1alpha1.ParsedConfig{"addr": addr}); err != nil {
+		t.Fatalf("Subscribe() error = %v", err)
+	}
+
+	// nothing receives the event, so it waits until the subscription ends
+	stream := openStream(t, addr)
+	send(t, stream, "a")
+	time.Sleep(100 * time.Millisecond)
+	cancel()
+
+	resp := responses(t, stream, 1)["a"]
+	if resp == nil || resp.GetOk() || resp.GetError() != push.ErrClosed.Error() {
+		t.Errorf("response of the pending event = %v", resp)
+	}
+}
+
+func TestAddrAcrossUpdates(t *testing.T) {
+	addr := freeAddr(t)
+	config := v1alpha1.ParsedConfig{"addr": addr}
+
+	oldCtx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	if _, _, err := (&provider{}).Subscribe(oldCtx, config); err != nil {
+		t.Fatalf("Subscribe() error = %v", err)
+	}
+
+	// an update subscribes again right after cancelling the previous subscription, which shuts down in the background
+	cancel()
+	ctx, sub := brokertest.Subscribe(t, &provider{}, config)
+
+	stream := openStream(t, addr)
+	send(t, stream, "a")
+	receiveMessage(ctx, t, sub).Ack()
+	if resp := responses(t, stream, 1)["a"]; resp == nil || !resp.GetOk() {
+		t.Errorf("response = %v", resp)
+	}
+}
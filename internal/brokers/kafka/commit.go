@@ -0,0 +1,96 @@
+/*
+Copyright (c) 2022 RaptorML authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package kafka
+
+import (
+	"fmt"
+	"github.com/IBM/sarama"
+	"strings"
+	"time"
+)
+
+type commitStrategy int
+
+const (
+	// commitPeriodic commits the marked offsets every interval
+	commitPeriodic commitStrategy = iota
+	// commitPerMessage commits whenever an ack marks a new offset
+	commitPerMessage
+	// commitBatch commits once the number of marked messages reaches the batch size
+	commitBatch
+)
+
+// commitOptions controls when the marked offsets are committed
+type commitOptions struct {
+	strategy  commitStrategy
+	interval  time.Duration
+	batchSize int
+}
+
+func parseCommitOptions(strategy string, interval time.Duration, batchSize int) (commitOptions, error) {
+	opts := commitOptions{interval: interval, batchSize: batchSize}
+	switch strings.ToLower(strategy) {
+	case "", "periodic":
+		opts.strategy = commitPeriodic
+	case "per_message":
+		opts.strategy = commitPerMessage
+	case "batch":
+		opts.strategy = commitBatch
+	default:
+		return opts, fmt.Errorf("invalid commit_strategy: %s", strategy)
+	}
+
+	if opts.interval == 0 {
+		opts.interval = time.Second
+	}
+	if opts.batchSize == 0 {
+		opts.batchSize = 100
+	}
+	if opts.interval < 0 || opts.batchSize < 0 {
+		return opts, fmt.Errorf("commit_interval and commit_batch_size must be positive")
+	}
+	return opts, nil
+}
+
+// apply configures the offset manager of the client. Only the periodic strategy relies on auto-commit;
+// otherwise, the subscription commits explicitly.
+func (o commitOptions) apply(config *sarama.Config) {
+	config.Consumer.Offsets.AutoCommit.Enable = o.strategy == commitPeriodic
+	config.Consumer.Offsets.AutoCommit.Interval = o.interval
+}
+
+// topicPartition identifies a partition of a topic
+type topicPartition struct {
+	topic     string
+	partition int32
+}
+
+// partitionAcks are the messages of a partition that are yet to be marked, in the order they were received
+type partitionAcks []*ackInfo
+
+// advance returns the last of the acked messages at the head, the messages that remain and the number of
+// messages it skipped.
+// Kafka stores a single offset per partition, so an offset is only marked once all lower offsets are acked.
+func (p partitionAcks) advance() (*ackInfo, partitionAcks, int) {
+	var last *ackInfo
+	n := 0
+	for n < len(p) && p[n].acked {
+		last = p[n]
+		n++
+	}
+	return last, p[n:], n
+}
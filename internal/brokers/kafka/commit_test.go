@@ -0,0 +1,213 @@
+/*
+Copyright (c) 2022 RaptorML authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package kafka
+
+import (
+	"context"
+	"github.com/IBM/sarama"
+	"github.com/go-logr/logr"
+	"gocloud.dev/pubsub/driver"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestPartitionAcksAdvance(t *testing.T) {
+	tests := []struct {
+		name     string
+		acked    []bool
+		wantLast int
+		wantRest int
+	}{
+		{name: "empty", acked: nil, wantLast: -1},
+		{name: "head not acked", acked: []bool{false, true, true}, wantLast: -1, wantRest: 3},
+		{name: "all acked", acked: []bool{true, true, true}, wantLast: 2},
+		{name: "gap", acked: []bool{true, true, false, true}, wantLast: 1, wantRest: 2},
+		{name: "single", acked: []bool{true}, wantLast: 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var p partitionAcks
+			for i, acked := range tt.acked {
+				p = append(p, &ackInfo{msg: &sarama.ConsumerMessage{Offset: int64(i)}, acked: acked})
+			}
+
+			last, rest, n := p.advance()
+			if tt.wantLast < 0 {
+				if last != nil || n != 0 {
+					t.Errorf("advance() = %v, %d, want no acked messages", last, n)
+				}
+			} else if last == nil || last.msg.Offset != int64(tt.wantLast) || n != tt.wantLast+1 {
+				t.Errorf("advance() = %v, %d, want offset %d", last, n, tt.wantLast)
+			}
+			if len(rest) != tt.wantRest {
+				t.Errorf("advance() left %d messages, want %d", len(rest), tt.wantRest)
+			}
+		})
+	}
+}
+
+// newTestSubscription returns a subscription within a session, without a consumer group
+func newTestSubscription(commit commitOptions, retry retryOptions) (*subscription, *fakeSession) {
+	if retry.maxRetries == 0 {
+		retry.maxRetries = 3
+	}
+	if retry.logger.GetSink() == nil {
+		retry.logger = logr.Discard()
+	}
+	sess := &fakeSession{offsets: make(map[topicPartition]offsetAndMetadata)}
+	s := &subscription{
+		groupID:   "group",
+		commit:    commit,
+		retry:     retry,
+		sess:      sess,
+		unacked:   make(map[topicPartition]partitionAcks),
+		claims:    make(map[topicPartition]sarama.ConsumerGroupClaim),
+		marked:    make(map[topicPartition]int64),
+		processed: make(map[topicPartition]time.Time),
+		rejoin:    func() { panic("rejoined the group") },
+	}
+	return s, sess
+}
+
+// deliver hands messages of the partitions over to the subscription, as if they were consumed
+func deliver(s *subscription, tp topicPartition, offsets ...int64) []*driver.Message {
+	dms := make([]*driver.Message, len(offsets))
+	for i, o := range offsets {
+		dms[i] = s.toDriverMessage(&sarama.ConsumerMessage{Topic: tp.topic, Partition: tp.partition, Offset: o})
+	}
+	return dms
+}
+
+func TestSendAcks(t *testing.T) {
+	tp := topicPartition{topic: "orders", partition: 0}
+	tests := []struct {
+		strategy string
+		// the messages at offsets 10 to 14 are acked out of order
+		ackOrder []int
+		// wantMarked and wantCommits are the next offset to commit and the number of commits after each ack
+		wantMarked     []int64
+		wantCommits    []int
+		wantAutoCommit bool
+		// wantCleanupCommits is the number of commits once the session ended
+		wantCleanupCommits int
+	}{
+		{
+			strategy:           "periodic",
+			ackOrder:           []int{1, 0, 2, 4, 3},
+			wantMarked:         []int64{0, 12, 13, 13, 15},
+			wantCommits:        []int{0, 0, 0, 0, 0},
+			wantAutoCommit:     true,
+			wantCleanupCommits: 0,
+		},
+		{
+			strategy:           "per_message",
+			ackOrder:           []int{1, 0, 2, 4, 3},
+			wantMarked:         []int64{0, 12, 13, 13, 15},
+			wantCommits:        []int{0, 1, 2, 2, 3},
+			wantCleanupCommits: 3,
+		},
+		{
+			strategy:           "batch",
+			ackOrder:           []int{1, 0, 2, 4, 3},
+			wantMarked:         []int64{0, 12, 13, 13, 15},
+			wantCommits:        []int{0, 0, 1, 1, 1},
+			wantCleanupCommits: 2,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.strategy, func(t *testing.T) {
+			commit, err := parseCommitOptions(tt.strategy, 0, 3)
+			if err != nil {
+				t.Fatal(err)
+			}
+			config := sarama.NewConfig()
+			commit.apply(config)
+			if config.Consumer.Offsets.AutoCommit.Enable != tt.wantAutoCommit {
+				t.Errorf("auto-commit = %v, want %v", config.Consumer.Offsets.AutoCommit.Enable, tt.wantAutoCommit)
+			}
+
+			s, sess := newTestSubscription(commit, retryOptions{})
+			dms := deliver(s, tp, 10, 11, 12, 13, 14)
+			var marked []int64
+			var commits []int
+			for _, i := range tt.ackOrder {
+				if err := s.SendAcks(context.Background(), []driver.AckID{dms[i].AckID}); err != nil {
+					t.Fatalf("SendAcks() error = %v", err)
+				}
+				marked = append(marked, sess.offsets[tp].offset)
+				commits = append(commits, sess.commits)
+			}
+			if !reflect.DeepEqual(marked, tt.wantMarked) {
+				t.Errorf("marked offsets = %v, want %v", marked, tt.wantMarked)
+			}
+			if !reflect.DeepEqual(commits, tt.wantCommits) {
+				t.Errorf("commits = %v, want %v", commits, tt.wantCommits)
+			}
+
+			if err := s.Cleanup(sess); err != nil {
+				t.Fatalf("Cleanup() error = %v", err)
+			}
+			if sess.commits != tt.wantCleanupCommits {
+				t.Errorf("commits after the session ended = %d, want %d", sess.commits, tt.wantCleanupCommits)
+			}
+		})
+	}
+}
+
+func TestSendAcksPerPartition(t *testing.T) {
+	p0 := topicPartition{topic: "orders", partition: 0}
+	p1 := topicPartition{topic: "orders", partition: 1}
+	commit, _ := parseCommitOptions("per_message", 0, 0)
+	s, sess := newTestSubscription(commit, retryOptions{})
+
+	first := deliver(s, p0, 10)
+	second := deliver(s, p1, 20)
+	if err := s.SendAcks(context.Background(), []driver.AckID{second[0].AckID}); err != nil {
+		t.Fatalf("SendAcks() error = %v", err)
+	}
+	// an unacked message only holds back the offsets of its own partition
+	if got := sess.offsets[p1].offset; got != 21 {
+		t.Errorf("marked offset of %v = %d, want 21", p1, got)
+	}
+	if _, ok := sess.offsets[p0]; ok {
+		t.Errorf("marked offset of %v = %d before it was acked", p0, sess.offsets[p0].offset)
+	}
+
+	if err := s.SendAcks(context.Background(), []driver.AckID{first[0].AckID}); err != nil {
+		t.Fatalf("SendAcks() error = %v", err)
+	}
+	if got := sess.offsets[p0].offset; got != 11 {
+		t.Errorf("marked offset of %v = %d, want 11", p0, got)
+	}
+}
+
+func TestSendAcksWithoutSession(t *testing.T) {
+	tp := topicPartition{topic: "orders", partition: 0}
+	commit, _ := parseCommitOptions("per_message", 0, 0)
+	s, sess := newTestSubscription(commit, retryOptions{})
+	dms := deliver(s, tp, 10)
+
+	// the session ended, so the message is redelivered by the next one
+	s.sess = nil
+	if err := s.SendAcks(context.Background(), []driver.AckID{dms[0].AckID}); err != nil {
+		t.Fatalf("SendAcks() error = %v", err)
+	}
+	if len(sess.offsets) != 0 || sess.commits != 0 {
+		t.Errorf("marked %v and committed %d times without a session", sess.offsets, sess.commits)
+	}
+}
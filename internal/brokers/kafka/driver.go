@@ -0,0 +1,478 @@
+/*
+Copyright (c) 2022 RaptorML authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package kafka
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/IBM/sarama"
+	"github.com/raptor-ml/streaming-runner/internal/brokers/receive"
+	"gocloud.dev/gcerrors"
+	"gocloud.dev/pubsub/driver"
+	"slices"
+	"sync"
+	"time"
+)
+
+// subscription implements driver.Subscription, and sarama.ConsumerGroupHandler to consume the claims
+// of the consumer group sessions.
+type subscription struct {
+	client  sarama.Client
+	groupID string
+	group   sarama.ConsumerGroup
+	topics  topics
+	offsets *initialOffsets
+	commit  commitOptions
+	retry   retryOptions
+
+	messages chan *sarama.ConsumerMessage
+	// closed is closed once the group is closed, with closeErr set when it failed
+	closed   chan error
+	closeErr error
+	cancel   context.CancelFunc
+
+	mu       sync.Mutex
+	sess     sarama.ConsumerGroupSession
+	consumed []string
+	// unacked are the messages of the session that are yet to be marked, per partition
+	unacked map[topicPartition]partitionAcks
+	// redeliver are the nacked messages to deliver again
+	redeliver []*ackInfo
+	// uncommitted is the number of messages marked since the last commit
+	uncommitted int
+	// claims, marked and processed are the claimed partitions, their next offset to commit and the timestamp of
+	// their last marked message, to report the lag
+	claims    map[topicPartition]sarama.ConsumerGroupClaim
+	marked    map[topicPartition]int64
+	processed map[topicPartition]time.Time
+	// rejoin ends the current Consume call, so the group is joined again with the updated topics
+	rejoin        context.CancelFunc
+	topicsChanged chan struct{}
+}
+
+// ackInfo is the driver.AckID of a message
+type ackInfo struct {
+	msg   *sarama.ConsumerMessage
+	acked bool
+	// nacks is the number of times the message failed to be handled
+	nacks int
+}
+
+func newSubscription(client sarama.Client, groupID string, topics topics, offsets *initialOffsets, commit commitOptions, retry retryOptions) (*subscription, error) {
+	consumed, err := topics.resolve(client)
+	if err != nil {
+		return nil, err
+	}
+	group, err := sarama.NewConsumerGroupFromClient(groupID, client)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create consumer group: %w", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	s := &subscription{
+		client:   client,
+		groupID:  groupID,
+		group:    group,
+		topics:   topics,
+		offsets:  offsets,
+		commit:   commit,
+		retry:    retry,
+		messages: make(chan *sarama.ConsumerMessage),
+		closed:   make(chan error),
+		cancel:   cancel,
+
+		unacked:       make(map[topicPartition]partitionAcks),
+		claims:        make(map[topicPartition]sarama.ConsumerGroupClaim),
+		marked:        make(map[topicPartition]int64),
+		processed:     make(map[topicPartition]time.Time),
+		consumed:      consumed,
+		topicsChanged: make(chan struct{}, 1),
+	}
+	go s.run(ctx)
+	if topics.pattern != nil {
+		go s.watchTopics(ctx)
+	}
+	go s.reportLag(ctx)
+	return s, nil
+}
+
+// run consumes the group until the context is canceled, or a fatal error occurs.
+// Consume returns whenever the group is rebalanced, so it's called repeatedly.
+func (s *subscription) run(ctx context.Context) {
+	defer close(s.closed)
+	for {
+		s.mu.Lock()
+		consumed := s.consumed
+		cctx, rejoin := context.WithCancel(ctx)
+		s.rejoin = rejoin
+		s.mu.Unlock()
+
+		var err error
+		if len(consumed) > 0 {
+			err = s.group.Consume(cctx, consumed, s)
+		} else {
+			// no topic matches the pattern yet
+			select {
+			case <-ctx.Done():
+			case <-s.topicsChanged:
+			}
+		}
+		rejoin()
+
+		if err != nil || ctx.Err() != nil {
+			s.closeErr = err
+			_ = s.group.Close()
+			if s.retry.producer != nil {
+				_ = s.retry.producer.Close()
+			}
+			_ = s.client.Close()
+			return
+		}
+	}
+}
+
+// watchTopics periodically resolves the topics, and rejoins the group when they change
+func (s *subscription) watchTopics(ctx context.Context) {
+	ticker := time.NewTicker(s.topics.refreshInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		// failures are transient, the topics are resolved again on the next tick
+		consumed, err := s.topics.resolve(s.client)
+		if err != nil {
+			continue
+		}
+
+		s.mu.Lock()
+		if slices.Equal(consumed, s.consumed) {
+			s.mu.Unlock()
+			continue
+		}
+		s.consumed = consumed
+		rejoin := s.rejoin
+		s.mu.Unlock()
+
+		rejoin()
+		select {
+		case s.topicsChanged <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// reportLag periodically reports the lag of the claimed partitions
+func (s *subscription) reportLag(ctx context.Context) {
+	ticker := time.NewTicker(lagInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		s.updateLag(time.Now())
+	}
+}
+
+// updateLag sets the lag of the claimed partitions. The time lag is the age of the oldest message that wasn't
+// acknowledged yet; when the lagging messages weren't received yet, it's estimated by the time since the last
+// acknowledged message.
+func (s *subscription) updateLag(now time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for tp, claim := range s.claims {
+		lag := max(claim.HighWaterMarkOffset()-max(s.marked[tp], claim.InitialOffset()), 0)
+		consumerLag.With(lagLabels(s.groupID, tp)).Set(float64(lag))
+
+		var oldest time.Time
+		switch {
+		case lag == 0:
+			oldest = now
+		case len(s.unacked[tp]) > 0:
+			oldest = s.unacked[tp][0].msg.Timestamp
+		default:
+			oldest = s.processed[tp]
+		}
+		if !oldest.IsZero() {
+			consumerTimeLag.With(lagLabels(s.groupID, tp)).Set(max(now.Sub(oldest), 0).Seconds())
+		}
+	}
+}
+
+func (s *subscription) Setup(sess sarama.ConsumerGroupSession) error {
+	s.mu.Lock()
+	s.sess = sess
+	// messages of the previous session that are still in flight are redelivered if their partition moved,
+	// so it's safe to stop tracking them
+	s.unacked = make(map[topicPartition]partitionAcks)
+	s.redeliver = nil
+	s.uncommitted = 0
+	s.mu.Unlock()
+
+	if s.offsets != nil {
+		return s.offsets.apply(sess)
+	}
+	return nil
+}
+
+func (s *subscription) Cleanup(sess sarama.ConsumerGroupSession) error {
+	s.mu.Lock()
+	s.sess = nil
+	uncommitted := s.uncommitted
+	s.uncommitted = 0
+	s.mu.Unlock()
+
+	// auto-commit flushes the marked offsets when the session ends, otherwise they're committed here
+	if s.commit.strategy != commitPeriodic && uncommitted > 0 {
+		sess.Commit()
+	}
+	return nil
+}
+
+// ConsumeClaim hands the messages of the claim over to ReceiveBatch one at a time, so no messages are buffered
+// when the session ends.
+func (s *subscription) ConsumeClaim(sess sarama.ConsumerGroupSession, claim sarama.ConsumerGroupClaim) error {
+	tp := topicPartition{topic: claim.Topic(), partition: claim.Partition()}
+	s.mu.Lock()
+	s.claims[tp] = claim
+	s.mu.Unlock()
+	defer func() {
+		s.mu.Lock()
+		delete(s.claims, tp)
+		delete(s.processed, tp)
+		s.mu.Unlock()
+		// the partition may be claimed by another member now, which reports its lag
+		consumerLag.Delete(lagLabels(s.groupID, tp))
+		consumerTimeLag.Delete(lagLabels(s.groupID, tp))
+	}()
+
+	for {
+		select {
+		case msg, ok := <-claim.Messages():
+			if !ok {
+				return nil
+			}
+			select {
+			case s.messages <- msg:
+			case <-sess.Context().Done():
+				return nil
+			}
+		case <-sess.Context().Done():
+			return nil
+		}
+	}
+}
+
+func (s *subscription) ReceiveBatch(ctx context.Context, maxMessages int) ([]*driver.Message, error) {
+	// nacked messages are delivered again before consuming further
+	s.mu.Lock()
+	n := min(maxMessages, len(s.redeliver))
+	redeliver := s.redeliver[:n]
+	s.redeliver = s.redeliver[n:]
+	s.mu.Unlock()
+	if n > 0 {
+		dms := make([]*driver.Message, 0, n)
+		for _, ack := range redeliver {
+			dms = append(dms, newDriverMessage(ack))
+		}
+		return dms, nil
+	}
+
+	dms, err := receive.Batch(ctx, s.messages, s.closed, maxMessages, s.toDriverMessage)
+	if errors.Is(err, receive.ErrClosed) && s.closeErr != nil {
+		return nil, s.closeErr
+	}
+	return dms, err
+}
+
+// toDriverMessage tracks a consumed message until it's acked
+func (s *subscription) toDriverMessage(msg *sarama.ConsumerMessage) *driver.Message {
+	ack := &ackInfo{msg: msg}
+	tp := topicPartition{topic: msg.Topic, partition: msg.Partition}
+	s.mu.Lock()
+	s.unacked[tp] = append(s.unacked[tp], ack)
+	s.mu.Unlock()
+	return newDriverMessage(ack)
+}
+
+func newDriverMessage(ack *ackInfo) *driver.Message {
+	msg := ack.msg
+	md := make(map[string]string, len(msg.Headers)+1)
+	for _, h := range msg.Headers {
+		md[string(h.Key)] = string(h.Value)
+	}
+	if len(msg.Key) > 0 {
+		md["key"] = string(msg.Key)
+	}
+
+	return &driver.Message{
+		LoggableID: messageID(msg),
+		Body:       msg.Value,
+		Metadata:   md,
+		AckID:      ack,
+		AsFunc: func(i any) bool {
+			p, ok := i.(**sarama.ConsumerMessage)
+			if !ok {
+				return false
+			}
+			*p = msg
+			return true
+		},
+	}
+}
+
+func (s *subscription) SendAcks(_ context.Context, ackIDs []driver.AckID) error {
+	acks := make([]*ackInfo, len(ackIDs))
+	for i, id := range ackIDs {
+		acks[i] = id.(*ackInfo)
+	}
+	s.ack(acks)
+	return nil
+}
+
+// ack marks the offsets the acked messages complete, and commits them according to the commit strategy
+func (s *subscription) ack(acks []*ackInfo) {
+	if len(acks) == 0 {
+		return
+	}
+
+	s.mu.Lock()
+	sess := s.sess
+	for _, ack := range acks {
+		ack.acked = true
+	}
+	if sess == nil {
+		// the messages are redelivered to the next session
+		s.mu.Unlock()
+		return
+	}
+
+	for _, ack := range acks {
+		msg := ack.msg
+		tp := topicPartition{topic: msg.Topic, partition: msg.Partition}
+		last, rest, n := s.unacked[tp].advance()
+		if last == nil {
+			continue
+		}
+		s.unacked[tp] = rest
+		sess.MarkMessage(last.msg, s.offsets.metadata())
+		s.marked[tp] = last.msg.Offset + 1
+		s.processed[tp] = last.msg.Timestamp
+		s.uncommitted += n
+	}
+
+	commit := false
+	switch s.commit.strategy {
+	case commitPerMessage:
+		commit = s.uncommitted > 0
+	case commitBatch:
+		commit = s.uncommitted >= s.commit.batchSize
+	}
+	if commit {
+		s.uncommitted = 0
+	}
+	s.mu.Unlock()
+
+	// committing is a round-trip to the broker, so it's done without holding the lock
+	if commit {
+		sess.Commit()
+	}
+}
+
+func (s *subscription) CanNack() bool {
+	return true
+}
+
+// SendNacks delivers the messages again, without rejoining the group, so a failing message doesn't rebalance the
+// consumers of all the partitions. The nacked messages are never marked meanwhile, so the offsets of their
+// partitions don't advance past them. Messages that failed more than max_retries times are given up on and acked,
+// so they don't block their partitions.
+func (s *subscription) SendNacks(_ context.Context, ackIDs []driver.AckID) error {
+	var failed []*ackInfo
+	s.mu.Lock()
+	for _, id := range ackIDs {
+		ack := id.(*ackInfo)
+		ack.nacks++
+		if ack.nacks > s.retry.maxRetries {
+			failed = append(failed, ack)
+			continue
+		}
+		s.redeliver = append(s.redeliver, ack)
+	}
+	s.mu.Unlock()
+
+	// producing to the dead-letter topic is a round-trip to the broker, so it's done without holding the lock
+	var done []*ackInfo
+	for _, ack := range failed {
+		if err := s.retry.giveUp(ack.msg, ack.nacks); err != nil {
+			s.retry.logger.Error(err, "Failed to give up on a message, delivering it again")
+			s.mu.Lock()
+			s.redeliver = append(s.redeliver, ack)
+			s.mu.Unlock()
+			continue
+		}
+		done = append(done, ack)
+	}
+	s.ack(done)
+	return nil
+}
+
+func (s *subscription) IsRetryable(error) bool {
+	return false
+}
+
+func (s *subscription) As(i any) bool {
+	switch p := i.(type) {
+	case *sarama.Client:
+		*p = s.client
+	case *sarama.ConsumerGroup:
+		*p = s.group
+	case *sarama.ConsumerGroupSession:
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		*p = s.sess
+	default:
+		return false
+	}
+	return true
+}
+
+func (s *subscription) ErrorAs(err error, i any) bool {
+	return errors.As(err, i)
+}
+
+func (s *subscription) ErrorCode(err error) gcerrors.ErrorCode {
+	switch {
+	case errors.Is(err, receive.ErrClosed):
+		return gcerrors.FailedPrecondition
+	case errors.Is(err, sarama.ErrOutOfBrokers):
+		return gcerrors.NotFound
+	}
+	return gcerrors.Unknown
+}
+
+func (s *subscription) Close() error {
+	s.cancel()
+	<-s.closed
+	return nil
+}
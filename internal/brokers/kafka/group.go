@@ -0,0 +1,80 @@
+/*
+Copyright (c) 2022 RaptorML authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package kafka
+
+import (
+	"fmt"
+	"github.com/IBM/sarama"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// updateGroupConfig configures the rebalance strategy and the static membership of the consumer group.
+// It must be called after the version is set, since static membership requires Kafka 2.3.
+func updateGroupConfig(config *sarama.Config, in config) error {
+	switch strings.ToLower(in.RebalanceStrategy) {
+	case "", "range":
+		config.Consumer.Group.Rebalance.GroupStrategies = []sarama.BalanceStrategy{sarama.NewBalanceStrategyRange()}
+	case "roundrobin":
+		config.Consumer.Group.Rebalance.GroupStrategies = []sarama.BalanceStrategy{sarama.NewBalanceStrategyRoundRobin()}
+	case "sticky":
+		config.Consumer.Group.Rebalance.GroupStrategies = []sarama.BalanceStrategy{sarama.NewBalanceStrategySticky()}
+	case "cooperative-sticky":
+		return fmt.Errorf("rebalance_strategy cooperative-sticky is not supported by sarama, which only implements " +
+			"the eager rebalance protocol; use sticky along with static_membership instead")
+	default:
+		return fmt.Errorf("invalid rebalance_strategy: %s", in.RebalanceStrategy)
+	}
+
+	id := in.GroupInstanceID
+	if id == "" && in.StaticMembership {
+		var err error
+		id, err = statefulSetPodName()
+		if err != nil {
+			return err
+		}
+	}
+	if id == "" {
+		return nil
+	}
+
+	if !config.Version.IsAtLeast(sarama.V2_3_0_0) {
+		return fmt.Errorf("static membership requires kafka version 2.3.0 or later, set version accordingly")
+	}
+	config.Consumer.Group.InstanceId = id
+	return nil
+}
+
+// statefulSetPodName returns the name of the pod from the POD_NAME environment variable, or the hostname
+// otherwise. Only pods of a StatefulSet keep their name when they're restarted, so it must end with an ordinal.
+func statefulSetPodName() (string, error) {
+	name := os.Getenv("POD_NAME")
+	if name == "" {
+		var err error
+		name, err = os.Hostname()
+		if err != nil {
+			return "", fmt.Errorf("failed to get the pod name: %w", err)
+		}
+	}
+
+	i := strings.LastIndexByte(name, '-')
+	if _, err := strconv.ParseUint(name[i+1:], 10, 32); i < 0 || err != nil {
+		return "", fmt.Errorf("static_membership requires a pod of a StatefulSet, but %s has no ordinal", name)
+	}
+	return name, nil
+}
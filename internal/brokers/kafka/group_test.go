@@ -0,0 +1,117 @@
+/*
+Copyright (c) 2022 RaptorML authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package kafka
+
+import (
+	"github.com/IBM/sarama"
+	"strings"
+	"testing"
+)
+
+func TestUpdateGroupConfig(t *testing.T) {
+	tests := []struct {
+		name         string
+		in           config
+		version      sarama.KafkaVersion
+		podName      string
+		wantStrategy string
+		wantID       string
+		wantErr      bool
+		// wantErrText is part of the expected error, when it matters
+		wantErrText string
+	}{
+		{name: "defaults", version: sarama.V0_11_0_0, podName: "runner-0", wantStrategy: "range"},
+		{name: "sticky", in: config{RebalanceStrategy: "Sticky"}, version: sarama.V0_11_0_0, wantStrategy: "sticky"},
+		{name: "roundrobin", in: config{RebalanceStrategy: "roundrobin"}, version: sarama.V0_11_0_0, wantStrategy: "roundrobin"},
+		{
+			name:        "cooperative sticky",
+			in:          config{RebalanceStrategy: "cooperative-sticky"},
+			version:     sarama.V2_3_0_0,
+			wantErr:     true,
+			wantErrText: "not supported by sarama",
+		},
+		{
+			name:        "unknown strategy",
+			in:          config{RebalanceStrategy: "fastest"},
+			version:     sarama.V0_11_0_0,
+			wantErr:     true,
+			wantErrText: "invalid rebalance_strategy",
+		},
+		{
+			name:         "explicit instance id",
+			in:           config{GroupInstanceID: "consumer-a"},
+			version:      sarama.V2_3_0_0,
+			wantStrategy: "range",
+			wantID:       "consumer-a",
+		},
+		{
+			name:    "explicit instance id before kafka 2.3",
+			in:      config{GroupInstanceID: "consumer-a"},
+			version: sarama.V0_11_0_0,
+			wantErr: true,
+		},
+		{
+			name:         "statefulset pod",
+			in:           config{StaticMembership: true},
+			version:      sarama.V2_3_0_0,
+			podName:      "runner-2",
+			wantStrategy: "range",
+			wantID:       "runner-2",
+		},
+		{
+			name:    "deployment pod",
+			in:      config{StaticMembership: true},
+			version: sarama.V2_3_0_0,
+			podName: "runner-7d4b9c8f5-x2k9p",
+			wantErr: true,
+		},
+		{
+			name:    "statefulset pod before kafka 2.3",
+			in:      config{StaticMembership: true},
+			version: sarama.V2_1_0_0,
+			podName: "runner-2",
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("POD_NAME", tt.podName)
+			sc := sarama.NewConfig()
+			sc.Version = tt.version
+
+			err := updateGroupConfig(sc, tt.in)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("updateGroupConfig() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err != nil && !strings.Contains(err.Error(), tt.wantErrText) {
+				t.Errorf("updateGroupConfig() error = %v, want %q", err, tt.wantErrText)
+			}
+			if sc.Version != tt.version {
+				t.Errorf("updateGroupConfig() changed the version to %s", sc.Version)
+			}
+			if err != nil {
+				return
+			}
+			if got := sc.Consumer.Group.Rebalance.GroupStrategies[0].Name(); got != tt.wantStrategy {
+				t.Errorf("updateGroupConfig() strategy = %s, want %s", got, tt.wantStrategy)
+			}
+			if sc.Consumer.Group.InstanceId != tt.wantID {
+				t.Errorf("updateGroupConfig() instance id = %q, want %q", sc.Consumer.Group.InstanceId, tt.wantID)
+			}
+		})
+	}
+}
@@ -22,12 +22,14 @@ import (
 	"crypto/x509"
 	"fmt"
 	"github.com/IBM/sarama"
+	"github.com/go-logr/logr"
 	"github.com/raptor-ml/raptor/api/v1alpha1"
 	"github.com/raptor-ml/streaming-runner/pkg/brokers"
 	"gocloud.dev/pubsub"
+	"gocloud.dev/pubsub/batcher"
 	"gocloud.dev/pubsub/kafkapubsub"
-	"strconv"
 	"strings"
+	"time"
 )
 
 func init() {
@@ -42,7 +44,17 @@ func (p *provider) Metadata(_ context.Context, msg *pubsub.Message) brokers.Meta
 	if ok := msg.As(&m); ok {
 		md.Timestamp = m.Timestamp
 		md.Topic = m.Topic
-		md.ID = strconv.FormatInt(m.Offset, 10)
+		// offsets are only unique within a partition, and subscriptions may span multiple topics
+		md.ID = messageID(m)
+		md.Key = string(m.Key)
+		partition := m.Partition
+		md.Partition = &partition
+		if len(m.Headers) > 0 {
+			md.Headers = make(map[string]string, len(m.Headers))
+			for _, h := range m.Headers {
+				md.Headers[string(h.Key)] = string(h.Value)
+			}
+		}
 	}
 	return md
 }
@@ -53,17 +65,72 @@ type config struct {
 	ConsumerGroup string   `mapstructure:"consumer_group"`
 	ClientID      string   `mapstructure:"client_id"`
 
-	SaslUsername string `mapstructure:"sasl_username"`
-	SaslPassword string `mapstructure:"sasl_password"`
+	// TopicPattern is a regular expression of topics to consume in addition to Topics. It must match the whole
+	// topic name, as with the Java client, so `orders` doesn't match `orders-dlq`. The topics of the
+	// cluster are matched every TopicRefreshInterval, and the group is rejoined when they change.
+	TopicPattern         string        `mapstructure:"topic_pattern"`
+	TopicRefreshInterval time.Duration `mapstructure:"topic_refresh_interval"`
 
+	// SaslMechanism is one of PLAIN (default), SCRAM-SHA-256, SCRAM-SHA-512, OAUTHBEARER or GSSAPI
+	SaslMechanism string `mapstructure:"sasl_mechanism"`
+	SaslUsername  string `mapstructure:"sasl_username"`
+	SaslPassword  string `mapstructure:"sasl_password"`
+	// SaslOAuth* configure the client credentials flow used to get OAUTHBEARER tokens
+	SaslOAuthTokenURL     string   `mapstructure:"sasl_oauth_token_url"`
+	SaslOAuthClientID     string   `mapstructure:"sasl_oauth_client_id"`
+	SaslOAuthClientSecret string   `mapstructure:"sasl_oauth_client_secret"`
+	SaslOAuthScopes       []string `mapstructure:"sasl_oauth_scopes"`
+	// SaslKerberos* configure GSSAPI. The principal is authenticated with a keytab when SaslKerberosKeytabPath is
+	// set, or with SaslUsername and SaslPassword otherwise.
+	SaslKerberosKeytabPath      string `mapstructure:"sasl_kerberos_keytab_path"`
+	SaslKerberosConfigPath      string `mapstructure:"sasl_kerberos_config_path"`
+	SaslKerberosServiceName     string `mapstructure:"sasl_kerberos_service_name"`
+	SaslKerberosRealm           string `mapstructure:"sasl_kerberos_realm"`
+	SaslKerberosDisablePAFXFAST bool   `mapstructure:"sasl_kerberos_disable_pafxfast"`
+
+	// TLSCaCert, TLSClientCert and TLSClientKey are either inline PEM blocks or paths to PEM files
 	TLSDisable    bool   `mapstructure:"tls_disable"`
 	TLSSkipVerify bool   `mapstructure:"tls_skip_verify"`
 	TLSCaCert     string `mapstructure:"tls_ca_cert"`
 	TLSClientCert string `mapstructure:"tls_client_cert"`
 	TLSClientKey  string `mapstructure:"tls_client_key"`
 
+	// InitialOffset is where to start partitions without a committed offset: `oldest` or `newest` (default).
+	// It can also be an RFC3339 timestamp or a negative duration relative to the subscription time (e.g. `-6h`),
+	// which moves committed offsets as well, so an existing group can backfill.
 	InitialOffset string `mapstructure:"initial_offset"`
-	Version       string `mapstructure:"version"`
+	// PartitionOffsets are explicit starting offsets in the form of `topic:partition=offset`, that take
+	// precedence over InitialOffset and move committed offsets as well. Timestamps and explicit offsets are
+	// applied once per configuration, so they're not applied again on restarts unless they're changed.
+	PartitionOffsets []string `mapstructure:"partition_offsets"`
+	Version          string   `mapstructure:"version"`
+
+	// IsolationLevel is either `read_uncommitted` (default) or `read_committed`, which only reads committed
+	// transactional messages, and skips aborted transactions and control records
+	IsolationLevel string `mapstructure:"isolation_level"`
+
+	// CommitStrategy is when the offsets of the processed messages are committed: `periodic` (default) every
+	// CommitInterval, `per_message` after every processed message, or `batch` every CommitBatchSize processed
+	// messages. An offset is only committed once all the lower offsets of its partition are processed.
+	CommitStrategy  string        `mapstructure:"commit_strategy"`
+	CommitInterval  time.Duration `mapstructure:"commit_interval"`
+	CommitBatchSize int           `mapstructure:"commit_batch_size"`
+
+	// MaxRetries is the number of times a message that failed to be handled is redelivered (default 3). Messages
+	// that fail after that are produced to DeadLetterTopic, or dropped and logged without one, so they don't block
+	// their partition.
+	MaxRetries      int    `mapstructure:"max_retries"`
+	DeadLetterTopic string `mapstructure:"dead_letter_topic"`
+
+	// RebalanceStrategy is one of `range` (default), `roundrobin` or `sticky`. `cooperative-sticky` isn't offered,
+	// since the kafka client only implements the eager rebalance protocol; use static membership instead to avoid
+	// rebalances when the runner is restarted.
+	RebalanceStrategy string `mapstructure:"rebalance_strategy"`
+	// GroupInstanceID is the static membership ID of the consumer, so restarts within the session timeout don't
+	// rebalance the group. StaticMembership uses the pod name as the ID instead, and requires the runner to be a
+	// StatefulSet, since other pods get a new name on every restart. Both require Version 2.3 or later.
+	GroupInstanceID  string `mapstructure:"group_instance_id"`
+	StaticMembership bool   `mapstructure:"static_membership"`
 }
 
 func (p *provider) Subscribe(ctx context.Context, c v1alpha1.ParsedConfig) (context.Context, *pubsub.Subscription, error) {
@@ -76,8 +143,18 @@ func (p *provider) Subscribe(ctx context.Context, c v1alpha1.ParsedConfig) (cont
 	if len(cfg.Brokers) == 0 {
 		return ctx, nil, fmt.Errorf("brokers required to connect to kafka")
 	}
-	if len(cfg.Topics) == 0 {
-		return ctx, nil, fmt.Errorf("topics required to connect to kafka")
+	if len(cfg.Topics) == 0 && cfg.TopicPattern == "" {
+		return ctx, nil, fmt.Errorf("topics or topic_pattern required to connect to kafka")
+	}
+	t := topics{static: cfg.Topics, refreshInterval: cfg.TopicRefreshInterval}
+	if cfg.TopicPattern != "" {
+		t.pattern, err = compileTopicPattern(cfg.TopicPattern)
+		if err != nil {
+			return ctx, nil, fmt.Errorf("invalid topic_pattern: %w", err)
+		}
+	}
+	if t.refreshInterval == 0 {
+		t.refreshInterval = time.Minute
 	}
 
 	if cfg.ConsumerGroup == "" {
@@ -92,20 +169,47 @@ func (p *provider) Subscribe(ctx context.Context, c v1alpha1.ParsedConfig) (cont
 	config := kafkapubsub.MinimalConfig()
 
 	if cfg.Version != "" {
-		if ver, err := sarama.ParseKafkaVersion(cfg.Version); err == nil {
-			if ver.IsAtLeast(config.Version) {
-				return ctx, nil, fmt.Errorf("kafka version %s is not supported", cfg.Version)
-			}
-			config.Version = ver
-		} else {
-			return ctx, nil, fmt.Errorf("failed to parse kafka version: %w", err)
+		config.Version, err = parseVersion(cfg.Version, config.Version)
+		if err != nil {
+			return ctx, nil, err
 		}
 	}
 
-	if io, err := parseInitialOffset(cfg.InitialOffset); err != nil {
-		config.Consumer.Offsets.Initial = io
+	switch strings.ToLower(cfg.IsolationLevel) {
+	case "", "read_uncommitted":
+		config.Consumer.IsolationLevel = sarama.ReadUncommitted
+	case "read_committed":
+		config.Consumer.IsolationLevel = sarama.ReadCommitted
+	default:
+		return ctx, nil, fmt.Errorf("invalid isolation_level: %s", cfg.IsolationLevel)
 	}
 
+	err = updateGroupConfig(config, cfg)
+	if err != nil {
+		return ctx, nil, err
+	}
+
+	initial, at, err := parseInitialOffset(cfg.InitialOffset, time.Now())
+	if err != nil {
+		return ctx, nil, err
+	}
+	config.Consumer.Offsets.Initial = initial
+	explicit, err := parsePartitionOffsets(cfg.PartitionOffsets)
+	if err != nil {
+		return ctx, nil, err
+	}
+
+	commit, err := parseCommitOptions(cfg.CommitStrategy, cfg.CommitInterval, cfg.CommitBatchSize)
+	if err != nil {
+		return ctx, nil, err
+	}
+	commit.apply(config)
+	retry, err := parseRetryOptions(cfg.MaxRetries, cfg.DeadLetterTopic, logr.FromContextOrDiscard(ctx))
+	if err != nil {
+		return ctx, nil, err
+	}
+	retry.apply(config)
+
 	cfg.ClientID = "consumer.k8s.raptor.ml"
 	if cfg.ClientID != "" {
 		config.ClientID = cfg.ClientID
@@ -116,30 +220,64 @@ func (p *provider) Subscribe(ctx context.Context, c v1alpha1.ParsedConfig) (cont
 		return ctx, nil, err
 	}
 
-	if cfg.SaslUsername != "" && cfg.SaslPassword != "" {
-		config.Net.SASL.Handshake = true
-		config.Net.SASL.Mechanism = sarama.SASLTypePlaintext
-		config.Net.SASL.User = cfg.SaslUsername
-		config.Net.SASL.Password = cfg.SaslPassword
+	err = updateSASLConfig(ctx, config, cfg)
+	if err != nil {
+		return ctx, nil, err
 	}
 
-	sub, err := kafkapubsub.OpenSubscription(cfg.Brokers, config, cfg.ConsumerGroup, cfg.Topics, &kafkapubsub.SubscriptionOptions{
-		KeyName: "key",
-	})
-	return ctx, sub, err
-}
+	client, err := sarama.NewClient(cfg.Brokers, config)
+	if err != nil {
+		return ctx, nil, fmt.Errorf("failed to connect to kafka: %w", err)
+	}
+
+	var offsets *initialOffsets
+	if !at.IsZero() || len(explicit) > 0 {
+		admin, err := sarama.NewClusterAdminFromClient(client)
+		if err != nil {
+			_ = client.Close()
+			return ctx, nil, fmt.Errorf("failed to create kafka admin: %w", err)
+		}
+		offsets = &initialOffsets{
+			client:   client,
+			admin:    admin,
+			logger:   logr.FromContextOrDiscard(ctx),
+			group:    cfg.ConsumerGroup,
+			at:       at,
+			explicit: explicit,
+			marker:   startMarker(cfg.InitialOffset, cfg.PartitionOffsets),
+		}
+	}
+
+	if retry.deadLetterTopic != "" {
+		retry.producer, err = sarama.NewSyncProducerFromClient(client)
+		if err != nil {
+			_ = client.Close()
+			return ctx, nil, fmt.Errorf("failed to create dead-letter producer: %w", err)
+		}
+	}
 
-func parseInitialOffset(value string) (initialOffset int64, err error) {
-	initialOffset = sarama.OffsetNewest // Default
-	if strings.EqualFold(value, "oldest") {
-		initialOffset = sarama.OffsetOldest
-	} else if strings.EqualFold(value, "newest") {
-		initialOffset = sarama.OffsetNewest
-	} else if value != "" {
-		return 0, fmt.Errorf("kafka error: invalid initialOffset: %s", value)
+	ds, err := newSubscription(client, cfg.ConsumerGroup, t, offsets, commit, retry)
+	if err != nil {
+		if retry.producer != nil {
+			_ = retry.producer.Close()
+		}
+		_ = client.Close()
+		return ctx, nil, err
 	}
+	sub := pubsub.NewSubscription(ds, &batcher.Options{MaxBatchSize: 1, MaxHandlers: 1}, nil)
+	return ctx, sub, nil
+}
 
-	return initialOffset, err
+// parseVersion parses the Kafka version of the cluster, which must be at least the minimal supported version
+func parseVersion(value string, minimal sarama.KafkaVersion) (sarama.KafkaVersion, error) {
+	ver, err := sarama.ParseKafkaVersion(value)
+	if err != nil {
+		return minimal, fmt.Errorf("failed to parse kafka version: %w", err)
+	}
+	if !ver.IsAtLeast(minimal) {
+		return minimal, fmt.Errorf("kafka version %s is not supported", value)
+	}
+	return ver, nil
 }
 
 func updateTLSConfig(config *sarama.Config, in config) error {
@@ -149,18 +287,33 @@ func updateTLSConfig(config *sarama.Config, in config) error {
 	}
 	config.Net.TLS.Enable = true
 
-	if !in.TLSSkipVerify && in.TLSCaCert == "" {
+	if !in.TLSSkipVerify && in.TLSCaCert == "" && in.TLSClientCert == "" && in.TLSClientKey == "" {
 		return nil
 	}
 
 	config.Net.TLS.Config = &tls.Config{InsecureSkipVerify: in.TLSSkipVerify, MinVersion: tls.VersionTLS12}
 	if in.TLSCaCert != "" {
+		ca, err := readPEM(in.TLSCaCert)
+		if err != nil {
+			return fmt.Errorf("kafka error: unable to read ca certificate: %w", err)
+		}
 		caCertPool := x509.NewCertPool()
-		if ok := caCertPool.AppendCertsFromPEM([]byte(in.TLSCaCert)); !ok {
+		if ok := caCertPool.AppendCertsFromPEM(ca); !ok {
 			return fmt.Errorf("kafka error: unable to load ca certificate")
 		}
 		config.Net.TLS.Config.RootCAs = caCertPool
 	}
 
+	if in.TLSClientCert != "" || in.TLSClientKey != "" {
+		if in.TLSClientCert == "" || in.TLSClientKey == "" {
+			return fmt.Errorf("kafka error: both tls_client_cert and tls_client_key are required")
+		}
+		getCert, err := clientCertificate(in.TLSClientCert, in.TLSClientKey)
+		if err != nil {
+			return err
+		}
+		config.Net.TLS.Config.GetClientCertificate = getCert
+	}
+
 	return nil
 }
@@ -0,0 +1,193 @@
+/*
+Copyright (c) 2022 RaptorML authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package kafka
+
+import (
+	"context"
+	"github.com/IBM/sarama"
+	"reflect"
+	"testing"
+)
+
+func TestParseVersion(t *testing.T) {
+	tests := []struct {
+		value   string
+		want    sarama.KafkaVersion
+		wantErr bool
+	}{
+		{value: "0.11.0.0", want: sarama.V0_11_0_0},
+		{value: "2.3.0", want: sarama.V2_3_0_0},
+		{value: "3.6.0", want: sarama.V3_6_0_0},
+		{value: "0.10.2.0", wantErr: true},
+		{value: "0.8.2.0", wantErr: true},
+		{value: "latest", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.value, func(t *testing.T) {
+			got, err := parseVersion(tt.value, sarama.V0_11_0_0)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("parseVersion(%q) error = %v, wantErr %v", tt.value, err, tt.wantErr)
+			}
+			if !tt.wantErr && got != tt.want {
+				t.Errorf("parseVersion(%q) = %s, want %s", tt.value, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestUpdateSASLConfig(t *testing.T) {
+	tests := []struct {
+		name          string
+		in            config
+		wantEnabled   bool
+		wantMechanism sarama.SASLMechanism
+		// wantHashSize is the size of the SCRAM hash, for SCRAM mechanisms
+		wantHashSize int
+		wantGSSAPI   *sarama.GSSAPIConfig
+		wantErr      bool
+	}{
+		{name: "disabled"},
+		{
+			name:          "plain by default",
+			in:            config{SaslUsername: "user", SaslPassword: "pass"},
+			wantEnabled:   true,
+			wantMechanism: sarama.SASLTypePlaintext,
+		},
+		{
+			name:          "plain",
+			in:            config{SaslMechanism: "plain", SaslUsername: "user", SaslPassword: "pass"},
+			wantEnabled:   true,
+			wantMechanism: sarama.SASLTypePlaintext,
+		},
+		{
+			name:          "scram-sha-256",
+			in:            config{SaslMechanism: "SCRAM-SHA-256", SaslUsername: "user", SaslPassword: "pass"},
+			wantEnabled:   true,
+			wantMechanism: sarama.SASLTypeSCRAMSHA256,
+			wantHashSize:  32,
+		},
+		{
+			name:          "scram-sha-512",
+			in:            config{SaslMechanism: "scram-sha-512", SaslUsername: "user", SaslPassword: "pass"},
+			wantEnabled:   true,
+			wantMechanism: sarama.SASLTypeSCRAMSHA512,
+			wantHashSize:  64,
+		},
+		{
+			name:          "oauthbearer",
+			in:            config{SaslMechanism: "OAUTHBEARER", SaslOAuthTokenURL: "https://idp/token", SaslOAuthClientID: "id", SaslOAuthClientSecret: "secret"},
+			wantEnabled:   true,
+			wantMechanism: sarama.SASLTypeOAuth,
+		},
+		{
+			name: "gssapi with keytab",
+			in: config{
+				SaslMechanism:          "GSSAPI",
+				SaslUsername:           "runner",
+				SaslPassword:           "ignored",
+				SaslKerberosRealm:      "EXAMPLE.COM",
+				SaslKerberosKeytabPath: "/etc/kafka/runner.keytab",
+			},
+			wantEnabled:   true,
+			wantMechanism: sarama.SASLTypeGSSAPI,
+			wantGSSAPI: &sarama.GSSAPIConfig{
+				AuthType:           sarama.KRB5_KEYTAB_AUTH,
+				KeyTabPath:         "/etc/kafka/runner.keytab",
+				KerberosConfigPath: "/etc/krb5.conf",
+				ServiceName:        "kafka",
+				Username:           "runner",
+				Realm:              "EXAMPLE.COM",
+			},
+		},
+		{
+			name: "gssapi with password",
+			in: config{
+				SaslMechanism:               "gssapi",
+				SaslUsername:                "runner",
+				SaslPassword:                "pass",
+				SaslKerberosRealm:           "EXAMPLE.COM",
+				SaslKerberosConfigPath:      "/config/krb5.conf",
+				SaslKerberosServiceName:     "broker",
+				SaslKerberosDisablePAFXFAST: true,
+			},
+			wantEnabled:   true,
+			wantMechanism: sarama.SASLTypeGSSAPI,
+			wantGSSAPI: &sarama.GSSAPIConfig{
+				AuthType:           sarama.KRB5_USER_AUTH,
+				KerberosConfigPath: "/config/krb5.conf",
+				ServiceName:        "broker",
+				Username:           "runner",
+				Password:           "pass",
+				Realm:              "EXAMPLE.COM",
+				DisablePAFXFAST:    true,
+			},
+		},
+		{
+			name:    "gssapi without keytab or password",
+			in:      config{SaslMechanism: "GSSAPI", SaslUsername: "runner", SaslKerberosRealm: "EXAMPLE.COM"},
+			wantErr: true,
+		},
+		{
+			name:    "gssapi without realm",
+			in:      config{SaslMechanism: "GSSAPI", SaslUsername: "runner", SaslKerberosKeytabPath: "/etc/kafka/runner.keytab"},
+			wantErr: true,
+		},
+		{name: "plain without password", in: config{SaslMechanism: "PLAIN", SaslUsername: "user"}, wantErr: true},
+		{name: "scram without username", in: config{SaslMechanism: "SCRAM-SHA-256", SaslPassword: "pass"}, wantErr: true},
+		{name: "oauthbearer without client secret", in: config{SaslMechanism: "OAUTHBEARER", SaslOAuthTokenURL: "https://idp/token", SaslOAuthClientID: "id"}, wantErr: true},
+		{name: "unknown mechanism", in: config{SaslMechanism: "DIGEST-MD5", SaslUsername: "user", SaslPassword: "pass"}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sc := sarama.NewConfig()
+			err := updateSASLConfig(context.Background(), sc, tt.in)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("updateSASLConfig() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			if sc.Net.SASL.Enable != tt.wantEnabled {
+				t.Fatalf("updateSASLConfig() enabled = %v, want %v", sc.Net.SASL.Enable, tt.wantEnabled)
+			}
+			if !tt.wantEnabled {
+				return
+			}
+			if sc.Net.SASL.Mechanism != tt.wantMechanism {
+				t.Errorf("updateSASLConfig() mechanism = %s, want %s", sc.Net.SASL.Mechanism, tt.wantMechanism)
+			}
+			if tt.wantHashSize != 0 {
+				if sc.Net.SASL.SCRAMClientGeneratorFunc == nil {
+					t.Fatal("updateSASLConfig() didn't set a SCRAM client")
+				}
+				c := sc.Net.SASL.SCRAMClientGeneratorFunc().(*scramClient)
+				if size := c.HashGeneratorFcn().Size(); size != tt.wantHashSize {
+					t.Errorf("SCRAM hash size = %d, want %d", size, tt.wantHashSize)
+				}
+			}
+			if tt.wantGSSAPI != nil && !reflect.DeepEqual(sc.Net.SASL.GSSAPI, *tt.wantGSSAPI) {
+				t.Errorf("updateSASLConfig() gssapi = %+v, want %+v", sc.Net.SASL.GSSAPI, *tt.wantGSSAPI)
+			}
+			if tt.wantMechanism == sarama.SASLTypeOAuth && sc.Net.SASL.TokenProvider == nil {
+				t.Error("updateSASLConfig() didn't set a token provider")
+			}
+			if err := sc.Validate(); err != nil {
+				t.Errorf("Validate() error = %v", err)
+			}
+		})
+	}
+}
@@ -0,0 +1,52 @@
+/*
+Copyright (c) 2022 RaptorML authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package kafka
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"sigs.k8s.io/controller-runtime/pkg/metrics"
+	"strconv"
+	"time"
+)
+
+// lagInterval is how often the consumer lag is reported
+const lagInterval = 10 * time.Second
+
+var (
+	consumerLag = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "raptor",
+		Subsystem: "streaming_kafka",
+		Name:      "consumer_processing_lag",
+		Help: "The number of messages between the high watermark of a partition and its first message that wasn't " +
+			"acknowledged yet. Acknowledged offsets are committed according to the commit strategy.",
+	}, []string{"group", "topic", "partition"})
+	consumerTimeLag = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "raptor",
+		Subsystem: "streaming_kafka",
+		Name:      "consumer_time_lag_seconds",
+		Help: "The age of the oldest message of a partition that wasn't acknowledged yet, or the time since the " +
+			"timestamp of the last acknowledged message while the partition has a lag.",
+	}, []string{"group", "topic", "partition"})
+)
+
+func init() {
+	metrics.Registry.MustRegister(consumerLag, consumerTimeLag)
+}
+
+func lagLabels(group string, tp topicPartition) prometheus.Labels {
+	return prometheus.Labels{"group": group, "topic": tp.topic, "partition": strconv.Itoa(int(tp.partition))}
+}
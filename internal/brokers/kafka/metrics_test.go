@@ -0,0 +1,129 @@
+/*
+Copyright (c) 2022 RaptorML authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package kafka
+
+import (
+	"github.com/IBM/sarama"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"testing"
+	"time"
+)
+
+// fakeClaim is a claim of a partition with a fixed high watermark
+type fakeClaim struct {
+	sarama.ConsumerGroupClaim
+	tp            topicPartition
+	initialOffset int64
+	highWaterMark int64
+}
+
+func (c *fakeClaim) Topic() string {
+	return c.tp.topic
+}
+
+func (c *fakeClaim) Partition() int32 {
+	return c.tp.partition
+}
+
+func (c *fakeClaim) InitialOffset() int64 {
+	return c.initialOffset
+}
+
+func (c *fakeClaim) HighWaterMarkOffset() int64 {
+	return c.highWaterMark
+}
+
+func TestUpdateLag(t *testing.T) {
+	now := time.Now()
+	tp := topicPartition{topic: "lag", partition: 3}
+	tests := []struct {
+		name string
+		// received are the timestamps of the messages received from offset 10, and acked how many were acked
+		received      []time.Time
+		acked         int
+		highWaterMark int64
+		wantLag       float64
+		wantTimeLag   float64
+	}{
+		{
+			name:          "caught up",
+			received:      []time.Time{now.Add(-time.Minute)},
+			acked:         1,
+			highWaterMark: 11,
+		},
+		{
+			name:          "messages in flight",
+			received:      []time.Time{now.Add(-time.Minute), now.Add(-30 * time.Second), now.Add(-10 * time.Second)},
+			acked:         1,
+			highWaterMark: 13,
+			wantLag:       2,
+			wantTimeLag:   30,
+		},
+		{
+			name:          "lagging messages that weren't received yet",
+			received:      []time.Time{now.Add(-time.Minute), now.Add(-20 * time.Second)},
+			acked:         2,
+			highWaterMark: 15,
+			wantLag:       3,
+			wantTimeLag:   20,
+		},
+		{
+			name:          "nothing acked yet",
+			received:      []time.Time{now.Add(-5 * time.Second)},
+			highWaterMark: 11,
+			wantLag:       1,
+			wantTimeLag:   5,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s, _ := newTestSubscription(commitOptions{}, retryOptions{})
+			s.claims[tp] = &fakeClaim{tp: tp, initialOffset: 10, highWaterMark: tt.highWaterMark}
+			defer consumerLag.Delete(lagLabels(s.groupID, tp))
+			defer consumerTimeLag.Delete(lagLabels(s.groupID, tp))
+
+			var acks []*ackInfo
+			for i, ts := range tt.received {
+				msg := &sarama.ConsumerMessage{Topic: tp.topic, Partition: tp.partition, Offset: 10 + int64(i), Timestamp: ts}
+				dm := s.toDriverMessage(msg)
+				if i < tt.acked {
+					acks = append(acks, dm.AckID.(*ackInfo))
+				}
+			}
+			s.ack(acks)
+
+			// the time lag is reported on every tick, rather than when messages are acked
+			s.updateLag(now)
+			if got := testutil.ToFloat64(consumerLag.With(lagLabels(s.groupID, tp))); got != tt.wantLag {
+				t.Errorf("consumer lag = %v, want %v", got, tt.wantLag)
+			}
+			if got := testutil.ToFloat64(consumerTimeLag.With(lagLabels(s.groupID, tp))); got != tt.wantTimeLag {
+				t.Errorf("consumer time lag = %v, want %v", got, tt.wantTimeLag)
+			}
+
+			// a lagging partition keeps growing its time lag while nothing is acked
+			s.updateLag(now.Add(time.Minute))
+			want := 0.0
+			if tt.wantLag > 0 {
+				want = tt.wantTimeLag + 60
+			}
+			if got := testutil.ToFloat64(consumerTimeLag.With(lagLabels(s.groupID, tp))); got != want {
+				t.Errorf("consumer time lag a minute later = %v, want %v", got, want)
+			}
+		})
+	}
+}
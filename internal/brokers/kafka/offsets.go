@@ -0,0 +1,173 @@
+/*
+Copyright (c) 2022 RaptorML authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package kafka
+
+import (
+	"fmt"
+	"github.com/IBM/sarama"
+	"github.com/go-logr/logr"
+	"hash/fnv"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// parseInitialOffset parses `oldest`, `newest`, an RFC3339 timestamp or a negative duration relative to now.
+// Oldest and newest only apply to partitions without a committed offset, while timestamps are returned as `at`.
+func parseInitialOffset(value string, now time.Time) (initialOffset int64, at time.Time, err error) {
+	initialOffset = sarama.OffsetNewest // Default
+	if strings.EqualFold(value, "oldest") {
+		initialOffset = sarama.OffsetOldest
+	} else if strings.EqualFold(value, "newest") || value == "" {
+		initialOffset = sarama.OffsetNewest
+	} else if t, err := time.Parse(time.RFC3339, value); err == nil {
+		at = t
+	} else if d, err := time.ParseDuration(value); err == nil && d < 0 {
+		at = now.Add(d)
+	} else {
+		return 0, at, fmt.Errorf("kafka error: invalid initialOffset: %s", value)
+	}
+
+	return initialOffset, at, nil
+}
+
+// parsePartitionOffsets parses explicit offsets in the form of `topic:partition=offset`
+func parsePartitionOffsets(values []string) (map[string]map[int32]int64, error) {
+	offsets := make(map[string]map[int32]int64)
+	for _, v := range values {
+		tp, o, ok := strings.Cut(strings.TrimSpace(v), "=")
+		if !ok {
+			return nil, fmt.Errorf("kafka error: invalid partition offset: %s", v)
+		}
+		topic, p, ok := strings.Cut(tp, ":")
+		if !ok {
+			return nil, fmt.Errorf("kafka error: invalid partition offset: %s", v)
+		}
+		partition, err := strconv.ParseInt(p, 10, 32)
+		if err != nil {
+			return nil, fmt.Errorf("kafka error: invalid partition in %s: %w", v, err)
+		}
+		offset, err := strconv.ParseInt(o, 10, 64)
+		if err != nil || offset < 0 {
+			return nil, fmt.Errorf("kafka error: invalid offset in %s", v)
+		}
+
+		if offsets[topic] == nil {
+			offsets[topic] = make(map[int32]int64)
+		}
+		offsets[topic][int32(partition)] = offset
+	}
+	return offsets, nil
+}
+
+// startMarker identifies the configured start, and is committed as the metadata of the offsets consumed
+// since it was applied
+func startMarker(initialOffset string, partitionOffsets []string) string {
+	sorted := slices.Clone(partitionOffsets)
+	slices.Sort(sorted)
+	h := fnv.New64a()
+	_, _ = h.Write([]byte(initialOffset + "|" + strings.Join(sorted, ",")))
+	return fmt.Sprintf("start:%x", h.Sum64())
+}
+
+// initialOffsets positions the claimed partitions either at explicit offsets or at the first offset after
+// a timestamp. The start is applied once per configuration: it's committed with a marker as metadata, and
+// partitions that are committed without the marker are moved, even when the group already consumed them.
+type initialOffsets struct {
+	client   sarama.Client
+	admin    sarama.ClusterAdmin
+	logger   logr.Logger
+	group    string
+	at       time.Time
+	explicit map[string]map[int32]int64
+	marker   string
+}
+
+// metadata is the commit metadata of the consumed offsets
+func (o *initialOffsets) metadata() string {
+	if o == nil {
+		return ""
+	}
+	return o.marker
+}
+
+func (o *initialOffsets) apply(sess sarama.ConsumerGroupSession) error {
+	claims := sess.Claims()
+	committed, err := o.admin.ListConsumerGroupOffsets(o.group, claims)
+	if err != nil {
+		return fmt.Errorf("failed to list committed offsets: %w", err)
+	}
+
+	applied := false
+	for topic, partitions := range claims {
+		for _, p := range partitions {
+			b := committed.GetBlock(topic, p)
+			hasCommitted := b != nil && b.Offset >= 0
+			if hasCommitted && b.Metadata == o.marker {
+				// the start was applied before, and the partition is consumed since
+				continue
+			}
+
+			offset, ok, err := o.start(topic, p)
+			if err != nil {
+				return err
+			}
+			if !ok {
+				continue
+			}
+			if hasCommitted {
+				o.logger.Info("Moving the committed offset to the configured start",
+					"topic", topic, "partition", p, "committed", b.Offset, "offset", offset)
+			}
+			// marking only moves the offset forward and resetting only moves it backward,
+			// the claim starts from the resulting offset
+			sess.MarkOffset(topic, p, offset, o.marker)
+			sess.ResetOffset(topic, p, offset, o.marker)
+			applied = true
+		}
+	}
+
+	// the start is committed right away, so it isn't applied again when the group is rebalanced
+	if applied {
+		sess.Commit()
+	}
+	return nil
+}
+
+// start returns the configured starting offset of a partition, if any
+func (o *initialOffsets) start(topic string, p int32) (int64, bool, error) {
+	if offset, ok := o.explicit[topic][p]; ok {
+		return offset, true, nil
+	}
+	if o.at.IsZero() {
+		return 0, false, nil
+	}
+
+	offset, err := o.client.GetOffset(topic, p, o.at.UnixMilli())
+	if err != nil {
+		return 0, false, fmt.Errorf("failed to get offset for time of %s/%d: %w", topic, p, err)
+	}
+	if offset < 0 {
+		// there are no messages after the timestamp
+		offset, err = o.client.GetOffset(topic, p, sarama.OffsetNewest)
+		if err != nil {
+			return 0, false, fmt.Errorf("failed to get newest offset of %s/%d: %w", topic, p, err)
+		}
+	}
+	return offset, true, nil
+}
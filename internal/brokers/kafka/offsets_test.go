@@ -0,0 +1,274 @@
+/*
+Copyright (c) 2022 RaptorML authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package kafka
+
+import (
+	"github.com/IBM/sarama"
+	"github.com/go-logr/logr"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestParseInitialOffset(t *testing.T) {
+	now := time.Date(2023, 11, 14, 22, 0, 0, 0, time.UTC)
+	tests := []struct {
+		value   string
+		want    int64
+		wantAt  time.Time
+		wantErr bool
+	}{
+		{value: "", want: sarama.OffsetNewest},
+		{value: "newest", want: sarama.OffsetNewest},
+		{value: "Oldest", want: sarama.OffsetOldest},
+		{value: "2023-11-14T10:00:00Z", want: sarama.OffsetNewest, wantAt: time.Date(2023, 11, 14, 10, 0, 0, 0, time.UTC)},
+		{value: "-6h", want: sarama.OffsetNewest, wantAt: now.Add(-6 * time.Hour)},
+		{value: "6h", wantErr: true},
+		{value: "2023-11-14", wantErr: true},
+		{value: "latest", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.value, func(t *testing.T) {
+			got, at, err := parseInitialOffset(tt.value, now)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("parseInitialOffset() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			if got != tt.want || !at.Equal(tt.wantAt) {
+				t.Errorf("parseInitialOffset() = %d, %v, want %d, %v", got, at, tt.want, tt.wantAt)
+			}
+		})
+	}
+}
+
+func TestParsePartitionOffsets(t *testing.T) {
+	tests := []struct {
+		name    string
+		values  []string
+		want    map[string]map[int32]int64
+		wantErr bool
+	}{
+		{name: "none", want: map[string]map[int32]int64{}},
+		{
+			name:   "multiple topics",
+			values: []string{"orders:0=10", " orders:1=0", "payments:3=42 "},
+			want:   map[string]map[int32]int64{"orders": {0: 10, 1: 0}, "payments": {3: 42}},
+		},
+		{name: "topic with colons", values: []string{"a:b:0=1"}, wantErr: true},
+		{name: "missing offset", values: []string{"orders:0"}, wantErr: true},
+		{name: "missing partition", values: []string{"orders=10"}, wantErr: true},
+		{name: "invalid partition", values: []string{"orders:x=10"}, wantErr: true},
+		{name: "negative offset", values: []string{"orders:0=-1"}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parsePartitionOffsets(tt.values)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("parsePartitionOffsets() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err == nil && !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("parsePartitionOffsets() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestStartMarker(t *testing.T) {
+	a := startMarker("-6h", []string{"orders:0=1", "orders:1=2"})
+	if b := startMarker("-6h", []string{"orders:1=2", "orders:0=1"}); a != b {
+		t.Errorf("startMarker() depends on the order of the partition offsets: %s != %s", a, b)
+	}
+	if b := startMarker("-6h", []string{"orders:0=1", "orders:1=3"}); a == b {
+		t.Errorf("startMarker() = %s for different partition offsets", a)
+	}
+	if b := startMarker("-1h", []string{"orders:0=1", "orders:1=2"}); a == b {
+		t.Errorf("startMarker() = %s for different initial offsets", a)
+	}
+}
+
+type offsetAndMetadata struct {
+	offset   int64
+	metadata string
+}
+
+// fakeSession tracks the next offsets of the claims the way the offset manager of sarama does
+type fakeSession struct {
+	sarama.ConsumerGroupSession
+	claims  map[string][]int32
+	offsets map[topicPartition]offsetAndMetadata
+	// commits is the number of times the marked offsets were committed
+	commits int
+}
+
+func (s *fakeSession) Claims() map[string][]int32 {
+	return s.claims
+}
+
+func (s *fakeSession) MarkOffset(topic string, partition int32, offset int64, metadata string) {
+	tp := topicPartition{topic: topic, partition: partition}
+	if offset > s.offsets[tp].offset {
+		s.offsets[tp] = offsetAndMetadata{offset, metadata}
+	}
+}
+
+func (s *fakeSession) ResetOffset(topic string, partition int32, offset int64, metadata string) {
+	tp := topicPartition{topic: topic, partition: partition}
+	if offset <= s.offsets[tp].offset {
+		s.offsets[tp] = offsetAndMetadata{offset, metadata}
+	}
+}
+
+func (s *fakeSession) MarkMessage(msg *sarama.ConsumerMessage, metadata string) {
+	s.MarkOffset(msg.Topic, msg.Partition, msg.Offset+1, metadata)
+}
+
+func (s *fakeSession) Commit() {
+	s.commits++
+}
+
+func TestApplyInitialOffsets(t *testing.T) {
+	at := time.Date(2023, 11, 14, 10, 0, 0, 0, time.UTC)
+	marker := "start:current"
+	p0 := topicPartition{topic: "orders", partition: 0}
+	p1 := topicPartition{topic: "orders", partition: 1}
+
+	tests := []struct {
+		name      string
+		explicit  map[string]map[int32]int64
+		at        bool
+		committed map[topicPartition]offsetAndMetadata
+		want      map[topicPartition]offsetAndMetadata
+		// applied is set when the start was applied before
+		applied bool
+	}{
+		{
+			name:     "new group with explicit offsets",
+			explicit: map[string]map[int32]int64{"orders": {0: 5}},
+			want: map[topicPartition]offsetAndMetadata{
+				p0: {5, marker},
+				p1: {sarama.OffsetNewest, ""},
+			},
+		},
+		{
+			name:      "existing group with an explicit offset before the committed one",
+			explicit:  map[string]map[int32]int64{"orders": {0: 5}},
+			committed: map[topicPartition]offsetAndMetadata{p0: {100, ""}, p1: {7, ""}},
+			want:      map[topicPartition]offsetAndMetadata{p0: {5, marker}, p1: {7, ""}},
+		},
+		{
+			name:      "existing group with an explicit offset after the committed one",
+			explicit:  map[string]map[int32]int64{"orders": {0: 500}},
+			committed: map[topicPartition]offsetAndMetadata{p0: {100, ""}, p1: {7, ""}},
+			want:      map[topicPartition]offsetAndMetadata{p0: {500, marker}, p1: {7, ""}},
+		},
+		{
+			name:      "explicit offsets that were applied before",
+			explicit:  map[string]map[int32]int64{"orders": {0: 5}},
+			committed: map[topicPartition]offsetAndMetadata{p0: {120, marker}, p1: {7, ""}},
+			want:      map[topicPartition]offsetAndMetadata{p0: {120, marker}, p1: {7, ""}},
+			applied:   true,
+		},
+		{
+			name:      "explicit offsets that changed since they were applied",
+			explicit:  map[string]map[int32]int64{"orders": {0: 5}},
+			committed: map[topicPartition]offsetAndMetadata{p0: {120, "start:previous"}, p1: {7, "start:previous"}},
+			want:      map[topicPartition]offsetAndMetadata{p0: {5, marker}, p1: {7, "start:previous"}},
+		},
+		{
+			name:      "existing group with a timestamp",
+			at:        true,
+			committed: map[topicPartition]offsetAndMetadata{p0: {100, ""}},
+			// there are no messages in p1 after the timestamp, so it starts from the newest offset
+			want: map[topicPartition]offsetAndMetadata{p0: {40, marker}, p1: {9, marker}},
+		},
+		{
+			name:      "explicit offsets take precedence over a timestamp",
+			explicit:  map[string]map[int32]int64{"orders": {1: 3}},
+			at:        true,
+			committed: map[topicPartition]offsetAndMetadata{p0: {100, ""}, p1: {7, ""}},
+			want:      map[topicPartition]offsetAndMetadata{p0: {40, marker}, p1: {3, marker}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fetch := sarama.NewMockOffsetFetchResponse(t)
+			for tp, c := range tt.committed {
+				fetch.SetOffset("group", tp.topic, tp.partition, c.offset, c.metadata, sarama.ErrNoError)
+			}
+			broker := sarama.NewMockBroker(t, 1)
+			defer broker.Close()
+			broker.SetHandlerByMap(map[string]sarama.MockResponse{
+				"MetadataRequest": sarama.NewMockMetadataResponse(t).
+					SetBroker(broker.Addr(), broker.BrokerID()).
+					SetController(broker.BrokerID()).
+					SetLeader("orders", 0, broker.BrokerID()).
+					SetLeader("orders", 1, broker.BrokerID()),
+				"FindCoordinatorRequest": sarama.NewMockFindCoordinatorResponse(t).
+					SetCoordinator(sarama.CoordinatorGroup, "group", broker),
+				"OffsetFetchRequest": fetch,
+				"OffsetRequest": sarama.NewMockOffsetResponse(t).
+					SetOffset("orders", 0, at.UnixMilli(), 40).
+					SetOffset("orders", 1, at.UnixMilli(), -1).
+					SetOffset("orders", 1, sarama.OffsetNewest, 9),
+			})
+
+			config := sarama.NewConfig()
+			config.Version = sarama.V2_1_0_0
+			client, err := sarama.NewClient([]string{broker.Addr()}, config)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer client.Close()
+			admin, err := sarama.NewClusterAdminFromClient(client)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			o := &initialOffsets{
+				client:   client,
+				admin:    admin,
+				logger:   logr.Discard(),
+				group:    "group",
+				explicit: tt.explicit,
+				marker:   marker,
+			}
+			if tt.at {
+				o.at = at
+			}
+
+			sess := &fakeSession{
+				claims:  map[string][]int32{"orders": {0, 1}},
+				offsets: map[topicPartition]offsetAndMetadata{p0: {sarama.OffsetNewest, ""}, p1: {sarama.OffsetNewest, ""}},
+			}
+			for tp, c := range tt.committed {
+				sess.offsets[tp] = c
+			}
+			if err := o.apply(sess); err != nil {
+				t.Fatalf("apply() error = %v", err)
+			}
+			if !reflect.DeepEqual(sess.offsets, tt.want) {
+				t.Errorf("apply() offsets = %v, want %v", sess.offsets, tt.want)
+			}
+			// the start is committed whenever it moved an offset
+			if wantCommit := !tt.applied; (sess.commits > 0) != wantCommit {
+				t.Errorf("apply() committed %d times, want a commit %v", sess.commits, wantCommit)
+			}
+		})
+	}
+}
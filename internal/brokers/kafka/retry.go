@@ -0,0 +1,88 @@
+/*
+Copyright (c) 2022 RaptorML authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package kafka
+
+import (
+	"fmt"
+	"github.com/IBM/sarama"
+	"github.com/go-logr/logr"
+)
+
+// originHeader is added to dead-lettered messages, with the id of the message they were copied from
+const originHeader = "x-raptor-origin"
+
+// retryOptions controls what happens to nacked messages
+type retryOptions struct {
+	maxRetries int
+	// producer produces to the dead-letter topic, and is nil when there is none
+	producer        sarama.SyncProducer
+	deadLetterTopic string
+	logger          logr.Logger
+}
+
+func parseRetryOptions(maxRetries int, deadLetterTopic string, logger logr.Logger) (retryOptions, error) {
+	if maxRetries < 0 {
+		return retryOptions{}, fmt.Errorf("max_retries must be positive")
+	}
+	if maxRetries == 0 {
+		maxRetries = 3
+	}
+	return retryOptions{maxRetries: maxRetries, deadLetterTopic: deadLetterTopic, logger: logger}, nil
+}
+
+// apply configures the producer of the client, which returns successes to produce synchronously
+func (o retryOptions) apply(config *sarama.Config) {
+	if o.deadLetterTopic != "" {
+		config.Producer.Return.Successes = true
+		config.Producer.RequiredAcks = sarama.WaitForAll
+	}
+}
+
+// giveUp produces a message that failed too many times to the dead-letter topic, or logs and drops it
+func (o retryOptions) giveUp(msg *sarama.ConsumerMessage, attempts int) error {
+	id := messageID(msg)
+	if o.producer == nil {
+		o.logger.Error(nil, "Dropping a message that failed to be handled", "id", id, "attempts", attempts)
+		return nil
+	}
+
+	headers := make([]sarama.RecordHeader, 0, len(msg.Headers)+1)
+	for _, h := range msg.Headers {
+		headers = append(headers, *h)
+	}
+	headers = append(headers, sarama.RecordHeader{Key: []byte(originHeader), Value: []byte(id)})
+	pm := &sarama.ProducerMessage{
+		Topic:     o.deadLetterTopic,
+		Value:     sarama.ByteEncoder(msg.Value),
+		Headers:   headers,
+		Timestamp: msg.Timestamp,
+	}
+	if msg.Key != nil {
+		pm.Key = sarama.ByteEncoder(msg.Key)
+	}
+	if _, _, err := o.producer.SendMessage(pm); err != nil {
+		return fmt.Errorf("failed to produce %s to the dead-letter topic: %w", id, err)
+	}
+	o.logger.Info("Produced a message that failed to be handled to the dead-letter topic",
+		"id", id, "attempts", attempts, "topic", o.deadLetterTopic)
+	return nil
+}
+
+// messageID identifies a message within the cluster
+func messageID(msg *sarama.ConsumerMessage) string {
+	return fmt.Sprintf("%s/%d/%d", msg.Topic, msg.Partition, msg.Offset)
+}
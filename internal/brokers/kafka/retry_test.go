@@ -0,0 +1,138 @@
+/*
+Copyright (c) 2022 RaptorML authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package kafka
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/IBM/sarama"
+	"github.com/IBM/sarama/mocks"
+	"github.com/go-logr/logr"
+	"gocloud.dev/pubsub/driver"
+	"testing"
+)
+
+func TestSendNacks(t *testing.T) {
+	tp := topicPartition{topic: "orders", partition: 0}
+	checkDeadLetter := func(pm *sarama.ProducerMessage) error {
+		if pm.Topic != "orders-dlq" {
+			return fmt.Errorf("produced to %s", pm.Topic)
+		}
+		for _, h := range pm.Headers {
+			if string(h.Key) == originHeader && string(h.Value) == "orders/0/10" {
+				return nil
+			}
+		}
+		return fmt.Errorf("missing %s header in %v", originHeader, pm.Headers)
+	}
+
+	tests := []struct {
+		name string
+		// producer expects the messages produced to the dead-letter topic, and is nil without one
+		producer func(t *testing.T) sarama.SyncProducer
+		// wantMarked is the next offset to commit once the message failed more than max_retries times
+		wantMarked int64
+	}{
+		{
+			name:       "dropped without a dead-letter topic",
+			wantMarked: 12,
+		},
+		{
+			name: "produced to the dead-letter topic",
+			producer: func(t *testing.T) sarama.SyncProducer {
+				return mocks.NewSyncProducer(t, nil).ExpectSendMessageWithMessageCheckerFunctionAndSucceed(checkDeadLetter)
+			},
+			wantMarked: 12,
+		},
+		{
+			name: "dead-letter topic unavailable",
+			producer: func(t *testing.T) sarama.SyncProducer {
+				return mocks.NewSyncProducer(t, nil).ExpectSendMessageAndFail(errors.New("unavailable"))
+			},
+			// the message is delivered again instead, so it holds back its partition
+			wantMarked: 0,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			retry := retryOptions{maxRetries: 2, deadLetterTopic: "orders-dlq"}
+			if tt.producer != nil {
+				retry.producer = tt.producer(t)
+				defer retry.producer.Close()
+			}
+			commit, _ := parseCommitOptions("per_message", 0, 0)
+			// rejoining the group panics, so a nack must never rebalance the group
+			s, sess := newTestSubscription(commit, retry)
+			dms := deliver(s, tp, 10, 11)
+			if err := s.SendAcks(context.Background(), []driver.AckID{dms[1].AckID}); err != nil {
+				t.Fatalf("SendAcks() error = %v", err)
+			}
+
+			failing := dms[0]
+			for i := 0; i < retry.maxRetries; i++ {
+				if err := s.SendNacks(context.Background(), []driver.AckID{failing.AckID}); err != nil {
+					t.Fatalf("SendNacks() error = %v", err)
+				}
+				got, err := s.ReceiveBatch(context.Background(), 10)
+				if err != nil {
+					t.Fatalf("ReceiveBatch() error = %v", err)
+				}
+				if len(got) != 1 || got[0].LoggableID != "orders/0/10" {
+					t.Fatalf("ReceiveBatch() after nack %d = %v, want the nacked message", i+1, got)
+				}
+				if _, ok := sess.offsets[tp]; ok {
+					t.Fatalf("marked offset %d while the message is retried", sess.offsets[tp].offset)
+				}
+				failing = got[0]
+			}
+
+			if err := s.SendNacks(context.Background(), []driver.AckID{failing.AckID}); err != nil {
+				t.Fatalf("SendNacks() error = %v", err)
+			}
+			if got := sess.offsets[tp].offset; got != tt.wantMarked {
+				t.Errorf("marked offset = %d, want %d", got, tt.wantMarked)
+			}
+			if redelivered := len(s.redeliver) > 0; redelivered != (tt.wantMarked == 0) {
+				t.Errorf("message redelivered = %v after failing %d times", redelivered, retry.maxRetries+1)
+			}
+		})
+	}
+}
+
+func TestParseRetryOptions(t *testing.T) {
+	tests := []struct {
+		maxRetries int
+		want       int
+		wantErr    bool
+	}{
+		{maxRetries: 0, want: 3},
+		{maxRetries: 5, want: 5},
+		{maxRetries: -1, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(fmt.Sprint(tt.maxRetries), func(t *testing.T) {
+			got, err := parseRetryOptions(tt.maxRetries, "", logr.Discard())
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("parseRetryOptions() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err == nil && got.maxRetries != tt.want {
+				t.Errorf("parseRetryOptions() max retries = %d, want %d", got.maxRetries, tt.want)
+			}
+		})
+	}
+}
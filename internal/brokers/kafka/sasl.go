@@ -0,0 +1,140 @@
+/*
+Copyright (c) 2022 RaptorML authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package kafka
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/sha512"
+	"fmt"
+	"github.com/IBM/sarama"
+	"github.com/xdg-go/scram"
+	"golang.org/x/oauth2"
+	"golang.org/x/oauth2/clientcredentials"
+	"strings"
+)
+
+func updateSASLConfig(ctx context.Context, config *sarama.Config, in config) error {
+	mechanism := sarama.SASLMechanism(strings.ToUpper(in.SaslMechanism))
+	switch mechanism {
+	case "":
+		if in.SaslUsername == "" || in.SaslPassword == "" {
+			return nil
+		}
+		mechanism = sarama.SASLTypePlaintext
+	case sarama.SASLTypePlaintext, sarama.SASLTypeSCRAMSHA256, sarama.SASLTypeSCRAMSHA512:
+		if in.SaslUsername == "" || in.SaslPassword == "" {
+			return fmt.Errorf("sasl_username and sasl_password required for %s", mechanism)
+		}
+	case sarama.SASLTypeOAuth:
+		if in.SaslOAuthTokenURL == "" || in.SaslOAuthClientID == "" || in.SaslOAuthClientSecret == "" {
+			return fmt.Errorf("sasl_oauth_token_url, sasl_oauth_client_id and sasl_oauth_client_secret required for %s", mechanism)
+		}
+	case sarama.SASLTypeGSSAPI:
+		if in.SaslUsername == "" || in.SaslKerberosRealm == "" {
+			return fmt.Errorf("sasl_username and sasl_kerberos_realm required for %s", mechanism)
+		}
+		if in.SaslKerberosKeytabPath == "" && in.SaslPassword == "" {
+			return fmt.Errorf("sasl_kerberos_keytab_path or sasl_password required for %s", mechanism)
+		}
+	default:
+		return fmt.Errorf("unsupported sasl mechanism: %s", in.SaslMechanism)
+	}
+
+	config.Net.SASL.Enable = true
+	config.Net.SASL.Handshake = true
+	config.Net.SASL.Mechanism = mechanism
+	config.Net.SASL.User = in.SaslUsername
+	config.Net.SASL.Password = in.SaslPassword
+
+	switch mechanism {
+	case sarama.SASLTypeSCRAMSHA256:
+		config.Net.SASL.SCRAMClientGeneratorFunc = func() sarama.SCRAMClient {
+			return &scramClient{HashGeneratorFcn: sha256.New}
+		}
+	case sarama.SASLTypeSCRAMSHA512:
+		config.Net.SASL.SCRAMClientGeneratorFunc = func() sarama.SCRAMClient {
+			return &scramClient{HashGeneratorFcn: sha512.New}
+		}
+	case sarama.SASLTypeOAuth:
+		cc := clientcredentials.Config{
+			ClientID:     in.SaslOAuthClientID,
+			ClientSecret: in.SaslOAuthClientSecret,
+			TokenURL:     in.SaslOAuthTokenURL,
+			Scopes:       in.SaslOAuthScopes,
+		}
+		config.Net.SASL.TokenProvider = &tokenProvider{ts: cc.TokenSource(ctx)}
+	case sarama.SASLTypeGSSAPI:
+		config.Net.SASL.GSSAPI = sarama.GSSAPIConfig{
+			AuthType:           sarama.KRB5_USER_AUTH,
+			KerberosConfigPath: in.SaslKerberosConfigPath,
+			ServiceName:        in.SaslKerberosServiceName,
+			Username:           in.SaslUsername,
+			Password:           in.SaslPassword,
+			Realm:              in.SaslKerberosRealm,
+			DisablePAFXFAST:    in.SaslKerberosDisablePAFXFAST,
+		}
+		if in.SaslKerberosKeytabPath != "" {
+			config.Net.SASL.GSSAPI.AuthType = sarama.KRB5_KEYTAB_AUTH
+			config.Net.SASL.GSSAPI.KeyTabPath = in.SaslKerberosKeytabPath
+			config.Net.SASL.GSSAPI.Password = ""
+		}
+		if config.Net.SASL.GSSAPI.KerberosConfigPath == "" {
+			config.Net.SASL.GSSAPI.KerberosConfigPath = "/etc/krb5.conf"
+		}
+		if config.Net.SASL.GSSAPI.ServiceName == "" {
+			config.Net.SASL.GSSAPI.ServiceName = "kafka"
+		}
+	}
+	return nil
+}
+
+// scramClient implements sarama.SCRAMClient
+type scramClient struct {
+	*scram.ClientConversation
+	scram.HashGeneratorFcn
+}
+
+func (c *scramClient) Begin(userName, password, authzID string) error {
+	client, err := c.HashGeneratorFcn.NewClient(userName, password, authzID)
+	if err != nil {
+		return err
+	}
+	c.ClientConversation = client.NewConversation()
+	return nil
+}
+
+func (c *scramClient) Step(challenge string) (string, error) {
+	return c.ClientConversation.Step(challenge)
+}
+
+func (c *scramClient) Done() bool {
+	return c.ClientConversation.Done()
+}
+
+// tokenProvider implements sarama.AccessTokenProvider. The token source caches the token until it expires.
+type tokenProvider struct {
+	ts oauth2.TokenSource
+}
+
+func (p *tokenProvider) Token() (*sarama.AccessToken, error) {
+	t, err := p.ts.Token()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get oauth token: %w", err)
+	}
+	return &sarama.AccessToken{Token: t.AccessToken}, nil
+}
@@ -0,0 +1,116 @@
+/*
+Copyright (c) 2022 RaptorML authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package kafka
+
+import (
+	"crypto/tls"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// isPEM reports whether the value is an inline PEM block, rather than a path to a file
+func isPEM(value string) bool {
+	return strings.Contains(value, "-----BEGIN")
+}
+
+// readPEM returns the inline PEM, or the content of the file it points to
+func readPEM(value string) ([]byte, error) {
+	if isPEM(value) {
+		return []byte(value), nil
+	}
+	return os.ReadFile(value)
+}
+
+// clientCertificate returns the GetClientCertificate callback for the tls.Config.
+// Certificates that are read from files are reloaded when the files change, so rotated certificates
+// (e.g. of a mounted Secret) are used for new connections.
+func clientCertificate(cert, key string) (func(*tls.CertificateRequestInfo) (*tls.Certificate, error), error) {
+	if isPEM(cert) && isPEM(key) {
+		c, err := tls.X509KeyPair([]byte(cert), []byte(key))
+		if err != nil {
+			return nil, fmt.Errorf("kafka error: unable to load client certificate: %w", err)
+		}
+		return func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+			return &c, nil
+		}, nil
+	}
+
+	l := &certLoader{cert: cert, key: key}
+	if _, err := l.load(); err != nil {
+		return nil, err
+	}
+	return func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+		return l.load()
+	}, nil
+}
+
+type certLoader struct {
+	cert, key string
+
+	mu      sync.Mutex
+	current *tls.Certificate
+	modTime time.Time
+}
+
+// load returns the certificate, reloading it if any of the files was modified since it was last loaded
+func (l *certLoader) load() (*tls.Certificate, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	var modTime time.Time
+	for _, v := range []string{l.cert, l.key} {
+		if isPEM(v) {
+			continue
+		}
+		fi, err := os.Stat(v)
+		if err != nil {
+			if l.current != nil {
+				// the files may be in the middle of a rotation, keep using the current certificate
+				return l.current, nil
+			}
+			return nil, fmt.Errorf("kafka error: unable to load client certificate: %w", err)
+		}
+		if fi.ModTime().After(modTime) {
+			modTime = fi.ModTime()
+		}
+	}
+	if l.current != nil && !modTime.After(l.modTime) {
+		return l.current, nil
+	}
+
+	cert, err := readPEM(l.cert)
+	if err != nil {
+		return nil, fmt.Errorf("kafka error: unable to read client certificate: %w", err)
+	}
+	key, err := readPEM(l.key)
+	if err != nil {
+		return nil, fmt.Errorf("kafka error: unable to read client key: %w", err)
+	}
+	c, err := tls.X509KeyPair(cert, key)
+	if err != nil {
+		if l.current != nil {
+			return l.current, nil
+		}
+		return nil, fmt.Errorf("kafka error: unable to load client certificate: %w", err)
+	}
+	l.current = &c
+	l.modTime = modTime
+	return l.current, nil
+}
@@ -0,0 +1,277 @@
+/*
+Copyright (c) 2022 RaptorML authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package kafka
+
+import (
+	"bufio"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"github.com/IBM/sarama"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+type testCert struct {
+	cert    *x509.Certificate
+	key     *ecdsa.PrivateKey
+	certPEM string
+	keyPEM  string
+}
+
+// newCert generates a certificate signed by the parent, or a self-signed CA when the parent is nil
+func newCert(t *testing.T, cn string, parent *testCert) *testCert {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: cn},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1)},
+	}
+	signer, signerKey := tmpl, key
+	if parent == nil {
+		tmpl.IsCA = true
+		tmpl.BasicConstraintsValid = true
+		tmpl.KeyUsage |= x509.KeyUsageCertSign
+	} else {
+		signer, signerKey = parent.cert, parent.key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, signer, &key.PublicKey, signerKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &testCert{
+		cert:    cert,
+		key:     key,
+		certPEM: string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})),
+		keyPEM:  string(pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})),
+	}
+}
+
+// listen starts a TLS listener that requires a client certificate signed by the CA,
+// and replies with the common name of the client certificate
+func listen(t *testing.T, ca, server *testCert) string {
+	t.Helper()
+	pool := x509.NewCertPool()
+	pool.AddCert(ca.cert)
+	cert, err := tls.X509KeyPair([]byte(server.certPEM), []byte(server.keyPEM))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ln, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+		ClientCAs:    pool,
+		MinVersion:   tls.VersionTLS12,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = ln.Close() })
+
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func(conn *tls.Conn) {
+				defer conn.Close()
+				if err := conn.Handshake(); err != nil {
+					return
+				}
+				_, _ = conn.Write([]byte(conn.ConnectionState().PeerCertificates[0].Subject.CommonName + "\n"))
+			}(conn.(*tls.Conn))
+		}
+	}()
+	return ln.Addr().String()
+}
+
+// handshake connects with the TLS config of the consumer, and returns the common name the server saw
+func handshake(cfg *tls.Config, addr string) (string, error) {
+	conn, err := tls.DialWithDialer(&net.Dialer{Timeout: 5 * time.Second}, "tcp", addr, cfg)
+	if err != nil {
+		return "", err
+	}
+	defer conn.Close()
+	_ = conn.SetDeadline(time.Now().Add(5 * time.Second))
+	// with TLS 1.3 the server verifies the client certificate after the client finished the handshake
+	cn, err := bufio.NewReader(conn).ReadString('\n')
+	return strings.TrimSpace(cn), err
+}
+
+func writeFile(t *testing.T, path, data string, modTime time.Time) {
+	t.Helper()
+	if err := os.WriteFile(path, []byte(data), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chtimes(path, modTime, modTime); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestMutualTLS(t *testing.T) {
+	ca := newCert(t, "ca", nil)
+	otherCA := newCert(t, "other-ca", nil)
+	addr := listen(t, ca, newCert(t, "broker", ca))
+	client := newCert(t, "client", ca)
+	untrusted := newCert(t, "untrusted", otherCA)
+
+	dir := t.TempDir()
+	now := time.Now()
+	writeFile(t, filepath.Join(dir, "ca.crt"), ca.certPEM, now)
+	writeFile(t, filepath.Join(dir, "tls.crt"), client.certPEM, now)
+	writeFile(t, filepath.Join(dir, "tls.key"), client.keyPEM, now)
+
+	tests := []struct {
+		name string
+		in   config
+		// wantConfigErr fails the configuration, and wantErr fails the handshake
+		wantConfigErr bool
+		wantErr       bool
+		wantCN        string
+	}{
+		{
+			name:   "inline certificates",
+			in:     config{TLSCaCert: ca.certPEM, TLSClientCert: client.certPEM, TLSClientKey: client.keyPEM},
+			wantCN: "client",
+		},
+		{
+			name:   "certificate files",
+			in:     config{TLSCaCert: filepath.Join(dir, "ca.crt"), TLSClientCert: filepath.Join(dir, "tls.crt"), TLSClientKey: filepath.Join(dir, "tls.key")},
+			wantCN: "client",
+		},
+		{
+			name:    "broker signed by another ca",
+			in:      config{TLSCaCert: otherCA.certPEM, TLSClientCert: client.certPEM, TLSClientKey: client.keyPEM},
+			wantErr: true,
+		},
+		{
+			name:    "client signed by another ca",
+			in:      config{TLSCaCert: ca.certPEM, TLSClientCert: untrusted.certPEM, TLSClientKey: untrusted.keyPEM},
+			wantErr: true,
+		},
+		{
+			name:    "no client certificate",
+			in:      config{TLSCaCert: ca.certPEM},
+			wantErr: true,
+		},
+		{
+			name:          "mismatching key",
+			in:            config{TLSCaCert: ca.certPEM, TLSClientCert: client.certPEM, TLSClientKey: untrusted.keyPEM},
+			wantConfigErr: true,
+		},
+		{
+			name:          "missing key",
+			in:            config{TLSCaCert: ca.certPEM, TLSClientCert: client.certPEM},
+			wantConfigErr: true,
+		},
+		{
+			name:          "missing certificate file",
+			in:            config{TLSCaCert: ca.certPEM, TLSClientCert: filepath.Join(dir, "missing.crt"), TLSClientKey: filepath.Join(dir, "tls.key")},
+			wantConfigErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sc := sarama.NewConfig()
+			err := updateTLSConfig(sc, tt.in)
+			if (err != nil) != tt.wantConfigErr {
+				t.Fatalf("updateTLSConfig() error = %v, wantErr %v", err, tt.wantConfigErr)
+			}
+			if err != nil {
+				return
+			}
+			if !sc.Net.TLS.Enable {
+				t.Fatalf("TLS is not enabled")
+			}
+
+			cn, err := handshake(sc.Net.TLS.Config, addr)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("handshake() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if cn != tt.wantCN {
+				t.Errorf("server saw client %q, want %q", cn, tt.wantCN)
+			}
+		})
+	}
+}
+
+func TestClientCertificateReload(t *testing.T) {
+	ca := newCert(t, "ca", nil)
+	addr := listen(t, ca, newCert(t, "broker", ca))
+
+	dir := t.TempDir()
+	certPath, keyPath := filepath.Join(dir, "tls.crt"), filepath.Join(dir, "tls.key")
+	first := newCert(t, "first", ca)
+	now := time.Now()
+	writeFile(t, certPath, first.certPEM, now)
+	writeFile(t, keyPath, first.keyPEM, now)
+
+	sc := sarama.NewConfig()
+	if err := updateTLSConfig(sc, config{TLSCaCert: ca.certPEM, TLSClientCert: certPath, TLSClientKey: keyPath}); err != nil {
+		t.Fatalf("updateTLSConfig() error = %v", err)
+	}
+	if cn, err := handshake(sc.Net.TLS.Config, addr); err != nil || cn != "first" {
+		t.Fatalf("handshake() = %q, %v, want first", cn, err)
+	}
+
+	// a rotation in progress leaves the files inconsistent, so the current certificate is kept
+	second := newCert(t, "second", ca)
+	writeFile(t, certPath, second.certPEM, now.Add(time.Minute))
+	if cn, err := handshake(sc.Net.TLS.Config, addr); err != nil || cn != "first" {
+		t.Fatalf("handshake() during the rotation = %q, %v, want first", cn, err)
+	}
+
+	// once both files are rewritten, new connections use the rotated certificate
+	writeFile(t, keyPath, second.keyPEM, now.Add(2*time.Minute))
+	if cn, err := handshake(sc.Net.TLS.Config, addr); err != nil || cn != "second" {
+		t.Fatalf("handshake() after the rotation = %q, %v, want second", cn, err)
+	}
+
+	// a removed file keeps the current certificate as well
+	if err := os.Remove(keyPath); err != nil {
+		t.Fatal(err)
+	}
+	if cn, err := handshake(sc.Net.TLS.Config, addr); err != nil || cn != "second" {
+		t.Fatalf("handshake() with a missing key = %q, %v, want second", cn, err)
+	}
+}
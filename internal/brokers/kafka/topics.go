@@ -0,0 +1,65 @@
+/*
+Copyright (c) 2022 RaptorML authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package kafka
+
+import (
+	"fmt"
+	"github.com/IBM/sarama"
+	"regexp"
+	"slices"
+	"strings"
+	"time"
+)
+
+// topics are the topics to consume: a static list, and the topics of the cluster matching a pattern
+type topics struct {
+	static          []string
+	pattern         *regexp.Regexp
+	refreshInterval time.Duration
+}
+
+// compileTopicPattern compiles a pattern that matches whole topic names
+func compileTopicPattern(pattern string) (*regexp.Regexp, error) {
+	// the pattern is compiled on its own first, so unbalanced groups can't escape the anchors
+	if _, err := regexp.Compile(pattern); err != nil {
+		return nil, err
+	}
+	return regexp.Compile("^(?:" + pattern + ")$")
+}
+
+// resolve returns the sorted topics to consume
+func (t topics) resolve(client sarama.Client) ([]string, error) {
+	ret := slices.Clone(t.static)
+	if t.pattern != nil {
+		if err := client.RefreshMetadata(); err != nil {
+			return nil, fmt.Errorf("failed to refresh kafka metadata: %w", err)
+		}
+		all, err := client.Topics()
+		if err != nil {
+			return nil, fmt.Errorf("failed to list kafka topics: %w", err)
+		}
+		for _, topic := range all {
+			// internal topics (e.g. __consumer_offsets) are never matched
+			if strings.HasPrefix(topic, "__") || !t.pattern.MatchString(topic) {
+				continue
+			}
+			ret = append(ret, topic)
+		}
+	}
+	slices.Sort(ret)
+	return slices.Compact(ret), nil
+}
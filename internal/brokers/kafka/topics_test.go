@@ -0,0 +1,81 @@
+/*
+Copyright (c) 2022 RaptorML authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package kafka
+
+import (
+	"github.com/IBM/sarama"
+	"strings"
+	"testing"
+)
+
+// fakeClient lists a fixed set of topics
+type fakeClient struct {
+	sarama.Client
+	topics []string
+}
+
+func (c *fakeClient) RefreshMetadata(...string) error {
+	return nil
+}
+
+func (c *fakeClient) Topics() ([]string, error) {
+	return c.topics, nil
+}
+
+func TestResolveTopics(t *testing.T) {
+	client := &fakeClient{topics: []string{"orders", "orders-dlq", "orders-retry", "eu.orders", "payments", "__consumer_offsets"}}
+	tests := []struct {
+		name    string
+		static  []string
+		pattern string
+		want    string
+		wantErr bool
+	}{
+		{name: "static topics", static: []string{"payments", "orders"}, want: "orders,payments"},
+		{name: "literal pattern", pattern: "orders", want: "orders"},
+		{name: "prefix pattern", pattern: "orders.*", want: "orders,orders-dlq,orders-retry"},
+		{name: "alternation", pattern: "orders|payments", want: "orders,payments"},
+		{name: "suffix pattern", pattern: ".*orders", want: "eu.orders,orders"},
+		{name: "static topics and pattern", static: []string{"orders"}, pattern: "orders-.*", want: "orders,orders-dlq,orders-retry"},
+		{name: "internal topics", pattern: ".*", want: "eu.orders,orders,orders-dlq,orders-retry,payments"},
+		{name: "invalid pattern", pattern: "orders(", wantErr: true},
+		{name: "unbalanced group", pattern: "orders)|(.*", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tp := topics{static: tt.static}
+			if tt.pattern != "" {
+				var err error
+				tp.pattern, err = compileTopicPattern(tt.pattern)
+				if (err != nil) != tt.wantErr {
+					t.Fatalf("compileTopicPattern() error = %v, wantErr %v", err, tt.wantErr)
+				}
+				if err != nil {
+					return
+				}
+			}
+
+			got, err := tp.resolve(client)
+			if err != nil {
+				t.Fatalf("resolve() error = %v", err)
+			}
+			if strings.Join(got, ",") != tt.want {
+				t.Errorf("resolve() = %v, want %s", got, tt.want)
+			}
+		})
+	}
+}
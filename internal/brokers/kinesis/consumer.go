@@ -0,0 +1,455 @@
+/*
+Copyright (c) 2022 RaptorML authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package kinesis
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/kinesis"
+	"github.com/aws/aws-sdk-go-v2/service/kinesis/types"
+	"github.com/raptor-ml/streaming-runner/internal/checkpoint"
+	"strings"
+	"sync"
+	"time"
+)
+
+// shardEnd is the checkpoint of a shard that was fully consumed. A shard that was read from a point in time, rather
+// than from a checkpoint or from its beginning, is checkpointed as shardEnd@<time>, so its children are read from
+// the same time instead of replaying them from their beginning.
+const shardEnd = "SHARD_END"
+
+func endCheckpoint(from time.Time) string {
+	if from.IsZero() {
+		return shardEnd
+	}
+	return shardEnd + "@" + from.UTC().Format(time.RFC3339Nano)
+}
+
+// parseEnd reports whether the checkpoint is of a consumed shard, and the time the shard was read from, if any
+func parseEnd(cp string) (from time.Time, ended bool) {
+	if cp == shardEnd {
+		return time.Time{}, true
+	}
+	ts, ok := strings.CutPrefix(cp, shardEnd+"@")
+	if !ok {
+		return time.Time{}, false
+	}
+	from, _ = time.Parse(time.RFC3339Nano, ts)
+	return from, true
+}
+
+// record is a record that was received from a shard
+type record struct {
+	types.Record
+	shard *shard
+	acked bool
+}
+
+// shard is a shard that is being (or was) read
+type shard struct {
+	id string
+	// from is the time the shard is read from, when it wasn't started from a checkpoint or from its beginning
+	from    time.Time
+	pending []*record
+	ended   bool
+}
+
+// consumer discovers the shards of the stream, reads them, and tracks their checkpoints.
+// A shard is read only after its parents were fully consumed, to keep the order of records by partition key.
+type consumer struct {
+	client            *kinesis.Client
+	stream            string
+	consumerARN       string
+	initialPosition   types.ShardIteratorType
+	pollInterval      time.Duration
+	maxRecords        int32
+	discoveryInterval time.Duration
+	store             checkpoint.Store
+
+	records    chan *record
+	errs       chan error
+	rediscover chan struct{}
+
+	mu          sync.Mutex
+	shards      map[string]*shard
+	checkpoints map[string]string
+	dirty       bool
+}
+
+func (c *consumer) fail(err error) {
+	select {
+	case c.errs <- err:
+	default:
+	}
+}
+
+func (c *consumer) load(ctx context.Context) error {
+	data, err := c.store.Load(ctx)
+	if err != nil {
+		return err
+	}
+	c.checkpoints = make(map[string]string)
+	if len(data) > 0 {
+		if err := json.Unmarshal(data, &c.checkpoints); err != nil {
+			return fmt.Errorf("invalid checkpoint: %w", err)
+		}
+	}
+	return nil
+}
+
+func (c *consumer) run(ctx context.Context) {
+	ticker := time.NewTicker(c.discoveryInterval)
+	defer ticker.Stop()
+	for {
+		if err := c.discover(ctx); err != nil {
+			if ctx.Err() == nil {
+				c.fail(err)
+			}
+			return
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		case <-c.rediscover:
+		}
+	}
+}
+
+// discover starts reading the shards that are ready to be read
+func (c *consumer) discover(ctx context.Context) error {
+	shards, err := c.listShards(ctx)
+	if err != nil {
+		return err
+	}
+	listed := make(map[string]bool, len(shards))
+	for _, s := range shards {
+		listed[aws.ToString(s.ShardId)] = true
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	// shards that were consumed and expired don't need to be remembered anymore
+	for id, cp := range c.checkpoints {
+		if _, ended := parseEnd(cp); ended && !listed[id] {
+			delete(c.checkpoints, id)
+			c.dirty = true
+		}
+	}
+
+	for _, s := range shards {
+		id := aws.ToString(s.ShardId)
+		if _, ok := c.shards[id]; ok {
+			continue
+		}
+		if _, ended := parseEnd(c.checkpoints[id]); ended {
+			continue
+		}
+		inherited, ok := c.parentsConsumed(listed, s.ParentShardId, s.AdjacentParentShardId)
+		if !ok {
+			continue
+		}
+
+		pos := &types.StartingPosition{Type: c.initialPosition}
+		if cp := c.checkpoints[id]; cp != "" {
+			pos = &types.StartingPosition{Type: types.ShardIteratorTypeAfterSequenceNumber, SequenceNumber: aws.String(cp)}
+		} else if inherited != nil {
+			pos = inherited
+		}
+
+		sh := &shard{id: id}
+		switch pos.Type {
+		case types.ShardIteratorTypeLatest:
+			sh.from = time.Now()
+		case types.ShardIteratorTypeAtTimestamp:
+			sh.from = aws.ToTime(pos.Timestamp)
+		}
+		c.shards[id] = sh
+		go func() {
+			var err error
+			if c.consumerARN != "" {
+				err = c.subscribe(ctx, sh, pos)
+			} else {
+				err = c.poll(ctx, sh, pos)
+			}
+			if err != nil && ctx.Err() == nil {
+				c.fail(fmt.Errorf("failed to read shard %s: %w", sh.id, err))
+			}
+		}()
+	}
+	return nil
+}
+
+// parentsConsumed reports whether the parents were consumed (or expired), and where their child should be read from.
+// The child was created while its parents were read, so it's read from its beginning when any of the parents was read
+// continuously, or otherwise from the earliest time the parents were read from. The position is nil when none of the
+// parents was consumed by this consumer.
+func (c *consumer) parentsConsumed(listed map[string]bool, parents ...*string) (pos *types.StartingPosition, ok bool) {
+	var consumed, continuous bool
+	var from time.Time
+	for _, p := range parents {
+		id := aws.ToString(p)
+		if id == "" || !listed[id] {
+			continue
+		}
+		t, ended := parseEnd(c.checkpoints[id])
+		if !ended {
+			return nil, false
+		}
+		consumed = true
+		if t.IsZero() {
+			continuous = true
+		} else if from.IsZero() || t.Before(from) {
+			from = t
+		}
+	}
+
+	switch {
+	case !consumed:
+		return nil, true
+	case continuous:
+		return &types.StartingPosition{Type: types.ShardIteratorTypeTrimHorizon}, true
+	default:
+		return &types.StartingPosition{Type: types.ShardIteratorTypeAtTimestamp, Timestamp: aws.Time(from)}, true
+	}
+}
+
+func (c *consumer) listShards(ctx context.Context) ([]types.Shard, error) {
+	var shards []types.Shard
+	in := &kinesis.ListShardsInput{StreamName: aws.String(c.stream)}
+	for {
+		out, err := c.client.ListShards(ctx, in)
+		if err != nil {
+			return nil, fmt.Errorf("failed to list shards: %w", err)
+		}
+		shards = append(shards, out.Shards...)
+		if out.NextToken == nil {
+			return shards, nil
+		}
+		// the stream name must not be set along with the token
+		in = &kinesis.ListShardsInput{NextToken: out.NextToken}
+	}
+}
+
+// poll reads the shard using GetRecords
+func (c *consumer) poll(ctx context.Context, sh *shard, pos *types.StartingPosition) error {
+	iterator := func(pos *types.StartingPosition) (*string, error) {
+		out, err := c.client.GetShardIterator(ctx, &kinesis.GetShardIteratorInput{
+			StreamName:             aws.String(c.stream),
+			ShardId:                aws.String(sh.id),
+			ShardIteratorType:      pos.Type,
+			StartingSequenceNumber: pos.SequenceNumber,
+			Timestamp:              pos.Timestamp,
+		})
+		if err != nil {
+			return nil, err
+		}
+		return out.ShardIterator, nil
+	}
+
+	it, err := iterator(pos)
+	if err != nil {
+		return err
+	}
+	for it != nil {
+		out, err := c.client.GetRecords(ctx, &kinesis.GetRecordsInput{ShardIterator: it, Limit: aws.Int32(c.maxRecords)})
+		var expired *types.ExpiredIteratorException
+		var throttled *types.ProvisionedThroughputExceededException
+		switch {
+		case errors.As(err, &expired):
+			if it, err = iterator(pos); err != nil {
+				return err
+			}
+			continue
+		case errors.As(err, &throttled):
+			if err := sleep(ctx, c.pollInterval); err != nil {
+				return err
+			}
+			continue
+		case err != nil:
+			return err
+		}
+
+		for _, r := range out.Records {
+			if err := c.emit(ctx, sh, r); err != nil {
+				return err
+			}
+			pos = &types.StartingPosition{Type: types.ShardIteratorTypeAfterSequenceNumber, SequenceNumber: r.SequenceNumber}
+		}
+		it = out.NextShardIterator
+
+		if len(out.Records) == 0 && it != nil {
+			if err := sleep(ctx, c.pollInterval); err != nil {
+				return err
+			}
+		}
+	}
+
+	c.end(sh)
+	return nil
+}
+
+// subscribe reads the shard using enhanced fan-out. Each subscription lasts up to 5 minutes, and then renewed.
+func (c *consumer) subscribe(ctx context.Context, sh *shard, pos *types.StartingPosition) error {
+	for {
+		out, err := c.client.SubscribeToShard(ctx, &kinesis.SubscribeToShardInput{
+			ConsumerARN:      aws.String(c.consumerARN),
+			ShardId:          aws.String(sh.id),
+			StartingPosition: pos,
+		})
+		// the previous subscription of the shard may still be active for a few seconds
+		var inUse *types.ResourceInUseException
+		if errors.As(err, &inUse) {
+			if err := sleep(ctx, time.Second); err != nil {
+				return err
+			}
+			continue
+		}
+		if err != nil {
+			return err
+		}
+
+		stream := out.GetStream()
+		for ev := range stream.Events() {
+			e, ok := ev.(*types.SubscribeToShardEventStreamMemberSubscribeToShardEvent)
+			if !ok {
+				continue
+			}
+			for _, r := range e.Value.Records {
+				if err := c.emit(ctx, sh, r); err != nil {
+					_ = stream.Close()
+					return err
+				}
+			}
+			if e.Value.ContinuationSequenceNumber == nil {
+				_ = stream.Close()
+				c.end(sh)
+				return nil
+			}
+			pos = &types.StartingPosition{
+				Type:           types.ShardIteratorTypeAfterSequenceNumber,
+				SequenceNumber: e.Value.ContinuationSequenceNumber,
+			}
+		}
+		_ = stream.Close()
+		if err := stream.Err(); err != nil {
+			return err
+		}
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+	}
+}
+
+func (c *consumer) emit(ctx context.Context, sh *shard, r types.Record) error {
+	rec := &record{Record: r, shard: sh}
+	c.mu.Lock()
+	sh.pending = append(sh.pending, rec)
+	c.mu.Unlock()
+
+	select {
+	case c.records <- rec:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (c *consumer) ack(r *record) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	r.acked = true
+
+	sh := r.shard
+	for len(sh.pending) > 0 && sh.pending[0].acked {
+		c.checkpoints[sh.id] = aws.ToString(sh.pending[0].SequenceNumber)
+		c.dirty = true
+		sh.pending = sh.pending[1:]
+	}
+	c.finish(sh)
+}
+
+// end marks that the shard was read till its end
+func (c *consumer) end(sh *shard) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	sh.ended = true
+	c.finish(sh)
+}
+
+// finish marks the shard as consumed once all of its records were acknowledged, so its children can be read
+func (c *consumer) finish(sh *shard) {
+	if !sh.ended || len(sh.pending) > 0 {
+		return
+	}
+	if _, ended := parseEnd(c.checkpoints[sh.id]); ended {
+		return
+	}
+	c.checkpoints[sh.id] = endCheckpoint(sh.from)
+	c.dirty = true
+	select {
+	case c.rediscover <- struct{}{}:
+	default:
+	}
+}
+
+// checkpoint periodically persists the checkpoints, and once more when the context is done
+func (c *consumer) checkpoint(ctx context.Context, interval time.Duration) {
+	save := func(ctx context.Context) {
+		c.mu.Lock()
+		if !c.dirty {
+			c.mu.Unlock()
+			return
+		}
+		data, err := json.Marshal(c.checkpoints)
+		c.dirty = false
+		c.mu.Unlock()
+		if err != nil {
+			c.fail(err)
+			return
+		}
+		if err := c.store.Save(ctx, data); err != nil {
+			c.fail(err)
+		}
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			save(context.Background())
+			return
+		case <-ticker.C:
+			save(ctx)
+		}
+	}
+}
+
+func sleep(ctx context.Context, d time.Duration) error {
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-time.After(d):
+		return nil
+	}
+}
@@ -0,0 +1,93 @@
+/*
+Copyright (c) 2022 RaptorML authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package kinesis
+
+import (
+	"context"
+	"errors"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/kinesis"
+	"github.com/raptor-ml/streaming-runner/internal/brokers/receive"
+	"gocloud.dev/gcerrors"
+	"gocloud.dev/pubsub/driver"
+)
+
+// subscription implements driver.Subscription on top of the shard consumer.
+// Kinesis has no redelivery, so records can only be acked.
+type subscription struct {
+	consumer *consumer
+}
+
+func (s *subscription) ReceiveBatch(ctx context.Context, maxMessages int) ([]*driver.Message, error) {
+	return receive.Batch(ctx, s.consumer.records, s.consumer.errs, maxMessages, toDriverMessage)
+}
+
+func toDriverMessage(r *record) *driver.Message {
+	return &driver.Message{
+		LoggableID: aws.ToString(r.SequenceNumber),
+		Body:       r.Data,
+		AckID:      r,
+		AsFunc: func(i any) bool {
+			p, ok := i.(**record)
+			if !ok {
+				return false
+			}
+			*p = r
+			return true
+		},
+	}
+}
+
+func (s *subscription) SendAcks(_ context.Context, ackIDs []driver.AckID) error {
+	for _, id := range ackIDs {
+		s.consumer.ack(id.(*record))
+	}
+	return nil
+}
+
+func (s *subscription) CanNack() bool {
+	return false
+}
+
+func (s *subscription) SendNacks(context.Context, []driver.AckID) error {
+	panic("unreachable")
+}
+
+func (s *subscription) IsRetryable(error) bool {
+	return false
+}
+
+func (s *subscription) As(i any) bool {
+	p, ok := i.(**kinesis.Client)
+	if !ok {
+		return false
+	}
+	*p = s.consumer.client
+	return true
+}
+
+func (s *subscription) ErrorAs(err error, i any) bool {
+	return errors.As(err, i)
+}
+
+func (s *subscription) ErrorCode(err error) gcerrors.ErrorCode {
+	return gcerrors.Unknown
+}
+
+func (s *subscription) Close() error {
+	return nil
+}
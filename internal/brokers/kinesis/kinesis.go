@@ -0,0 +1,235 @@
+/*
+Copyright (c) 2022 RaptorML authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package kinesis implements a broker consuming all the shards of an AWS Kinesis data stream.
+// Shards are read either by polling, or with enhanced fan-out when a consumer name is configured.
+// There is no lease coordination between runners, so a stream should be consumed by a single replica.
+package kinesis
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	awsConfig "github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/credentials"
+	"github.com/aws/aws-sdk-go-v2/service/kinesis"
+	"github.com/aws/aws-sdk-go-v2/service/kinesis/types"
+	"github.com/raptor-ml/raptor/api/v1alpha1"
+	"github.com/raptor-ml/streaming-runner/internal/checkpoint"
+	"github.com/raptor-ml/streaming-runner/pkg/brokers"
+	"gocloud.dev/pubsub"
+	"gocloud.dev/pubsub/batcher"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"strings"
+	"time"
+)
+
+func init() {
+	brokers.Register("kinesis", &provider{})
+}
+
+type provider struct{}
+type ContextKey string
+
+const StreamContextKey ContextKey = "stream"
+
+func (p *provider) Metadata(ctx context.Context, msg *pubsub.Message) brokers.Metadata {
+	var md brokers.Metadata
+	var r *record
+	if ok := msg.As(&r); ok {
+		md.ID = aws.ToString(r.SequenceNumber)
+		md.Topic = ctx.Value(StreamContextKey).(string)
+		md.Timestamp = aws.ToTime(r.ApproximateArrivalTimestamp)
+		md.Key = aws.ToString(r.PartitionKey)
+		md.Attributes = map[string]string{"shard_id": r.shard.id}
+	}
+	return md
+}
+
+type config struct {
+	Stream string `mapstructure:"stream"`
+	Region string `mapstructure:"region"`
+	// Endpoint overrides the Kinesis endpoint, e.g. for a local Kinesis-compatible server.
+	Endpoint string `mapstructure:"endpoint"`
+
+	AccessKeyID     string `mapstructure:"access_key_id"`
+	SecretAccessKey string `mapstructure:"secret_access_key"`
+	SessionToken    string `mapstructure:"session_token"`
+
+	// InitialPosition is where to start reading shards without a checkpoint: `latest` (default) or `trim_horizon`
+	InitialPosition string `mapstructure:"initial_position"`
+	// ConsumerName enables enhanced fan-out, registering the consumer if it doesn't exist
+	ConsumerName      string        `mapstructure:"consumer_name"`
+	PollInterval      time.Duration `mapstructure:"poll_interval"`
+	MaxRecords        int32         `mapstructure:"max_records"`
+	DiscoveryInterval time.Duration `mapstructure:"discovery_interval"`
+
+	// CheckpointPath keeps the checkpoints in a local file; otherwise, they are kept in CheckpointConfigMap, which
+	// requires the runner's role to get, create and update configmaps in the DataSource's namespace.
+	CheckpointPath      string        `mapstructure:"checkpoint_path"`
+	CheckpointConfigMap string        `mapstructure:"checkpoint_configmap"`
+	CheckpointInterval  time.Duration `mapstructure:"checkpoint_interval"`
+
+	MaxBatchSize int `mapstructure:"max_batch_size"`
+}
+
+func (p *provider) Subscribe(ctx context.Context, c v1alpha1.ParsedConfig) (context.Context, *pubsub.Subscription, error) {
+	cfg := config{}
+	err := c.Unmarshal(&cfg)
+	if err != nil {
+		return ctx, nil, fmt.Errorf("failed to unmarshal config: %w", err)
+	}
+
+	if cfg.Stream == "" {
+		return ctx, nil, fmt.Errorf("stream required to connect to kinesis")
+	}
+	var initialPosition types.ShardIteratorType
+	switch strings.ToLower(cfg.InitialPosition) {
+	case "", "latest":
+		initialPosition = types.ShardIteratorTypeLatest
+	case "trim_horizon":
+		initialPosition = types.ShardIteratorTypeTrimHorizon
+	default:
+		return ctx, nil, fmt.Errorf("invalid initial_position: %s", cfg.InitialPosition)
+	}
+	if cfg.PollInterval == 0 {
+		cfg.PollInterval = time.Second
+	}
+	if cfg.MaxRecords == 0 {
+		cfg.MaxRecords = 1000
+	}
+	if cfg.DiscoveryInterval == 0 {
+		cfg.DiscoveryInterval = 30 * time.Second
+	}
+	if cfg.CheckpointInterval == 0 {
+		cfg.CheckpointInterval = 10 * time.Second
+	}
+	if cfg.MaxBatchSize == 0 {
+		cfg.MaxBatchSize = 100
+	}
+
+	dc := brokers.DataSourceFromContext(ctx)
+	if dc == nil {
+		panic("no DataSource in context")
+	}
+	var store checkpoint.Store
+	if cfg.CheckpointPath != "" {
+		store = checkpoint.NewFile(cfg.CheckpointPath)
+	} else {
+		if cfg.CheckpointConfigMap == "" {
+			cfg.CheckpointConfigMap = fmt.Sprintf("%s-kinesis-checkpoint", dc.Name)
+		}
+		k8s := brokers.ClientFromContext(ctx)
+		if k8s == nil {
+			return ctx, nil, fmt.Errorf("kubernetes client required to checkpoint to %s", cfg.CheckpointConfigMap)
+		}
+		store = checkpoint.NewConfigMap(k8s, client.ObjectKey{Name: cfg.CheckpointConfigMap, Namespace: dc.Namespace}, cfg.Stream)
+	}
+
+	ctx = context.WithValue(ctx, StreamContextKey, cfg.Stream)
+
+	var opts []func(*awsConfig.LoadOptions) error
+	if cfg.Region != "" {
+		opts = append(opts, awsConfig.WithRegion(cfg.Region))
+	}
+	if cfg.AccessKeyID != "" && cfg.SecretAccessKey != "" {
+		opts = append(opts, awsConfig.WithCredentialsProvider(
+			credentials.NewStaticCredentialsProvider(cfg.AccessKeyID, cfg.SecretAccessKey, cfg.SessionToken),
+		))
+	}
+	awsCfg, err := awsConfig.LoadDefaultConfig(ctx, opts...)
+	if err != nil {
+		return ctx, nil, fmt.Errorf("failed to load aws config: %w", err)
+	}
+
+	kc := kinesis.NewFromConfig(awsCfg, func(o *kinesis.Options) {
+		if cfg.Endpoint != "" {
+			o.BaseEndpoint = aws.String(cfg.Endpoint)
+		}
+	})
+
+	cs := &consumer{
+		client:            kc,
+		stream:            cfg.Stream,
+		initialPosition:   initialPosition,
+		pollInterval:      cfg.PollInterval,
+		maxRecords:        cfg.MaxRecords,
+		discoveryInterval: cfg.DiscoveryInterval,
+		store:             store,
+		records:           make(chan *record, cfg.MaxBatchSize),
+		errs:              make(chan error, 1),
+		rediscover:        make(chan struct{}, 1),
+		shards:            make(map[string]*shard),
+	}
+	if cfg.ConsumerName != "" {
+		cs.consumerARN, err = registerConsumer(ctx, kc, cfg.Stream, cfg.ConsumerName)
+		if err != nil {
+			return ctx, nil, err
+		}
+	}
+	if err := cs.load(ctx); err != nil {
+		return ctx, nil, err
+	}
+
+	go cs.run(ctx)
+	go cs.checkpoint(ctx, cfg.CheckpointInterval)
+
+	sub := pubsub.NewSubscription(&subscription{consumer: cs}, &batcher.Options{
+		MaxBatchSize: cfg.MaxBatchSize,
+		MaxHandlers:  1,
+	}, nil)
+	return ctx, sub, nil
+}
+
+// registerConsumer returns the ARN of the enhanced fan-out consumer, registering it if needed,
+// once it's active.
+func registerConsumer(ctx context.Context, kc *kinesis.Client, stream, name string) (string, error) {
+	summary, err := kc.DescribeStreamSummary(ctx, &kinesis.DescribeStreamSummaryInput{StreamName: aws.String(stream)})
+	if err != nil {
+		return "", fmt.Errorf("failed to describe stream %s: %w", stream, err)
+	}
+	streamARN := summary.StreamDescriptionSummary.StreamARN
+
+	var notFound *types.ResourceNotFoundException
+	for {
+		out, err := kc.DescribeStreamConsumer(ctx, &kinesis.DescribeStreamConsumerInput{
+			StreamARN:    streamARN,
+			ConsumerName: aws.String(name),
+		})
+		switch {
+		case errors.As(err, &notFound):
+			_, err = kc.RegisterStreamConsumer(ctx, &kinesis.RegisterStreamConsumerInput{
+				StreamARN:    streamARN,
+				ConsumerName: aws.String(name),
+			})
+			var inUse *types.ResourceInUseException
+			if err != nil && !errors.As(err, &inUse) {
+				return "", fmt.Errorf("failed to register consumer %s: %w", name, err)
+			}
+		case err != nil:
+			return "", fmt.Errorf("failed to describe consumer %s: %w", name, err)
+		case out.ConsumerDescription.ConsumerStatus == types.ConsumerStatusActive:
+			return aws.ToString(out.ConsumerDescription.ConsumerARN), nil
+		}
+
+		select {
+		case <-ctx.Done():
+			return "", ctx.Err()
+		case <-time.After(time.Second):
+		}
+	}
+}
@@ -0,0 +1,311 @@
+/*
+Copyright (c) 2022 RaptorML authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package kinesis
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/raptor-ml/raptor/api/v1alpha1"
+	"github.com/raptor-ml/streaming-runner/pkg/brokers"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+type fakeRecord struct {
+	body    string
+	seq     string
+	arrival time.Time
+}
+
+type fakeShard struct {
+	id      string
+	parents []string
+	// closed shards were split or merged, so reading them ends after their last record
+	closed  bool
+	records []fakeRecord
+}
+
+// fakeKinesis implements the subset of the Kinesis JSON protocol used for polling shards.
+// Shard iterators are `<shard>/<index of the next record>`.
+type fakeKinesis struct {
+	mu     sync.Mutex
+	shards []*fakeShard
+}
+
+func (f *fakeKinesis) shard(id string) *fakeShard {
+	for _, s := range f.shards {
+		if s.id == id {
+			return s
+		}
+	}
+	return nil
+}
+
+func (f *fakeKinesis) iterator(in map[string]any) (string, error) {
+	s := f.shard(in["ShardId"].(string))
+	if s == nil {
+		return "", fmt.Errorf("unknown shard %s", in["ShardId"])
+	}
+
+	idx := 0
+	switch in["ShardIteratorType"] {
+	case "TRIM_HORIZON":
+	case "LATEST":
+		idx = len(s.records)
+	case "AT_TIMESTAMP":
+		sec, frac := splitEpoch(in["Timestamp"].(float64))
+		ts := time.Unix(sec, frac)
+		for idx < len(s.records) && s.records[idx].arrival.Before(ts) {
+			idx++
+		}
+	case "AFTER_SEQUENCE_NUMBER":
+		idx = -1
+		for i, r := range s.records {
+			if r.seq == in["StartingSequenceNumber"] {
+				idx = i + 1
+			}
+		}
+		if idx < 0 {
+			return "", fmt.Errorf("unknown sequence number %s", in["StartingSequenceNumber"])
+		}
+	default:
+		return "", fmt.Errorf("unsupported iterator type %s", in["ShardIteratorType"])
+	}
+	return fmt.Sprintf("%s/%d", s.id, idx), nil
+}
+
+func splitEpoch(v float64) (int64, int64) {
+	sec := int64(v)
+	return sec, int64((v - float64(sec)) * 1e9)
+}
+
+func (f *fakeKinesis) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	var in map[string]any
+	if err := json.NewDecoder(r.Body).Decode(&in); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	var out any
+	switch op := strings.TrimPrefix(r.Header.Get("X-Amz-Target"), "Kinesis_20131202."); op {
+	case "ListShards":
+		var shards []map[string]any
+		for _, s := range f.shards {
+			sh := map[string]any{"ShardId": s.id}
+			if len(s.parents) > 0 {
+				sh["ParentShardId"] = s.parents[0]
+			}
+			if len(s.parents) > 1 {
+				sh["AdjacentParentShardId"] = s.parents[1]
+			}
+			shards = append(shards, sh)
+		}
+		out = map[string]any{"Shards": shards}
+	case "GetShardIterator":
+		it, err := f.iterator(in)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		out = map[string]any{"ShardIterator": it}
+	case "GetRecords":
+		id, pos, _ := strings.Cut(in["ShardIterator"].(string), "/")
+		s := f.shard(id)
+		idx, _ := strconv.Atoi(pos)
+		end := idx + int(in["Limit"].(float64))
+		if end > len(s.records) {
+			end = len(s.records)
+		}
+
+		records := []map[string]any{}
+		for _, rec := range s.records[idx:end] {
+			records = append(records, map[string]any{
+				"Data":                        []byte(rec.body),
+				"PartitionKey":                "key",
+				"SequenceNumber":              rec.seq,
+				"ApproximateArrivalTimestamp": float64(rec.arrival.UnixMilli()) / 1000,
+			})
+		}
+		res := map[string]any{"Records": records, "MillisBehindLatest": 0}
+		if !s.closed || end < len(s.records) {
+			res["NextShardIterator"] = fmt.Sprintf("%s/%d", s.id, end)
+		}
+		out = res
+	default:
+		http.Error(w, "unsupported operation: "+op, http.StatusBadRequest)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/x-amz-json-1.1")
+	_ = json.NewEncoder(w).Encode(out)
+}
+
+func TestResharding(t *testing.T) {
+	start := time.Now()
+	old, future := start.Add(-time.Hour), start.Add(time.Hour)
+	rec := func(body string, arrival time.Time) fakeRecord {
+		return fakeRecord{body: body, seq: body, arrival: arrival}
+	}
+
+	// p0 was split into c1 and c2 before the consumer started, and new records were written to both since
+	split := func() []*fakeShard {
+		return []*fakeShard{
+			{id: "p0", closed: true, records: []fakeRecord{rec("p0-1", old), rec("p0-2", old)}},
+			{id: "c1", parents: []string{"p0"}, records: []fakeRecord{rec("c1-old", old), rec("c1-new", future)}},
+			{id: "c2", parents: []string{"p0"}, records: []fakeRecord{rec("c2-new", future)}},
+		}
+	}
+	// p0 and p1 were merged into c2 before the consumer started
+	merge := func() []*fakeShard {
+		return []*fakeShard{
+			{id: "p0", closed: true, records: []fakeRecord{rec("p0-1", old), rec("p0-2", old)}},
+			{id: "p1", closed: true, records: []fakeRecord{rec("p1-1", old)}},
+			{id: "c2", parents: []string{"p0", "p1"}, records: []fakeRecord{rec("c2-old", old), rec("c2-new", future)}},
+		}
+	}
+	endedAt := func(d time.Duration) string { return endCheckpoint(start.Add(d)) }
+
+	tests := []struct {
+		name            string
+		shards          []*fakeShard
+		initialPosition string
+		checkpoints     map[string]string
+		want            []string
+	}{
+		{
+			name:   "split before starting from latest",
+			shards: split(),
+			want:   []string{"c1-new", "c2-new"},
+		},
+		{
+			name:            "split before starting from trim horizon",
+			shards:          split(),
+			initialPosition: "trim_horizon",
+			want:            []string{"c1-new", "c1-old", "c2-new", "p0-1", "p0-2"},
+		},
+		{
+			name:        "split after a checkpoint",
+			shards:      split(),
+			checkpoints: map[string]string{"p0": "p0-1"},
+			want:        []string{"c1-new", "c1-old", "c2-new", "p0-2"},
+		},
+		{
+			name:        "split of a parent that was read continuously",
+			shards:      split(),
+			checkpoints: map[string]string{"p0": shardEnd},
+			want:        []string{"c1-new", "c1-old", "c2-new"},
+		},
+		{
+			name:        "split of a parent that was read from a point in time",
+			shards:      split(),
+			checkpoints: map[string]string{"p0": endedAt(-30 * time.Minute)},
+			want:        []string{"c1-new", "c2-new"},
+		},
+		{
+			name:   "merge before starting from latest",
+			shards: merge(),
+			want:   []string{"c2-new"},
+		},
+		{
+			name:        "merge of a parent with a checkpoint",
+			shards:      merge(),
+			checkpoints: map[string]string{"p0": "p0-1"},
+			want:        []string{"c2-new", "c2-old", "p0-2"},
+		},
+		{
+			name:        "merge of parents that were read from different points in time",
+			shards:      merge(),
+			checkpoints: map[string]string{"p0": endedAt(-30 * time.Minute), "p1": endedAt(-2 * time.Hour)},
+			want:        []string{"c2-new", "c2-old"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			srv := httptest.NewServer(&fakeKinesis{shards: tt.shards})
+			t.Cleanup(srv.Close)
+
+			path := filepath.Join(t.TempDir(), "checkpoint.json")
+			if tt.checkpoints != nil {
+				data, _ := json.Marshal(tt.checkpoints)
+				if err := os.WriteFile(path, data, 0o600); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+			defer cancel()
+			ctx = brokers.ContextWithDataSource(ctx, &v1alpha1.DataSource{ObjectMeta: metav1.ObjectMeta{Name: "test", Namespace: "default"}})
+			ctx, sub, err := (&provider{}).Subscribe(ctx, v1alpha1.ParsedConfig{
+				"stream":            "test",
+				"region":            "us-east-1",
+				"endpoint":          srv.URL,
+				"access_key_id":     "test",
+				"secret_access_key": "test",
+				"initial_position":  tt.initialPosition,
+				"poll_interval":     "10ms",
+				"checkpoint_path":   path,
+			})
+			if err != nil {
+				t.Fatalf("Subscribe() error = %v", err)
+			}
+			defer func() { _ = sub.Shutdown(context.Background()) }()
+
+			var got []string
+			for len(got) < len(tt.want) {
+				msg, err := sub.Receive(ctx)
+				if err != nil {
+					t.Fatalf("Receive() error = %v after receiving %v", err, got)
+				}
+				got = append(got, string(msg.Body))
+				msg.Ack()
+			}
+
+			// nothing else should be delivered
+			rctx, rcancel := context.WithTimeout(ctx, 500*time.Millisecond)
+			defer rcancel()
+			if msg, err := sub.Receive(rctx); err == nil {
+				got = append(got, string(msg.Body))
+			}
+
+			sort.Strings(got)
+			if strings.Join(got, ",") != strings.Join(tt.want, ",") {
+				t.Errorf("received %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestConfigMapCheckpointRequiresClient(t *testing.T) {
+	ctx := brokers.ContextWithDataSource(context.Background(), &v1alpha1.DataSource{ObjectMeta: metav1.ObjectMeta{Name: "test", Namespace: "default"}})
+	_, _, err := (&provider{}).Subscribe(ctx, v1alpha1.ParsedConfig{"stream": "test", "region": "us-east-1"})
+	if err == nil || !strings.Contains(err.Error(), "test-kinesis-checkpoint") {
+		t.Errorf("Subscribe() without a kubernetes client error = %v", err)
+	}
+}
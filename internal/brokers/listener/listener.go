@@ -0,0 +1,161 @@
+/*
+Copyright (c) 2022 RaptorML authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package listener shares TCP listeners between the subscriptions of brokers that serve clients.
+// A DataSource update cancels the previous subscription and subscribes again right away, while the previous
+// subscription is shut down in the background. Sharing the listener lets the new subscription take over the address
+// instead of racing the release of the port.
+package listener
+
+import (
+	"net"
+	"sync"
+	"time"
+)
+
+var (
+	mu        sync.Mutex
+	listeners = make(map[string]*shared)
+)
+
+// shared is a bound address, along with the listeners handed out for it
+type shared struct {
+	addr string
+	ln   net.Listener
+	done chan struct{}
+	// open holds the listeners that weren't closed yet, from the oldest to the newest
+	open []*listener
+}
+
+// Listen returns a listener on the TCP address. Listeners of the same address share the bound port, and accepted
+// connections are handed to the newest of them, which replaces the others. The port is released once all of them
+// are closed.
+func Listen(addr string) (net.Listener, error) {
+	mu.Lock()
+	defer mu.Unlock()
+
+	s, ok := listeners[addr]
+	if !ok {
+		ln, err := net.Listen("tcp", addr)
+		if err != nil {
+			return nil, err
+		}
+		s = &shared{addr: addr, ln: ln, done: make(chan struct{})}
+		listeners[addr] = s
+		go s.accept()
+	}
+	l := &listener{shared: s, conns: make(chan net.Conn), closed: make(chan struct{})}
+	s.open = append(s.open, l)
+	return l, nil
+}
+
+// accept hands the accepted connections over to the listeners, until the port is released
+func (s *shared) accept() {
+	delay := 5 * time.Millisecond
+	for {
+		c, err := s.ln.Accept()
+		if err != nil {
+			select {
+			case <-s.done:
+				return
+			default:
+			}
+			// temporary failures, such as running out of file descriptors, are retried like http.Server does
+			time.Sleep(delay)
+			if delay *= 2; delay > time.Second {
+				delay = time.Second
+			}
+			continue
+		}
+		delay = 5 * time.Millisecond
+
+		if !s.handOver(c) {
+			_ = c.Close()
+			return
+		}
+	}
+}
+
+// handOver hands the connection to the newest listener, or returns false once all of them are closed
+func (s *shared) handOver(c net.Conn) bool {
+	for {
+		mu.Lock()
+		if len(s.open) == 0 {
+			mu.Unlock()
+			return false
+		}
+		l := s.open[len(s.open)-1]
+		mu.Unlock()
+
+		select {
+		case l.conns <- c:
+			return true
+		case <-l.closed:
+		}
+	}
+}
+
+func (s *shared) release(l *listener) error {
+	mu.Lock()
+	defer mu.Unlock()
+	for i, o := range s.open {
+		if o == l {
+			s.open = append(s.open[:i], s.open[i+1:]...)
+			break
+		}
+	}
+	if len(s.open) > 0 {
+		return nil
+	}
+	delete(listeners, s.addr)
+	close(s.done)
+	return s.ln.Close()
+}
+
+type listener struct {
+	*shared
+	conns  chan net.Conn
+	once   sync.Once
+	closed chan struct{}
+}
+
+func (l *listener) Accept() (net.Conn, error) {
+	select {
+	case <-l.closed:
+		return nil, net.ErrClosed
+	default:
+	}
+	select {
+	case c := <-l.conns:
+		return c, nil
+	case <-l.closed:
+		return nil, net.ErrClosed
+	}
+}
+
+// Close stops handing connections to the listener, and releases the port if no other listener uses it
+func (l *listener) Close() error {
+	var err error
+	l.once.Do(func() {
+		close(l.closed)
+		err = l.release(l)
+	})
+	return err
+}
+
+func (l *listener) Addr() net.Addr {
+	return l.ln.Addr()
+}
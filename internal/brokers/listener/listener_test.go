@@ -0,0 +1,104 @@
+/*
+Copyright (c) 2022 RaptorML authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package listener
+
+import (
+	"errors"
+	"net"
+	"testing"
+	"time"
+)
+
+// freeAddr returns an address that's free to listen on
+func freeAddr(t *testing.T) string {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	return ln.Addr().String()
+}
+
+func accept(t *testing.T, ln net.Listener) {
+	t.Helper()
+	accepted := make(chan error, 1)
+	go func() {
+		c, err := ln.Accept()
+		if err == nil {
+			_ = c.Close()
+		}
+		accepted <- err
+	}()
+	c, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatalf("Dial() error = %v", err)
+	}
+	defer c.Close()
+	select {
+	case err := <-accepted:
+		if err != nil {
+			t.Fatalf("Accept() error = %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("connection wasn't accepted")
+	}
+}
+
+func TestTakeOver(t *testing.T) {
+	addr := freeAddr(t)
+	old, err := Listen(addr)
+	if err != nil {
+		t.Fatalf("Listen() error = %v", err)
+	}
+	// the address is taken over while the previous listener is still open
+	next, err := Listen(addr)
+	if err != nil {
+		t.Fatalf("Listen() of a listened address error = %v", err)
+	}
+	defer next.Close()
+	// connections go to the newest listener, which replaces the previous one
+	accept(t, next)
+
+	if err := old.Close(); err != nil {
+		t.Fatalf("Close() error = %v", err)
+	}
+	if _, err := old.Accept(); !errors.Is(err, net.ErrClosed) {
+		t.Errorf("Accept() of a closed listener error = %v, want net.ErrClosed", err)
+	}
+	// closing twice doesn't release the address of the other listener
+	_ = old.Close()
+	accept(t, next)
+}
+
+func TestRelease(t *testing.T) {
+	addr := freeAddr(t)
+	ln, err := Listen(addr)
+	if err != nil {
+		t.Fatalf("Listen() error = %v", err)
+	}
+	accept(t, ln)
+	if err := ln.Close(); err != nil {
+		t.Fatalf("Close() error = %v", err)
+	}
+
+	// the port is released once the last listener is closed
+	raw, err := net.Listen("tcp", addr)
+	if err != nil {
+		t.Fatalf("address wasn't released: %v", err)
+	}
+	_ = raw.Close()
+}
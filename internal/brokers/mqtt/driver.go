@@ -0,0 +1,323 @@
+/*
+Copyright (c) 2022 RaptorML authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package mqtt
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/eclipse/paho.golang/paho"
+	"github.com/go-logr/logr"
+	"github.com/google/uuid"
+	"github.com/raptor-ml/streaming-runner/internal/brokers/receive"
+	"gocloud.dev/gcerrors"
+	"gocloud.dev/pubsub/driver"
+	"sync"
+	"time"
+)
+
+const (
+	minReconnectDelay = time.Second
+	maxReconnectDelay = 30 * time.Second
+)
+
+var errNacked = errors.New("messages were nacked")
+
+// message is a publish received on a specific connection, since acks must be sent on the connection that received it
+type message struct {
+	publish  *paho.Publish
+	client   *paho.Client
+	id       string
+	received time.Time
+}
+
+// connection is a single session with the broker. lost receives the first error that drops it.
+type connection struct {
+	client *paho.Client
+	lost   chan error
+}
+
+func (c *connection) drop(err error) {
+	select {
+	case c.lost <- err:
+	default:
+	}
+}
+
+// subscription implements driver.Subscription on top of an MQTT v5 client with manual acknowledgements.
+// The connection is re-established, and the topics resubscribed, whenever it's lost.
+//
+// MQTT has no negative acknowledgement: the broker only redelivers a message that wasn't acknowledged when the session
+// is resumed. A nack therefore skips the PUBACK and reconnects, so nacked messages are redelivered when session_expiry
+// is set, and dropped otherwise. Messages that were nacked more than max_retries times are acked and dropped instead,
+// so a message that always fails doesn't keep the subscription reconnecting.
+type subscription struct {
+	ctx      context.Context
+	cfg      config
+	logger   logr.Logger
+	messages chan *message
+
+	mu   sync.Mutex
+	conn *connection
+	// nacks counts the nacks of the messages in flight by packet id, which the broker keeps when redelivering them.
+	// A packet id is only reused once its message was acked, or when the session wasn't resumed.
+	nacks map[uint16]int
+}
+
+// route is called by the paho router for every incoming message. Blocking here applies backpressure on the broker.
+func (s *subscription) route(client *paho.Client, p *paho.Publish) {
+	select {
+	case <-s.ctx.Done():
+	case s.messages <- &message{publish: p, client: client, id: uuid.New().String(), received: time.Now()}:
+	}
+}
+
+// connect dials the broker, and subscribes to the configured topics
+func (s *subscription) connect(ctx context.Context) (*connection, error) {
+	conn, err := dial(ctx, s.cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	c := &connection{lost: make(chan error, 1)}
+	c.client = paho.NewClient(paho.ClientConfig{
+		ClientID: s.cfg.ClientID,
+		Conn:     conn,
+		Router: paho.NewSingleHandlerRouter(func(p *paho.Publish) {
+			s.route(c.client, p)
+		}),
+		EnableManualAcknowledgment: true,
+		OnClientError:              c.drop,
+		OnServerDisconnect: func(d *paho.Disconnect) {
+			c.drop(fmt.Errorf("mqtt server disconnected (reason %d)", d.ReasonCode))
+		},
+	})
+
+	cp := &paho.Connect{
+		ClientID:   s.cfg.ClientID,
+		KeepAlive:  30,
+		CleanStart: s.cfg.SessionExpiry == 0,
+		Properties: &paho.ConnectProperties{},
+	}
+	if s.cfg.SessionExpiry > 0 {
+		se := uint32(s.cfg.SessionExpiry.Seconds())
+		cp.Properties.SessionExpiryInterval = &se
+	}
+	if s.cfg.Username != "" {
+		cp.Username = s.cfg.Username
+		cp.UsernameFlag = true
+	}
+	if s.cfg.Password != "" {
+		cp.Password = []byte(s.cfg.Password)
+		cp.PasswordFlag = true
+	}
+	// the connection is current before connecting, since a resumed session redelivers its messages right away
+	s.mu.Lock()
+	s.conn = c
+	s.mu.Unlock()
+	ca, err := c.client.Connect(ctx, cp)
+	if err != nil {
+		_ = conn.Close()
+		return nil, err
+	}
+	if !ca.SessionPresent {
+		// the messages in flight were dropped along with the session
+		s.mu.Lock()
+		s.nacks = make(map[uint16]int)
+		s.mu.Unlock()
+	}
+
+	sp := &paho.Subscribe{}
+	for _, t := range s.cfg.Topics {
+		if s.cfg.SharedGroup != "" {
+			t = fmt.Sprintf("$share/%s/%s", s.cfg.SharedGroup, t)
+		}
+		sp.Subscriptions = append(sp.Subscriptions, paho.SubscribeOptions{Topic: t, QoS: byte(s.cfg.QoS)})
+	}
+	sa, err := c.client.Subscribe(ctx, sp)
+	if err == nil {
+		for i, r := range sa.Reasons {
+			if r >= 0x80 {
+				err = fmt.Errorf("failed to subscribe to %s (reason %d)", sp.Subscriptions[i].Topic, r)
+				break
+			}
+		}
+	}
+	if err != nil {
+		_ = c.client.Disconnect(&paho.Disconnect{ReasonCode: 0})
+		return nil, err
+	}
+
+	return c, nil
+}
+
+// run keeps the subscription connected until the context is done, reconnecting with an exponential backoff
+func (s *subscription) run(c *connection) {
+	delay := minReconnectDelay
+	for {
+		select {
+		case <-s.ctx.Done():
+			_ = c.client.Disconnect(&paho.Disconnect{ReasonCode: 0})
+			return
+		case err := <-c.lost:
+			s.logger.Info("mqtt connection lost, reconnecting", "reason", err.Error())
+			_ = c.client.Disconnect(&paho.Disconnect{ReasonCode: 0})
+		}
+
+		for {
+			var err error
+			c, err = s.connect(s.ctx)
+			if err == nil {
+				delay = minReconnectDelay
+				break
+			}
+			if s.ctx.Err() != nil {
+				return
+			}
+			s.logger.Error(err, "failed to reconnect to mqtt", "retryIn", delay)
+
+			t := time.NewTimer(delay)
+			select {
+			case <-s.ctx.Done():
+				t.Stop()
+				return
+			case <-t.C:
+			}
+			if delay *= 2; delay > maxReconnectDelay {
+				delay = maxReconnectDelay
+			}
+		}
+	}
+}
+
+func (s *subscription) ReceiveBatch(ctx context.Context, maxMessages int) ([]*driver.Message, error) {
+	return receive.Batch(ctx, s.messages, nil, maxMessages, toDriverMessage)
+}
+
+func toDriverMessage(m *message) *driver.Message {
+	md := map[string]string{}
+	if m.publish.Properties != nil {
+		for _, up := range m.publish.Properties.User {
+			md[up.Key] = up.Value
+		}
+	}
+	return &driver.Message{
+		LoggableID: m.id,
+		Body:       m.publish.Payload,
+		Metadata:   md,
+		AckID:      m,
+		AsFunc: func(i any) bool {
+			switch ptr := i.(type) {
+			case **paho.Publish:
+				*ptr = m.publish
+			case **message:
+				*ptr = m
+			default:
+				return false
+			}
+			return true
+		},
+	}
+}
+
+func (s *subscription) SendAcks(_ context.Context, ackIDs []driver.AckID) error {
+	for _, id := range ackIDs {
+		if err := s.ack(id.(*message)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *subscription) ack(m *message) error {
+	if m.publish.QoS > 0 {
+		s.mu.Lock()
+		delete(s.nacks, m.publish.PacketID)
+		s.mu.Unlock()
+	}
+	// acks of messages from a connection that was already lost are dropped by paho, and redelivered by the broker
+	if err := m.client.Ack(m.publish); err != nil && !errors.Is(err, paho.ErrPacketNotFound) {
+		return err
+	}
+	return nil
+}
+
+func (s *subscription) CanNack() bool {
+	return true
+}
+
+// SendNacks skips the PUBACK of the messages and drops the connection that received them, so the broker redelivers
+// them when the session is resumed. Since paho sends the PUBACKs in order, keeping the connection would also hold back
+// the acks of every following message. Messages that were already nacked max_retries times are acked and dropped.
+func (s *subscription) SendNacks(_ context.Context, ackIDs []driver.AckID) error {
+	var exhausted []*message
+	s.mu.Lock()
+	drop := false
+	for _, id := range ackIDs {
+		m := id.(*message)
+		if m.publish.QoS == 0 || m.client != s.conn.client {
+			continue
+		}
+		if s.nacks[m.publish.PacketID] >= s.cfg.MaxRetries {
+			exhausted = append(exhausted, m)
+			continue
+		}
+		s.nacks[m.publish.PacketID]++
+		drop = true
+	}
+	s.mu.Unlock()
+
+	for _, m := range exhausted {
+		s.logger.Error(errNacked, "dropping mqtt message that failed too many times", "topic", m.publish.Topic, "id", m.id)
+		if err := s.ack(m); err != nil {
+			return err
+		}
+	}
+	if drop {
+		s.mu.Lock()
+		s.conn.drop(errNacked)
+		s.mu.Unlock()
+	}
+	return nil
+}
+
+func (s *subscription) IsRetryable(error) bool {
+	return false
+}
+
+func (s *subscription) As(i any) bool {
+	p, ok := i.(**paho.Client)
+	if !ok {
+		return false
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	*p = s.conn.client
+	return true
+}
+
+func (s *subscription) ErrorAs(error, any) bool {
+	return false
+}
+
+func (s *subscription) ErrorCode(error) gcerrors.ErrorCode {
+	return gcerrors.Unknown
+}
+
+func (s *subscription) Close() error {
+	return nil
+}
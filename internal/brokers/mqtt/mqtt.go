@@ -0,0 +1,173 @@
+/*
+Copyright (c) 2022 RaptorML authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package mqtt
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"github.com/eclipse/paho.golang/packets"
+	"github.com/go-logr/logr"
+	"github.com/raptor-ml/raptor/api/v1alpha1"
+	"github.com/raptor-ml/streaming-runner/pkg/brokers"
+	"gocloud.dev/pubsub"
+	"gocloud.dev/pubsub/batcher"
+	"net"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+)
+
+func init() {
+	brokers.Register("mqtt", &provider{})
+}
+
+type provider struct{}
+
+// Metadata uses the receive time as the message timestamp, since MQTT doesn't carry a publish time.
+// The packet id is reused by the broker, so messages are identified by an id generated on receive.
+func (p *provider) Metadata(_ context.Context, msg *pubsub.Message) brokers.Metadata {
+	var md brokers.Metadata
+	var m *message
+	if ok := msg.As(&m); ok {
+		md.Topic = m.publish.Topic
+		md.ID = m.id
+		md.Timestamp = m.received
+	}
+	return md
+}
+
+type config struct {
+	BrokerURL string   `mapstructure:"broker_url"`
+	Topics    []string `mapstructure:"topics"`
+	// SharedGroup subscribes to the topics as a shared subscription (`$share/<group>/<topic>`).
+	SharedGroup string `mapstructure:"shared_group"`
+	QoS         int    `mapstructure:"qos"`
+	ClientID    string `mapstructure:"client_id"`
+	// SessionExpiry keeps the session, and the messages that weren't acknowledged, across reconnects.
+	SessionExpiry time.Duration `mapstructure:"session_expiry"`
+
+	Username string `mapstructure:"username"`
+	Password string `mapstructure:"password"`
+
+	TLSSkipVerify bool   `mapstructure:"tls_skip_verify"`
+	TLSCaCert     string `mapstructure:"tls_ca_cert"`
+	TLSClientCert string `mapstructure:"tls_client_cert"`
+	TLSClientKey  string `mapstructure:"tls_client_key"`
+
+	// MaxRetries is the number of times a message is redelivered after failing, before it's acked and dropped.
+	MaxRetries int `mapstructure:"max_retries"`
+
+	MaxBatchSize int `mapstructure:"max_batch_size"`
+}
+
+func (p *provider) Subscribe(ctx context.Context, c v1alpha1.ParsedConfig) (context.Context, *pubsub.Subscription, error) {
+	cfg := config{QoS: 1, MaxRetries: 3}
+	err := c.Unmarshal(&cfg)
+	if err != nil {
+		return ctx, nil, fmt.Errorf("failed to unmarshal config: %w", err)
+	}
+
+	if cfg.BrokerURL == "" {
+		return ctx, nil, fmt.Errorf("broker_url required to connect to mqtt")
+	}
+	if len(cfg.Topics) == 0 {
+		return ctx, nil, fmt.Errorf("topics required to connect to mqtt")
+	}
+	if cfg.QoS < 0 || cfg.QoS > 1 {
+		return ctx, nil, fmt.Errorf("mqtt error: unsupported qos: %d", cfg.QoS)
+	}
+	if cfg.MaxRetries < 0 {
+		return ctx, nil, fmt.Errorf("mqtt error: invalid max_retries: %d", cfg.MaxRetries)
+	}
+	if cfg.MaxBatchSize == 0 {
+		cfg.MaxBatchSize = 100
+	}
+	if cfg.ClientID == "" {
+		cfg.ClientID, err = os.Hostname()
+		if err != nil {
+			return ctx, nil, fmt.Errorf("failed to resolve client id: %w", err)
+		}
+	}
+
+	sub := &subscription{
+		ctx:      ctx,
+		cfg:      cfg,
+		logger:   logr.FromContextOrDiscard(ctx),
+		messages: make(chan *message, cfg.MaxBatchSize),
+		nacks:    make(map[uint16]int),
+	}
+	conn, err := sub.connect(ctx)
+	if err != nil {
+		return ctx, nil, fmt.Errorf("failed to connect to mqtt: %w", err)
+	}
+	go sub.run(conn)
+
+	return ctx, pubsub.NewSubscription(sub, &batcher.Options{
+		MaxBatchSize: cfg.MaxBatchSize,
+		MaxHandlers:  1,
+	}, nil), nil
+}
+
+func dial(ctx context.Context, cfg config) (net.Conn, error) {
+	u, err := url.Parse(cfg.BrokerURL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid broker_url: %w", err)
+	}
+
+	d := &net.Dialer{Timeout: 10 * time.Second}
+	switch strings.ToLower(u.Scheme) {
+	case "mqtt", "tcp":
+		conn, err := d.DialContext(ctx, "tcp", u.Host)
+		if err != nil {
+			return nil, err
+		}
+		return packets.NewThreadSafeConn(conn), nil
+	case "mqtts", "ssl", "tls":
+		tc, err := tlsConfig(cfg)
+		if err != nil {
+			return nil, err
+		}
+		conn, err := (&tls.Dialer{NetDialer: d, Config: tc}).DialContext(ctx, "tcp", u.Host)
+		if err != nil {
+			return nil, err
+		}
+		return packets.NewThreadSafeConn(conn), nil
+	}
+	return nil, fmt.Errorf("unsupported broker_url scheme: %s", u.Scheme)
+}
+
+func tlsConfig(in config) (*tls.Config, error) {
+	tc := &tls.Config{InsecureSkipVerify: in.TLSSkipVerify, MinVersion: tls.VersionTLS12}
+	if in.TLSCaCert != "" {
+		caCertPool := x509.NewCertPool()
+		if ok := caCertPool.AppendCertsFromPEM([]byte(in.TLSCaCert)); !ok {
+			return nil, fmt.Errorf("mqtt error: unable to load ca certificate")
+		}
+		tc.RootCAs = caCertPool
+	}
+	if in.TLSClientCert != "" && in.TLSClientKey != "" {
+		cert, err := tls.X509KeyPair([]byte(in.TLSClientCert), []byte(in.TLSClientKey))
+		if err != nil {
+			return nil, fmt.Errorf("mqtt error: unable to load client certificate: %w", err)
+		}
+		tc.Certificates = []tls.Certificate{cert}
+	}
+	return tc, nil
+}
@@ -0,0 +1,284 @@
+/*
+Copyright (c) 2022 RaptorML authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package mqtt
+
+import (
+	"context"
+	"github.com/eclipse/paho.golang/packets"
+	"github.com/raptor-ml/raptor/api/v1alpha1"
+	"github.com/raptor-ml/streaming-runner/internal/brokers/brokertest"
+	"gocloud.dev/pubsub"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+const testTopic = "sensors/temperature"
+
+// fakeBroker is a single client MQTT v5 broker that keeps the session, and the messages that weren't acknowledged,
+// across reconnects
+type fakeBroker struct {
+	ln net.Listener
+
+	mu         sync.Mutex
+	conn       net.Conn
+	connects   int
+	subscribed bool
+	nextID     uint16
+	queued     []*packets.Publish
+	inflight   []*packets.Publish
+	acked      []string
+	redelivers int
+}
+
+func newFakeBroker(t *testing.T) *fakeBroker {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	f := &fakeBroker{ln: ln}
+	t.Cleanup(func() {
+		_ = ln.Close()
+		f.kick()
+	})
+
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go f.serve(conn)
+		}
+	}()
+	return f
+}
+
+func (f *fakeBroker) serve(conn net.Conn) {
+	defer func() {
+		_ = conn.Close()
+		f.mu.Lock()
+		defer f.mu.Unlock()
+		if f.conn == conn {
+			f.conn = nil
+		}
+	}()
+
+	for {
+		cp, err := packets.ReadPacket(conn)
+		if err != nil {
+			return
+		}
+
+		f.mu.Lock()
+		switch p := cp.Content.(type) {
+		case *packets.Connect:
+			f.connects++
+			f.conn = conn
+			resumed := !p.CleanStart && f.connects > 1
+			if !resumed {
+				f.inflight = nil
+				f.subscribed = false
+			}
+			_, _ = (&packets.Connack{SessionPresent: resumed, Properties: &packets.Properties{}}).WriteTo(conn)
+			for _, pb := range f.inflight {
+				pb.Duplicate = true
+				f.redelivers++
+				_, _ = pb.WriteTo(conn)
+			}
+		case *packets.Subscribe:
+			sa := &packets.Suback{PacketID: p.PacketID, Properties: &packets.Properties{}}
+			for _, s := range p.Subscriptions {
+				sa.Reasons = append(sa.Reasons, s.QoS)
+			}
+			_, _ = sa.WriteTo(conn)
+			f.subscribed = true
+			f.flush()
+		case *packets.Puback:
+			for i, pb := range f.inflight {
+				if pb.PacketID == p.PacketID {
+					f.acked = append(f.acked, string(pb.Payload))
+					f.inflight = append(f.inflight[:i], f.inflight[i+1:]...)
+					break
+				}
+			}
+		case *packets.Pingreq:
+			_, _ = (&packets.Pingresp{}).WriteTo(conn)
+		case *packets.Disconnect:
+			f.mu.Unlock()
+			return
+		}
+		f.mu.Unlock()
+	}
+}
+
+// flush delivers the queued messages to the connected client
+func (f *fakeBroker) flush() {
+	if f.conn == nil || !f.subscribed {
+		return
+	}
+	for _, pb := range f.queued {
+		f.nextID++
+		pb.PacketID = f.nextID
+		f.inflight = append(f.inflight, pb)
+		_, _ = pb.WriteTo(f.conn)
+	}
+	f.queued = nil
+}
+
+func (f *fakeBroker) publish(bodies ...string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for _, b := range bodies {
+		f.queued = append(f.queued, &packets.Publish{Topic: testTopic, QoS: 1, Payload: []byte(b), Properties: &packets.Properties{}})
+	}
+	f.flush()
+}
+
+// kick drops the connection without a DISCONNECT, like a network failure would
+func (f *fakeBroker) kick() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.conn != nil {
+		_ = f.conn.Close()
+		f.conn = nil
+	}
+}
+
+func subscribe(t *testing.T, f *fakeBroker) (context.Context, *pubsub.Subscription) {
+	t.Helper()
+	return brokertest.Subscribe(t, &provider{}, v1alpha1.ParsedConfig{
+		"broker_url":     "mqtt://" + f.ln.Addr().String(),
+		"topics":         "sensors/#",
+		"client_id":      "test",
+		"session_expiry": "1m",
+		"max_retries":    "2",
+	})
+}
+
+func receiveMessage(ctx context.Context, t *testing.T, sub *pubsub.Subscription) (*pubsub.Message, string) {
+	t.Helper()
+	msg, err := sub.Receive(ctx)
+	if err != nil {
+		t.Fatalf("Receive() error = %v", err)
+	}
+	md := (&provider{}).Metadata(ctx, msg)
+	if md.Topic != testTopic || md.ID == "" || time.Since(md.Timestamp) > brokertest.Timeout {
+		t.Errorf("Metadata() = %+v", md)
+	}
+	return msg, md.ID
+}
+
+func TestReceiveAndAck(t *testing.T) {
+	f := newFakeBroker(t)
+	ctx, sub := subscribe(t, f)
+	f.publish(`{"a":1}`, `{"a":2}`)
+
+	ids := make(map[string]bool)
+	for i := 0; i < 2; i++ {
+		msg, id := receiveMessage(ctx, t, sub)
+		if ids[id] {
+			t.Errorf("message id %s isn't unique", id)
+		}
+		ids[id] = true
+		msg.Ack()
+	}
+	brokertest.Eventually(t, &f.mu, func() bool { return len(f.acked) == 2 && len(f.inflight) == 0 })
+}
+
+func TestNackRedelivers(t *testing.T) {
+	f := newFakeBroker(t)
+	ctx, sub := subscribe(t, f)
+	f.publish(`{"a":1}`)
+
+	msg, id := receiveMessage(ctx, t, sub)
+	msg.Nack()
+
+	// the nack must not be acknowledged, and the message is redelivered by the resumed session
+	again, againID := receiveMessage(ctx, t, sub)
+	if string(again.Body) != string(msg.Body) {
+		t.Errorf("redelivered body = %s, want %s", again.Body, msg.Body)
+	}
+	if againID == id {
+		t.Errorf("redelivered message reused the id %s", id)
+	}
+	f.mu.Lock()
+	if len(f.acked) != 0 || f.redelivers != 1 {
+		t.Errorf("acked = %v, redelivers = %d after a nack", f.acked, f.redelivers)
+	}
+	f.mu.Unlock()
+
+	again.Ack()
+	brokertest.Eventually(t, &f.mu, func() bool { return len(f.acked) == 1 && len(f.inflight) == 0 })
+}
+
+func TestReconnect(t *testing.T) {
+	f := newFakeBroker(t)
+	ctx, sub := subscribe(t, f)
+
+	f.kick()
+	brokertest.Eventually(t, &f.mu, func() bool { return f.connects == 2 && f.conn != nil && f.subscribed })
+
+	f.publish(`{"a":1}`)
+	msg, _ := receiveMessage(ctx, t, sub)
+	if string(msg.Body) != `{"a":1}` {
+		t.Errorf("Body = %s", msg.Body)
+	}
+	msg.Ack()
+	brokertest.Eventually(t, &f.mu, func() bool { return len(f.acked) == 1 })
+}
+
+func TestNackRetriesExhausted(t *testing.T) {
+	f := newFakeBroker(t)
+	ctx, sub := subscribe(t, f)
+	f.publish(`{"a":1}`)
+
+	// the message is redelivered after each of the max_retries nacks, and dropped when it fails once more
+	for i := 0; i < 3; i++ {
+		msg, _ := receiveMessage(ctx, t, sub)
+		msg.Nack()
+	}
+	brokertest.Eventually(t, &f.mu, func() bool { return len(f.acked) == 1 && len(f.inflight) == 0 })
+	f.mu.Lock()
+	if f.redelivers != 2 || f.connects != 3 {
+		t.Errorf("redelivers = %d, connects = %d, want 2 and 3", f.redelivers, f.connects)
+	}
+	f.mu.Unlock()
+
+	// the subscription keeps receiving new messages
+	f.publish(`{"a":2}`)
+	msg, _ := receiveMessage(ctx, t, sub)
+	if string(msg.Body) != `{"a":2}` {
+		t.Errorf("Body = %s, want the next message", msg.Body)
+	}
+}
+
+func TestMetadataTimestamp(t *testing.T) {
+	f := newFakeBroker(t)
+	ctx, sub := subscribe(t, f)
+	f.publish(`{"a":1}`)
+
+	msg, _ := receiveMessage(ctx, t, sub)
+	first := (&provider{}).Metadata(ctx, msg).Timestamp
+	time.Sleep(10 * time.Millisecond)
+	// the timestamp is the receive time, rather than the time the metadata is read
+	if again := (&provider{}).Metadata(ctx, msg).Timestamp; !again.Equal(first) {
+		t.Errorf("Metadata() timestamp changed from %v to %v", first, again)
+	}
+	msg.Ack()
+}
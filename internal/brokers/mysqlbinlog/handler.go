@@ -0,0 +1,220 @@
+/*
+Copyright (c) 2022 RaptorML authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package mysqlbinlog
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/go-logr/logr"
+	"github.com/go-mysql-org/go-mysql/canal"
+	"github.com/go-mysql-org/go-mysql/mysql"
+	"github.com/go-mysql-org/go-mysql/replication"
+	"github.com/raptor-ml/streaming-runner/internal/brokers/txn"
+	"github.com/raptor-ml/streaming-runner/internal/checkpoint"
+	"time"
+	"unicode/utf8"
+)
+
+// change is a single row change
+type change struct {
+	id        string
+	timestamp time.Time
+	table     string
+	body      []byte
+	txn       *txn.Transaction[mysql.GTIDSet]
+}
+
+// handler receives the binlog events from canal, and turns row events into changes
+type handler struct {
+	canal.DummyEventHandler
+
+	ctx     context.Context
+	changes chan *change
+	errs    chan error
+	tracker *txn.Tracker[mysql.GTIDSet]
+	// txn is the transaction being received, gtid is its GTID if it has one, and seq numbers its changes
+	txn  *txn.Transaction[mysql.GTIDSet]
+	gtid mysql.GTIDSet
+	seq  int
+}
+
+func newHandler(ctx context.Context, gset mysql.GTIDSet, buffer int) *handler {
+	return &handler{
+		ctx:     ctx,
+		changes: make(chan *change, buffer),
+		errs:    make(chan error, 1),
+		tracker: txn.New(gset.Clone(), mergeGTID),
+	}
+}
+
+func (h *handler) String() string {
+	return "raptor"
+}
+
+func (h *handler) fail(err error) {
+	select {
+	case h.errs <- err:
+	default:
+	}
+}
+
+func (h *handler) OnGTID(_ *replication.EventHeader, gtid mysql.GTIDSet) error {
+	// transactions that don't end with an XID event (i.e. non-transactional tables) end when the next one begins
+	h.end()
+	h.begin(gtid)
+	return nil
+}
+
+func (h *handler) OnXID(*replication.EventHeader, mysql.Position) error {
+	h.end()
+	return nil
+}
+
+func (h *handler) OnDDL(*replication.EventHeader, mysql.Position, *replication.QueryEvent) error {
+	h.end()
+	return nil
+}
+
+func (h *handler) begin(gtid mysql.GTIDSet) {
+	h.txn = h.tracker.Begin()
+	h.gtid = gtid
+	h.seq = 0
+}
+
+func (h *handler) end() {
+	if h.txn != nil {
+		h.tracker.Commit(h.txn, h.gtid)
+		h.txn = nil
+	}
+}
+
+func (h *handler) OnRow(e *canal.RowsEvent) error {
+	if h.txn == nil {
+		h.begin(nil)
+	}
+
+	// updates are sent as pairs of [before, after]
+	step := 1
+	if e.Action == canal.UpdateAction {
+		step = 2
+	}
+	for i := 0; i+step <= len(e.Rows); i += step {
+		var before, after map[string]any
+		switch e.Action {
+		case canal.InsertAction:
+			after = rowMap(e, e.Rows[i])
+		case canal.DeleteAction:
+			before = rowMap(e, e.Rows[i])
+		case canal.UpdateAction:
+			before = rowMap(e, e.Rows[i])
+			after = rowMap(e, e.Rows[i+1])
+		}
+
+		body, err := json.Marshal(map[string]any{
+			"op":     e.Action,
+			"schema": e.Table.Schema,
+			"table":  e.Table.Name,
+			"before": before,
+			"after":  after,
+		})
+		if err != nil {
+			return fmt.Errorf("failed to encode row change: %w", err)
+		}
+
+		h.seq++
+		id := "-"
+		if h.gtid != nil {
+			id = h.gtid.String()
+		}
+		c := &change{
+			id:        fmt.Sprintf("%s#%d", id, h.seq),
+			timestamp: time.Unix(int64(e.Header.Timestamp), 0),
+			table:     fmt.Sprintf("%s.%s", e.Table.Schema, e.Table.Name),
+			body:      body,
+			txn:       h.txn,
+		}
+		h.tracker.Add(h.txn)
+
+		select {
+		case h.changes <- c:
+		case <-h.ctx.Done():
+			return h.ctx.Err()
+		}
+	}
+	return nil
+}
+
+func rowMap(e *canal.RowsEvent, row []any) map[string]any {
+	m := make(map[string]any, len(row))
+	for i, v := range row {
+		if i >= len(e.Table.Columns) {
+			break
+		}
+		// text columns are received as raw bytes
+		if b, ok := v.([]byte); ok && utf8.Valid(b) {
+			v = string(b)
+		}
+		m[e.Table.Columns[i].Name] = v
+	}
+	return m
+}
+
+// checkpoint periodically persists the acknowledged GTID set, and once more when the context is done.
+// A failed save is retried on the next tick, rather than failing the subscription.
+func (h *handler) checkpoint(ctx context.Context, store checkpoint.Store, interval time.Duration) {
+	logger := logr.FromContextOrDiscard(ctx)
+	var unsaved mysql.GTIDSet
+	save := func(ctx context.Context) {
+		if gset, ok := h.tracker.Flush(); ok {
+			unsaved = gset
+		}
+		if unsaved == nil {
+			return
+		}
+		if err := store.Save(ctx, []byte(unsaved.String())); err != nil {
+			logger.Error(err, "failed to save the binlog checkpoint, retrying", "gtidSet", unsaved.String())
+			return
+		}
+		unsaved = nil
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			save(context.Background())
+			return
+		case <-ticker.C:
+			save(ctx)
+		}
+	}
+}
+
+// mergeGTID adds the GTID of an acknowledged transaction to the set. Transactions without a GTID, and malformed GTIDs
+// that can't be added to the set, are skipped rather than blocking the checkpoint.
+func mergeGTID(gset, gtid mysql.GTIDSet) mysql.GTIDSet {
+	if gtid == nil {
+		return gset
+	}
+	next := gset.Clone()
+	if err := next.Update(gtid.String()); err != nil {
+		return gset
+	}
+	return next
+}
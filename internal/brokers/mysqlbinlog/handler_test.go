@@ -0,0 +1,183 @@
+/*
+Copyright (c) 2022 RaptorML authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package mysqlbinlog
+
+import (
+	"context"
+	"errors"
+	"github.com/go-mysql-org/go-mysql/canal"
+	"github.com/go-mysql-org/go-mysql/mysql"
+	"github.com/go-mysql-org/go-mysql/replication"
+	"github.com/go-mysql-org/go-mysql/schema"
+	"github.com/raptor-ml/streaming-runner/internal/brokers/brokertest"
+	"gocloud.dev/pubsub/driver"
+	"sync"
+	"testing"
+	"time"
+)
+
+const testUUID = "3e11fa47-71ca-11e1-9e33-c80aa9429562"
+
+func parseGTID(t *testing.T, s string) mysql.GTIDSet {
+	t.Helper()
+	gset, err := mysql.ParseGTIDSet(mysql.MySQLFlavor, s)
+	if err != nil {
+		t.Fatalf("ParseGTIDSet(%q) error = %v", s, err)
+	}
+	return gset
+}
+
+func TestMergeGTID(t *testing.T) {
+	gset := parseGTID(t, testUUID+":1-5")
+
+	tests := []struct {
+		name string
+		gtid mysql.GTIDSet
+		want string
+	}{
+		{name: "next", gtid: parseGTID(t, testUUID+":6"), want: testUUID + ":1-6"},
+		{name: "gap", gtid: parseGTID(t, testUUID+":8"), want: testUUID + ":1-5:8"},
+		{name: "without gtid", want: testUUID + ":1-5"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := mergeGTID(gset, tt.gtid).String(); got != tt.want {
+				t.Errorf("mergeGTID() = %s, want %s", got, tt.want)
+			}
+			if got := gset.String(); got != testUUID+":1-5" {
+				t.Errorf("mergeGTID() modified the set to %s", got)
+			}
+		})
+	}
+}
+
+func insert(h *handler, ids ...int) error {
+	e := &canal.RowsEvent{
+		Table:  &schema.Table{Schema: "shop", Name: "orders", Columns: []schema.TableColumn{{Name: "id"}}},
+		Action: canal.InsertAction,
+		Header: &replication.EventHeader{Timestamp: uint32(time.Now().Unix())},
+	}
+	for _, id := range ids {
+		e.Rows = append(e.Rows, []any{id})
+	}
+	return h.OnRow(e)
+}
+
+func TestTransactions(t *testing.T) {
+	h := newHandler(context.Background(), parseGTID(t, testUUID+":1-5"), 10)
+	if err := h.OnGTID(nil, parseGTID(t, testUUID+":6")); err != nil {
+		t.Fatal(err)
+	}
+	if err := insert(h, 1, 2); err != nil {
+		t.Fatalf("OnRow() error = %v", err)
+	}
+	if err := h.OnXID(nil, mysql.Position{}); err != nil {
+		t.Fatal(err)
+	}
+	if err := h.OnGTID(nil, parseGTID(t, testUUID+":7")); err != nil {
+		t.Fatal(err)
+	}
+	if err := insert(h, 3); err != nil {
+		t.Fatalf("OnRow() error = %v", err)
+	}
+	if err := h.OnXID(nil, mysql.Position{}); err != nil {
+		t.Fatal(err)
+	}
+
+	s := &subscription{handler: h}
+	dms, err := s.ReceiveBatch(context.Background(), 10)
+	if err != nil {
+		t.Fatalf("ReceiveBatch() error = %v", err)
+	}
+	var ids []string
+	for _, dm := range dms {
+		ids = append(ids, dm.LoggableID)
+	}
+	want := []string{testUUID + ":6#1", testUUID + ":6#2", testUUID + ":7#1"}
+	if len(ids) != len(want) || ids[0] != want[0] || ids[1] != want[1] || ids[2] != want[2] {
+		t.Fatalf("ReceiveBatch() ids = %v, want %v", ids, want)
+	}
+
+	// the second transaction is only checkpointed once the first one was fully acknowledged
+	ack := func(dm *driver.Message) {
+		if err := s.SendAcks(context.Background(), []driver.AckID{dm.AckID}); err != nil {
+			t.Fatalf("SendAcks() error = %v", err)
+		}
+	}
+	ack(dms[2])
+	ack(dms[0])
+	if gset, ok := h.tracker.Flush(); ok {
+		t.Errorf("Flush() = %s while the first transaction is pending", gset)
+	}
+	ack(dms[1])
+	if gset, ok := h.tracker.Flush(); !ok || gset.String() != testUUID+":1-7" {
+		t.Errorf("Flush() = %v, %v, want %s", gset, ok, testUUID+":1-7")
+	}
+}
+
+// flakyStore fails the first saves
+type flakyStore struct {
+	mu       sync.Mutex
+	failures int
+	saved    string
+}
+
+func (s *flakyStore) Load(context.Context) ([]byte, error) {
+	return nil, nil
+}
+
+func (s *flakyStore) Save(_ context.Context, data []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.failures > 0 {
+		s.failures--
+		return errors.New("disk full")
+	}
+	s.saved = string(data)
+	return nil
+}
+
+func TestCheckpointRetries(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	h := newHandler(ctx, parseGTID(t, testUUID+":1-5"), 10)
+	store := &flakyStore{failures: 2}
+	go h.checkpoint(ctx, store, 10*time.Millisecond)
+
+	if err := h.OnGTID(nil, parseGTID(t, testUUID+":6")); err != nil {
+		t.Fatal(err)
+	}
+	if err := insert(h, 1); err != nil {
+		t.Fatalf("OnRow() error = %v", err)
+	}
+	if err := h.OnXID(nil, mysql.Position{}); err != nil {
+		t.Fatal(err)
+	}
+	dms, err := (&subscription{handler: h}).ReceiveBatch(ctx, 10)
+	if err != nil || len(dms) != 1 {
+		t.Fatalf("ReceiveBatch() = %v, %v", dms, err)
+	}
+	h.tracker.Ack(dms[0].AckID.(*change).txn)
+
+	// the failed saves are retried, without failing the subscription
+	brokertest.Eventually(t, &store.mu, func() bool { return store.saved == testUUID+":1-6" })
+	select {
+	case err := <-h.errs:
+		t.Errorf("subscription failed with %v", err)
+	default:
+	}
+}
@@ -0,0 +1,167 @@
+/*
+Copyright (c) 2022 RaptorML authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package mysqlbinlog implements a broker tailing the row based binlog of a MySQL (or MariaDB) server.
+// The server must run with GTIDs enabled, since the consumed position is checkpointed as a GTID set.
+package mysqlbinlog
+
+import (
+	"context"
+	"fmt"
+	"github.com/go-mysql-org/go-mysql/canal"
+	"github.com/go-mysql-org/go-mysql/mysql"
+	"github.com/raptor-ml/raptor/api/v1alpha1"
+	"github.com/raptor-ml/streaming-runner/internal/checkpoint"
+	"github.com/raptor-ml/streaming-runner/pkg/brokers"
+	"gocloud.dev/pubsub"
+	"gocloud.dev/pubsub/batcher"
+	"hash/fnv"
+	"strings"
+	"time"
+)
+
+func init() {
+	brokers.Register("mysql_binlog", &provider{})
+}
+
+type provider struct{}
+
+func (p *provider) Metadata(_ context.Context, msg *pubsub.Message) brokers.Metadata {
+	var md brokers.Metadata
+	var c *change
+	if ok := msg.As(&c); ok {
+		md.ID = c.id
+		md.Timestamp = c.timestamp
+		md.Topic = c.table
+	}
+	return md
+}
+
+type config struct {
+	Addr     string `mapstructure:"addr"`
+	User     string `mapstructure:"user"`
+	Password string `mapstructure:"password"`
+	// Flavor is either `mysql` or `mariadb`
+	Flavor string `mapstructure:"flavor"`
+	// ServerID is the replica id used to connect to the server, and must be unique within the replication topology
+	ServerID uint32 `mapstructure:"server_id"`
+	// IncludeTables and ExcludeTables are regular expressions matched against `db.table`
+	IncludeTables []string `mapstructure:"include_tables"`
+	ExcludeTables []string `mapstructure:"exclude_tables"`
+
+	// CheckpointPath is the file the consumed GTID set is persisted to
+	CheckpointPath     string        `mapstructure:"checkpoint_path"`
+	CheckpointInterval time.Duration `mapstructure:"checkpoint_interval"`
+
+	MaxBatchSize int `mapstructure:"max_batch_size"`
+}
+
+func (p *provider) Subscribe(ctx context.Context, c v1alpha1.ParsedConfig) (context.Context, *pubsub.Subscription, error) {
+	cfg := config{}
+	err := c.Unmarshal(&cfg)
+	if err != nil {
+		return ctx, nil, fmt.Errorf("failed to unmarshal config: %w", err)
+	}
+
+	if cfg.Addr == "" || cfg.User == "" {
+		return ctx, nil, fmt.Errorf("addr and user required to connect to mysql")
+	}
+	if cfg.CheckpointPath == "" {
+		return ctx, nil, fmt.Errorf("checkpoint_path required to track the binlog position")
+	}
+	if cfg.Flavor == "" {
+		cfg.Flavor = mysql.MySQLFlavor
+	}
+	if cfg.CheckpointInterval == 0 {
+		cfg.CheckpointInterval = 5 * time.Second
+	}
+	if cfg.MaxBatchSize == 0 {
+		cfg.MaxBatchSize = 100
+	}
+	if cfg.ServerID == 0 {
+		dc := brokers.DataSourceFromContext(ctx)
+		if dc == nil {
+			panic("no DataSource in context")
+		}
+		// derive a stable id, away from the low ids that are usually taken by the servers themselves
+		h := fnv.New32a()
+		_, _ = h.Write([]byte(fmt.Sprintf("%s.%s", dc.Name, dc.Namespace)))
+		cfg.ServerID = 1000 + h.Sum32()%(1<<31)
+	}
+
+	cc := canal.NewDefaultConfig()
+	cc.Addr = cfg.Addr
+	cc.User = cfg.User
+	cc.Password = cfg.Password
+	cc.Flavor = cfg.Flavor
+	cc.ServerID = cfg.ServerID
+	cc.IncludeTableRegex = cfg.IncludeTables
+	cc.ExcludeTableRegex = cfg.ExcludeTables
+	// never dump the existing data, only tail the binlog
+	cc.Dump.ExecutionPath = ""
+
+	cn, err := canal.NewCanal(cc)
+	if err != nil {
+		return ctx, nil, fmt.Errorf("failed to connect to mysql: %w", err)
+	}
+
+	store := checkpoint.NewFile(cfg.CheckpointPath)
+	gset, err := startPosition(ctx, cn, store, cfg.Flavor)
+	if err != nil {
+		cn.Close()
+		return ctx, nil, err
+	}
+
+	h := newHandler(ctx, gset, cfg.MaxBatchSize)
+	cn.SetEventHandler(h)
+	go func() {
+		if err := cn.StartFromGTID(gset.Clone()); err != nil && ctx.Err() == nil {
+			h.fail(fmt.Errorf("binlog replication stopped: %w", err))
+		}
+	}()
+	go h.checkpoint(ctx, store, cfg.CheckpointInterval)
+	go func() {
+		<-ctx.Done()
+		cn.Close()
+	}()
+
+	sub := pubsub.NewSubscription(&subscription{handler: h}, &batcher.Options{
+		MaxBatchSize: cfg.MaxBatchSize,
+		MaxHandlers:  1,
+	}, nil)
+	return ctx, sub, nil
+}
+
+// startPosition returns the checkpointed GTID set, or the server's current one if there is no checkpoint yet
+func startPosition(ctx context.Context, cn *canal.Canal, store checkpoint.Store, flavor string) (mysql.GTIDSet, error) {
+	data, err := store.Load(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if s := strings.TrimSpace(string(data)); s != "" {
+		gset, err := mysql.ParseGTIDSet(flavor, s)
+		if err != nil {
+			return nil, fmt.Errorf("invalid checkpoint %q: %w", s, err)
+		}
+		return gset, nil
+	}
+
+	gset, err := cn.GetMasterGTIDSet()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get the server GTID set (is gtid_mode enabled?): %w", err)
+	}
+	return gset, nil
+}
@@ -0,0 +1,124 @@
+/*
+Copyright (c) 2022 RaptorML authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package nats
+
+import (
+	"context"
+	"errors"
+	"github.com/nats-io/nats.go"
+	"github.com/nats-io/nats.go/jetstream"
+	"gocloud.dev/gcerrors"
+	"gocloud.dev/pubsub/driver"
+	"strconv"
+	"time"
+)
+
+// subscription implements driver.Subscription on top of a JetStream pull consumer
+type subscription struct {
+	consumer jetstream.Consumer
+}
+
+func (s *subscription) ReceiveBatch(_ context.Context, maxMessages int) ([]*driver.Message, error) {
+	batch, err := s.consumer.Fetch(maxMessages, jetstream.FetchMaxWait(time.Second))
+	if err != nil {
+		return nil, err
+	}
+
+	var dms []*driver.Message
+	for m := range batch.Messages() {
+		m := m
+		dm := &driver.Message{
+			Body:     m.Data(),
+			Metadata: map[string]string{},
+			AckID:    m,
+			AsFunc: func(i any) bool {
+				p, ok := i.(*jetstream.Msg)
+				if !ok {
+					return false
+				}
+				*p = m
+				return true
+			},
+		}
+		for k := range m.Headers() {
+			dm.Metadata[k] = m.Headers().Get(k)
+		}
+		if meta, err := m.Metadata(); err == nil {
+			dm.LoggableID = strconv.FormatUint(meta.Sequence.Stream, 10)
+		}
+		dms = append(dms, dm)
+	}
+	// the fetched messages are handed over even if the fetch failed midway, otherwise they're only redelivered
+	// once their ack wait expires
+	if err := batch.Error(); err != nil && len(dms) == 0 {
+		return nil, err
+	}
+	return dms, nil
+}
+
+func (s *subscription) SendAcks(_ context.Context, ackIDs []driver.AckID) error {
+	for _, id := range ackIDs {
+		if err := id.(jetstream.Msg).Ack(); err != nil && !errors.Is(err, jetstream.ErrMsgAlreadyAckd) {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *subscription) CanNack() bool {
+	return true
+}
+
+func (s *subscription) SendNacks(_ context.Context, ackIDs []driver.AckID) error {
+	for _, id := range ackIDs {
+		if err := id.(jetstream.Msg).Nak(); err != nil && !errors.Is(err, jetstream.ErrMsgAlreadyAckd) {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *subscription) IsRetryable(err error) bool {
+	return errors.Is(err, nats.ErrTimeout) || errors.Is(err, nats.ErrConnectionReconnecting)
+}
+
+func (s *subscription) As(i any) bool {
+	p, ok := i.(*jetstream.Consumer)
+	if !ok {
+		return false
+	}
+	*p = s.consumer
+	return true
+}
+
+func (s *subscription) ErrorAs(error, any) bool {
+	return false
+}
+
+func (s *subscription) ErrorCode(err error) gcerrors.ErrorCode {
+	switch {
+	case errors.Is(err, nats.ErrTimeout):
+		return gcerrors.DeadlineExceeded
+	case errors.Is(err, jetstream.ErrConsumerNotFound), errors.Is(err, jetstream.ErrStreamNotFound):
+		return gcerrors.NotFound
+	}
+	return gcerrors.Unknown
+}
+
+func (s *subscription) Close() error {
+	return nil
+}
@@ -0,0 +1,135 @@
+/*
+Copyright (c) 2022 RaptorML authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package nats
+
+import (
+	"context"
+	"fmt"
+	"github.com/nats-io/nats.go"
+	"github.com/nats-io/nats.go/jetstream"
+	"github.com/raptor-ml/raptor/api/v1alpha1"
+	"github.com/raptor-ml/streaming-runner/pkg/brokers"
+	"gocloud.dev/pubsub"
+	"gocloud.dev/pubsub/batcher"
+	"strconv"
+	"strings"
+)
+
+func init() {
+	brokers.Register("nats", &provider{})
+}
+
+type provider struct{}
+
+func (p *provider) Metadata(_ context.Context, msg *pubsub.Message) brokers.Metadata {
+	var md brokers.Metadata
+	var m jetstream.Msg
+	if ok := msg.As(&m); ok {
+		md.Topic = m.Subject()
+		if meta, err := m.Metadata(); err == nil {
+			md.Timestamp = meta.Timestamp
+			md.ID = strconv.FormatUint(meta.Sequence.Stream, 10)
+		}
+	}
+	return md
+}
+
+type config struct {
+	URL         string `mapstructure:"url"`
+	Stream      string `mapstructure:"stream"`
+	Subject     string `mapstructure:"subject"`
+	DurableName string `mapstructure:"durable_name"`
+
+	Username    string `mapstructure:"username"`
+	Password    string `mapstructure:"password"`
+	Token       string `mapstructure:"token"`
+	Credentials string `mapstructure:"credentials_file"`
+
+	MaxBatchSize int `mapstructure:"max_batch_size"`
+}
+
+func (p *provider) Subscribe(ctx context.Context, c v1alpha1.ParsedConfig) (context.Context, *pubsub.Subscription, error) {
+	cfg := config{}
+	err := c.Unmarshal(&cfg)
+	if err != nil {
+		return ctx, nil, fmt.Errorf("failed to unmarshal config: %w", err)
+	}
+
+	if cfg.Stream == "" {
+		return ctx, nil, fmt.Errorf("stream required to connect to nats")
+	}
+	if cfg.URL == "" {
+		cfg.URL = nats.DefaultURL
+	}
+	if cfg.MaxBatchSize == 0 {
+		cfg.MaxBatchSize = 100
+	}
+
+	if cfg.DurableName == "" {
+		dc := brokers.DataSourceFromContext(ctx)
+		if dc == nil {
+			panic("no DataSource in context")
+		}
+		cfg.DurableName = durableName(dc)
+	}
+
+	opts := []nats.Option{nats.Name("consumer.k8s.raptor.ml")}
+	if cfg.Username != "" && cfg.Password != "" {
+		opts = append(opts, nats.UserInfo(cfg.Username, cfg.Password))
+	}
+	if cfg.Token != "" {
+		opts = append(opts, nats.Token(cfg.Token))
+	}
+	if cfg.Credentials != "" {
+		opts = append(opts, nats.UserCredentials(cfg.Credentials))
+	}
+
+	nc, err := nats.Connect(cfg.URL, opts...)
+	if err != nil {
+		return ctx, nil, fmt.Errorf("failed to connect to nats: %w", err)
+	}
+	go func() {
+		<-ctx.Done()
+		nc.Close()
+	}()
+
+	js, err := jetstream.New(nc)
+	if err != nil {
+		return ctx, nil, fmt.Errorf("failed to create jetstream context: %w", err)
+	}
+
+	cons, err := js.CreateOrUpdateConsumer(ctx, cfg.Stream, jetstream.ConsumerConfig{
+		Durable:       cfg.DurableName,
+		FilterSubject: cfg.Subject,
+		AckPolicy:     jetstream.AckExplicitPolicy,
+	})
+	if err != nil {
+		return ctx, nil, fmt.Errorf("failed to create durable consumer: %w", err)
+	}
+
+	sub := pubsub.NewSubscription(&subscription{consumer: cons}, &batcher.Options{
+		MaxBatchSize: cfg.MaxBatchSize,
+		MaxHandlers:  1,
+	}, nil)
+	return ctx, sub, nil
+}
+
+// durableName returns the default durable name of a DataSource. Durable names can't contain dots, which
+// kubernetes names may contain.
+func durableName(dc *v1alpha1.DataSource) string {
+	return strings.ReplaceAll(fmt.Sprintf("%s_%s", dc.Name, dc.Namespace), ".", "_")
+}
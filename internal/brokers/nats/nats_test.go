@@ -0,0 +1,174 @@
+/*
+Copyright (c) 2022 RaptorML authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package nats
+
+import (
+	"context"
+	"errors"
+	"github.com/nats-io/nats.go"
+	"github.com/nats-io/nats.go/jetstream"
+	"github.com/raptor-ml/raptor/api/v1alpha1"
+	"gocloud.dev/pubsub/driver"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"testing"
+)
+
+type fakeMsg struct {
+	jetstream.Msg
+	seq   uint64
+	acked bool
+	naked bool
+}
+
+func (m *fakeMsg) Data() []byte {
+	return []byte("{}")
+}
+
+func (m *fakeMsg) Headers() nats.Header {
+	return nats.Header{"Trace": []string{"abc"}}
+}
+
+func (m *fakeMsg) Metadata() (*jetstream.MsgMetadata, error) {
+	return &jetstream.MsgMetadata{Sequence: jetstream.SequencePair{Stream: m.seq}}, nil
+}
+
+func (m *fakeMsg) Ack() error {
+	if m.acked {
+		return jetstream.ErrMsgAlreadyAckd
+	}
+	m.acked = true
+	return nil
+}
+
+func (m *fakeMsg) Nak() error {
+	m.naked = true
+	return nil
+}
+
+type fakeBatch struct {
+	msgs chan jetstream.Msg
+	err  error
+}
+
+func (b *fakeBatch) Messages() <-chan jetstream.Msg {
+	return b.msgs
+}
+
+func (b *fakeBatch) Error() error {
+	return b.err
+}
+
+// fakeConsumer returns a single batch of messages, which failed with err after them
+type fakeConsumer struct {
+	jetstream.Consumer
+	msgs     []*fakeMsg
+	err      error
+	fetchErr error
+}
+
+func (c *fakeConsumer) Fetch(int, ...jetstream.FetchOpt) (jetstream.MessageBatch, error) {
+	if c.fetchErr != nil {
+		return nil, c.fetchErr
+	}
+	b := &fakeBatch{msgs: make(chan jetstream.Msg, len(c.msgs)), err: c.err}
+	for _, m := range c.msgs {
+		b.msgs <- m
+	}
+	close(b.msgs)
+	return b, nil
+}
+
+func TestReceiveBatch(t *testing.T) {
+	errFetch := errors.New("connection closed")
+	tests := []struct {
+		name     string
+		consumer *fakeConsumer
+		want     []string
+		wantErr  error
+	}{
+		{
+			name:     "messages",
+			consumer: &fakeConsumer{msgs: []*fakeMsg{{seq: 1}, {seq: 2}}},
+			want:     []string{"1", "2"},
+		},
+		{
+			name:     "messages of a failed fetch",
+			consumer: &fakeConsumer{msgs: []*fakeMsg{{seq: 1}}, err: errFetch},
+			want:     []string{"1"},
+		},
+		{
+			name:     "failed fetch without messages",
+			consumer: &fakeConsumer{err: errFetch},
+			wantErr:  errFetch,
+		},
+		{
+			name:     "failed request",
+			consumer: &fakeConsumer{fetchErr: errFetch},
+			wantErr:  errFetch,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := &subscription{consumer: tt.consumer}
+			dms, err := s.ReceiveBatch(context.Background(), 10)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("ReceiveBatch() error = %v, want %v", err, tt.wantErr)
+			}
+			if len(dms) != len(tt.want) {
+				t.Fatalf("ReceiveBatch() returned %d messages, want %d", len(dms), len(tt.want))
+			}
+			for i, dm := range dms {
+				if dm.LoggableID != tt.want[i] {
+					t.Errorf("message %d id = %s, want %s", i, dm.LoggableID, tt.want[i])
+				}
+				if dm.Metadata["Trace"] != "abc" {
+					t.Errorf("message %d metadata = %v, want the headers", i, dm.Metadata)
+				}
+			}
+		})
+	}
+}
+
+func TestAcks(t *testing.T) {
+	acked, naked := &fakeMsg{seq: 1}, &fakeMsg{seq: 2}
+	s := &subscription{consumer: &fakeConsumer{msgs: []*fakeMsg{acked, naked}}}
+	dms, err := s.ReceiveBatch(context.Background(), 10)
+	if err != nil {
+		t.Fatalf("ReceiveBatch() error = %v", err)
+	}
+
+	if err := s.SendAcks(context.Background(), []driver.AckID{dms[0].AckID}); err != nil {
+		t.Fatalf("SendAcks() error = %v", err)
+	}
+	// acking again is ignored
+	if err := s.SendAcks(context.Background(), []driver.AckID{dms[0].AckID}); err != nil {
+		t.Fatalf("SendAcks() of an acked message error = %v", err)
+	}
+	if err := s.SendNacks(context.Background(), []driver.AckID{dms[1].AckID}); err != nil {
+		t.Fatalf("SendNacks() error = %v", err)
+	}
+	if !acked.acked || acked.naked || naked.acked || !naked.naked {
+		t.Errorf("acked = %+v, naked = %+v", acked, naked)
+	}
+}
+
+func TestDurableName(t *testing.T) {
+	dc := &v1alpha1.DataSource{ObjectMeta: metav1.ObjectMeta{Name: "orders.v1", Namespace: "default"}}
+	if got := durableName(dc); got != "orders_v1_default" {
+		t.Errorf("durableName() = %s, want orders_v1_default", got)
+	}
+}
@@ -0,0 +1,98 @@
+/*
+Copyright (c) 2022 RaptorML authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package postgrescdc
+
+import (
+	"context"
+	"errors"
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/raptor-ml/streaming-runner/internal/brokers/receive"
+	"gocloud.dev/gcerrors"
+	"gocloud.dev/pubsub/driver"
+)
+
+// subscription implements driver.Subscription on top of the replication stream.
+// Replication can't skip changes, so messages can only be acked.
+// Failures of the stream are handled by the replication, which reconnects.
+type subscription struct {
+	replication *replication
+}
+
+func (s *subscription) ReceiveBatch(ctx context.Context, maxMessages int) ([]*driver.Message, error) {
+	return receive.Batch(ctx, s.replication.changes, nil, maxMessages, toDriverMessage)
+}
+
+func toDriverMessage(c *change) *driver.Message {
+	return &driver.Message{
+		LoggableID: c.lsn.String(),
+		Body:       c.body,
+		AckID:      c,
+		AsFunc: func(i any) bool {
+			p, ok := i.(**change)
+			if !ok {
+				return false
+			}
+			*p = c
+			return true
+		},
+	}
+}
+
+func (s *subscription) SendAcks(_ context.Context, ackIDs []driver.AckID) error {
+	for _, id := range ackIDs {
+		s.replication.tracker.Ack(id.(*change).txn)
+	}
+	return nil
+}
+
+func (s *subscription) CanNack() bool {
+	return false
+}
+
+func (s *subscription) SendNacks(context.Context, []driver.AckID) error {
+	panic("unreachable")
+}
+
+func (s *subscription) IsRetryable(error) bool {
+	return false
+}
+
+func (s *subscription) As(i any) bool {
+	p, ok := i.(**pgconn.PgConn)
+	if !ok {
+		return false
+	}
+	s.replication.mu.Lock()
+	defer s.replication.mu.Unlock()
+	*p = s.replication.conn
+	return *p != nil
+}
+
+func (s *subscription) ErrorAs(err error, i any) bool {
+	return errors.As(err, i)
+}
+
+func (s *subscription) ErrorCode(err error) gcerrors.ErrorCode {
+	if pgconn.Timeout(err) {
+		return gcerrors.DeadlineExceeded
+	}
+	return gcerrors.Unknown
+}
+
+func (s *subscription) Close() error {
+	return nil
+}
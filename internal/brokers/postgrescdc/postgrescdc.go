@@ -0,0 +1,113 @@
+/*
+Copyright (c) 2022 RaptorML authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package postgrescdc implements a broker consuming row changes from a PostgreSQL logical replication slot,
+// using the pgoutput plugin.
+package postgrescdc
+
+import (
+	"context"
+	"fmt"
+	"github.com/go-logr/logr"
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/raptor-ml/raptor/api/v1alpha1"
+	"github.com/raptor-ml/streaming-runner/pkg/brokers"
+	"gocloud.dev/pubsub"
+	"gocloud.dev/pubsub/batcher"
+	"strings"
+	"time"
+)
+
+func init() {
+	brokers.Register("postgres_cdc", &provider{})
+}
+
+type provider struct{}
+
+func (p *provider) Metadata(_ context.Context, msg *pubsub.Message) brokers.Metadata {
+	var md brokers.Metadata
+	var c *change
+	if ok := msg.As(&c); ok {
+		md.ID = c.lsn.String()
+		md.Timestamp = c.commitTime
+		md.Topic = c.table
+	}
+	return md
+}
+
+// duplicateObjectCode is the SQLSTATE returned when the replication slot already exists
+const duplicateObjectCode = "42710"
+
+type config struct {
+	// ConnString is a PostgreSQL connection string of a user with the REPLICATION attribute
+	ConnString   string   `mapstructure:"conn_string"`
+	Slot         string   `mapstructure:"slot"`
+	Publications []string `mapstructure:"publications"`
+	// CreateSlot creates the replication slot if it doesn't exist
+	CreateSlot bool `mapstructure:"create_slot"`
+	// StatusInterval is the interval in which the acknowledged position is reported to the server
+	StatusInterval time.Duration `mapstructure:"status_interval"`
+
+	MaxBatchSize int `mapstructure:"max_batch_size"`
+}
+
+func (p *provider) Subscribe(ctx context.Context, c v1alpha1.ParsedConfig) (context.Context, *pubsub.Subscription, error) {
+	cfg := config{CreateSlot: true}
+	err := c.Unmarshal(&cfg)
+	if err != nil {
+		return ctx, nil, fmt.Errorf("failed to unmarshal config: %w", err)
+	}
+
+	if cfg.ConnString == "" {
+		return ctx, nil, fmt.Errorf("conn_string required to connect to postgres")
+	}
+	if len(cfg.Publications) == 0 {
+		return ctx, nil, fmt.Errorf("publications required to consume postgres changes")
+	}
+	if cfg.StatusInterval == 0 {
+		cfg.StatusInterval = 10 * time.Second
+	}
+	if cfg.MaxBatchSize == 0 {
+		cfg.MaxBatchSize = 100
+	}
+	if cfg.Slot == "" {
+		dc := brokers.DataSourceFromContext(ctx)
+		if dc == nil {
+			panic("no DataSource in context")
+		}
+		// slot names may only contain lower case letters, numbers and underscores
+		cfg.Slot = strings.NewReplacer("-", "_", ".", "_").Replace(fmt.Sprintf("%s_%s", dc.Name, dc.Namespace))
+	}
+
+	pgCfg, err := pgconn.ParseConfig(cfg.ConnString)
+	if err != nil {
+		return ctx, nil, fmt.Errorf("invalid conn_string: %w", err)
+	}
+	pgCfg.RuntimeParams["replication"] = "database"
+	pgCfg.RuntimeParams["application_name"] = "consumer.k8s.raptor.ml"
+
+	r := newReplication(pgCfg, cfg, logr.FromContextOrDiscard(ctx))
+	if err := r.connect(ctx); err != nil {
+		return ctx, nil, err
+	}
+	go r.run(ctx)
+
+	sub := pubsub.NewSubscription(&subscription{replication: r}, &batcher.Options{
+		MaxBatchSize: cfg.MaxBatchSize,
+		MaxHandlers:  1,
+	}, nil)
+	return ctx, sub, nil
+}
@@ -0,0 +1,404 @@
+/*
+Copyright (c) 2022 RaptorML authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package postgrescdc
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/go-logr/logr"
+	"github.com/jackc/pglogrepl"
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/jackc/pgx/v5/pgproto3"
+	"github.com/jackc/pgx/v5/pgtype"
+	"github.com/raptor-ml/streaming-runner/internal/brokers/txn"
+	"math"
+	"strings"
+	"sync"
+	"time"
+)
+
+// change is a single row change
+type change struct {
+	lsn        pglogrepl.LSN
+	commitTime time.Time
+	table      string
+	body       []byte
+	txn        *txn.Transaction[pglogrepl.LSN]
+}
+
+const (
+	minReconnectDelay = time.Second
+	maxReconnectDelay = 30 * time.Second
+)
+
+// replication reads the replication stream, and reports the acknowledged position back to the server.
+// When the stream fails, it reconnects and resumes from the last acknowledged position, so changes that were
+// received but not acknowledged yet are delivered again.
+type replication struct {
+	pgCfg          *pgconn.Config
+	slot           string
+	createSlot     bool
+	publications   []string
+	statusInterval time.Duration
+	logger         logr.Logger
+	changes        chan *change
+
+	mu   sync.Mutex
+	conn *pgconn.PgConn
+
+	typeMap    *pgtype.Map
+	relations  map[uint32]*pglogrepl.RelationMessage
+	tracker    *txn.Tracker[pglogrepl.LSN]
+	txn        *txn.Transaction[pglogrepl.LSN]
+	commitTime time.Time
+	nextStatus time.Time
+}
+
+func newReplication(pgCfg *pgconn.Config, cfg config, logger logr.Logger) *replication {
+	return &replication{
+		pgCfg:          pgCfg,
+		slot:           cfg.Slot,
+		createSlot:     cfg.CreateSlot,
+		publications:   cfg.Publications,
+		statusInterval: cfg.StatusInterval,
+		logger:         logger,
+		changes:        make(chan *change, cfg.MaxBatchSize),
+		typeMap:        pgtype.NewMap(),
+		relations:      make(map[uint32]*pglogrepl.RelationMessage),
+		tracker:        txn.New(0, latestLSN),
+	}
+}
+
+// latestLSN merges the positions of the acknowledged transactions, which end at increasing LSNs
+func latestLSN(current, pos pglogrepl.LSN) pglogrepl.LSN {
+	if pos > current {
+		return pos
+	}
+	return current
+}
+
+// connect opens a replication connection, and starts streaming from the last acknowledged position
+func (r *replication) connect(ctx context.Context) error {
+	conn, err := pgconn.ConnectConfig(ctx, r.pgCfg)
+	if err != nil {
+		return fmt.Errorf("failed to connect to postgres: %w", err)
+	}
+
+	if r.createSlot {
+		_, err = pglogrepl.CreateReplicationSlot(ctx, conn, r.slot, "pgoutput", pglogrepl.CreateReplicationSlotOptions{
+			Mode: pglogrepl.LogicalReplication,
+		})
+		var pgErr *pgconn.PgError
+		if err != nil && !(errors.As(err, &pgErr) && pgErr.Code == duplicateObjectCode) {
+			_ = conn.Close(context.Background())
+			return fmt.Errorf("failed to create replication slot: %w", err)
+		}
+	}
+
+	// starting from LSN 0 resumes from the slot's confirmed position
+	pos := r.tracker.Reset()
+	err = pglogrepl.StartReplication(ctx, conn, r.slot, pos, pglogrepl.StartReplicationOptions{
+		Mode: pglogrepl.LogicalReplication,
+		PluginArgs: []string{
+			"proto_version '1'",
+			fmt.Sprintf("publication_names '%s'", strings.Join(r.publications, ",")),
+		},
+	})
+	if err != nil {
+		_ = conn.Close(context.Background())
+		return fmt.Errorf("failed to start replication: %w", err)
+	}
+
+	r.mu.Lock()
+	r.conn = conn
+	r.mu.Unlock()
+	r.txn = nil
+	r.nextStatus = time.Now().Add(r.statusInterval)
+	return nil
+}
+
+func (r *replication) close() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.conn != nil {
+		_ = r.conn.Close(context.Background())
+		r.conn = nil
+	}
+}
+
+// drain drops the changes that weren't received yet, since they're streamed again after reconnecting
+func (r *replication) drain() {
+	for {
+		select {
+		case <-r.changes:
+		default:
+			return
+		}
+	}
+}
+
+// run streams the changes until the context is done, reconnecting with an exponential backoff when the stream fails
+func (r *replication) run(ctx context.Context) {
+	defer r.close()
+
+	delay := minReconnectDelay
+	for {
+		started := time.Now()
+		err := r.stream(ctx)
+		if ctx.Err() != nil {
+			return
+		}
+		r.close()
+		r.drain()
+		if time.Since(started) > maxReconnectDelay {
+			delay = minReconnectDelay
+		}
+
+		for {
+			r.logger.Error(err, "replication interrupted, reconnecting", "lsn", r.tracker.Position().String(), "retryIn", delay)
+			t := time.NewTimer(delay)
+			select {
+			case <-ctx.Done():
+				t.Stop()
+				return
+			case <-t.C:
+			}
+			if delay *= 2; delay > maxReconnectDelay {
+				delay = maxReconnectDelay
+			}
+			if err = r.connect(ctx); err == nil {
+				break
+			}
+		}
+	}
+}
+
+// stream handles the replication messages until the context is done or the stream fails
+func (r *replication) stream(ctx context.Context) error {
+	for {
+		if err := r.maybeSendStatus(ctx); err != nil {
+			return err
+		}
+
+		rctx, cancel := context.WithDeadline(ctx, r.nextStatus)
+		raw, err := r.conn.ReceiveMessage(rctx)
+		cancel()
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if err != nil {
+			if pgconn.Timeout(err) {
+				continue
+			}
+			return fmt.Errorf("failed to receive replication message: %w", err)
+		}
+
+		switch msg := raw.(type) {
+		case *pgproto3.ErrorResponse:
+			return pgconn.ErrorResponseToPgError(msg)
+		case *pgproto3.CopyData:
+			if err := r.handleCopyData(ctx, msg.Data); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+func (r *replication) handleCopyData(ctx context.Context, data []byte) error {
+	if len(data) == 0 {
+		return errors.New("received an empty replication message")
+	}
+	switch data[0] {
+	case pglogrepl.PrimaryKeepaliveMessageByteID:
+		pkm, err := pglogrepl.ParsePrimaryKeepaliveMessage(data[1:])
+		if err != nil {
+			return fmt.Errorf("failed to parse keepalive message: %w", err)
+		}
+		r.tracker.Idle(pkm.ServerWALEnd)
+		if pkm.ReplyRequested {
+			r.nextStatus = time.Time{}
+		}
+	case pglogrepl.XLogDataByteID:
+		xld, err := pglogrepl.ParseXLogData(data[1:])
+		if err != nil {
+			return fmt.Errorf("failed to parse xlog data: %w", err)
+		}
+		return r.decode(ctx, xld)
+	}
+	return nil
+}
+
+func (r *replication) maybeSendStatus(ctx context.Context) error {
+	if time.Now().Before(r.nextStatus) {
+		return nil
+	}
+	r.nextStatus = time.Now().Add(r.statusInterval)
+
+	pos := r.tracker.Position()
+	if pos == 0 {
+		return nil
+	}
+	err := pglogrepl.SendStandbyStatusUpdate(ctx, r.conn, pglogrepl.StandbyStatusUpdate{WALWritePosition: pos})
+	if err != nil {
+		return fmt.Errorf("failed to send standby status: %w", err)
+	}
+	return nil
+}
+
+func (r *replication) decode(ctx context.Context, xld pglogrepl.XLogData) error {
+	msg, err := pglogrepl.Parse(xld.WALData)
+	if err != nil {
+		return fmt.Errorf("failed to parse logical replication message: %w", err)
+	}
+
+	switch m := msg.(type) {
+	case *pglogrepl.RelationMessage:
+		r.relations[m.RelationID] = m
+	case *pglogrepl.BeginMessage:
+		r.txn = r.tracker.Begin()
+		r.commitTime = m.CommitTime
+	case *pglogrepl.CommitMessage:
+		r.tracker.Commit(r.txn, m.TransactionEndLSN)
+		r.txn = nil
+	case *pglogrepl.InsertMessage:
+		return r.emit(ctx, xld.WALStart, "insert", m.RelationID, nil, m.Tuple)
+	case *pglogrepl.UpdateMessage:
+		return r.emit(ctx, xld.WALStart, "update", m.RelationID, m.OldTuple, m.NewTuple)
+	case *pglogrepl.DeleteMessage:
+		return r.emit(ctx, xld.WALStart, "delete", m.RelationID, m.OldTuple, nil)
+	}
+	return nil
+}
+
+func (r *replication) emit(ctx context.Context, lsn pglogrepl.LSN, op string, relID uint32, before, after *pglogrepl.TupleData) error {
+	rel, ok := r.relations[relID]
+	if !ok {
+		return fmt.Errorf("unknown relation id %d", relID)
+	}
+	if r.txn == nil {
+		return fmt.Errorf("row change outside of a transaction at %s", lsn)
+	}
+
+	b, err := r.row(rel, before)
+	if err != nil {
+		return err
+	}
+	a, err := r.row(rel, after)
+	if err != nil {
+		return err
+	}
+	body, err := json.Marshal(map[string]any{
+		"op":     op,
+		"schema": rel.Namespace,
+		"table":  rel.RelationName,
+		"before": b,
+		"after":  a,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to encode row change: %w", err)
+	}
+
+	c := &change{
+		lsn:        lsn,
+		commitTime: r.commitTime,
+		table:      fmt.Sprintf("%s.%s", rel.Namespace, rel.RelationName),
+		body:       body,
+		txn:        r.txn,
+	}
+	r.tracker.Add(r.txn)
+
+	// keep reporting the status to the server while waiting for the subscriber
+	for {
+		timer := time.NewTimer(time.Until(r.nextStatus))
+		select {
+		case r.changes <- c:
+			timer.Stop()
+			return nil
+		case <-ctx.Done():
+			timer.Stop()
+			return nil
+		case <-timer.C:
+			if err := r.maybeSendStatus(ctx); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+func (r *replication) row(rel *pglogrepl.RelationMessage, tuple *pglogrepl.TupleData) (map[string]any, error) {
+	if tuple == nil {
+		return nil, nil
+	}
+
+	row := make(map[string]any, len(tuple.Columns))
+	for i, col := range tuple.Columns {
+		c := rel.Columns[i]
+		switch col.DataType {
+		case pglogrepl.TupleDataTypeNull:
+			row[c.Name] = nil
+		case pglogrepl.TupleDataTypeToast:
+			// unchanged TOASTed values are not sent by the server
+		case pglogrepl.TupleDataTypeText:
+			v, err := r.decodeText(col.Data, c.DataType)
+			if err != nil {
+				return nil, fmt.Errorf("failed to decode column %s: %w", c.Name, err)
+			}
+			row[c.Name] = v
+		}
+	}
+	return row, nil
+}
+
+// decodeText decodes a column from its text representation. Only types that have a faithful JSON representation are
+// decoded; others, e.g. uuid, inet or interval, and values like infinite timestamps, keep the server's representation.
+func (r *replication) decodeText(data []byte, oid uint32) (any, error) {
+	switch oid {
+	case pgtype.BoolOID, pgtype.Int2OID, pgtype.Int4OID, pgtype.Int8OID, pgtype.OIDOID, pgtype.Float4OID,
+		pgtype.Float8OID, pgtype.NumericOID, pgtype.JSONOID, pgtype.JSONBOID, pgtype.ByteaOID, pgtype.DateOID,
+		pgtype.TimestampOID, pgtype.TimestamptzOID:
+	default:
+		return string(data), nil
+	}
+
+	dt, ok := r.typeMap.TypeForOID(oid)
+	if !ok {
+		return string(data), nil
+	}
+	v, err := dt.Codec.DecodeValue(r.typeMap, oid, pgtype.TextFormatCode, data)
+	if err != nil {
+		return nil, err
+	}
+	switch v := v.(type) {
+	case pgtype.InfinityModifier:
+		return string(data), nil
+	case pgtype.Numeric:
+		if v.NaN || v.InfinityModifier != pgtype.Finite {
+			return string(data), nil
+		}
+	case float32:
+		if math.IsNaN(float64(v)) || math.IsInf(float64(v), 0) {
+			return string(data), nil
+		}
+	case float64:
+		if math.IsNaN(v) || math.IsInf(v, 0) {
+			return string(data), nil
+		}
+	}
+	return v, nil
+}
@@ -0,0 +1,113 @@
+/*
+Copyright (c) 2022 RaptorML authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package postgrescdc
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/go-logr/logr"
+	"github.com/jackc/pglogrepl"
+	"github.com/jackc/pgx/v5/pgtype"
+	"testing"
+	"time"
+)
+
+func TestDecodeText(t *testing.T) {
+	tests := []struct {
+		name string
+		oid  uint32
+		data string
+		// want is the JSON encoding of the decoded value
+		want string
+	}{
+		{"bool", pgtype.BoolOID, "t", `true`},
+		{"int2", pgtype.Int2OID, "7", `7`},
+		{"int4", pgtype.Int4OID, "-42", `-42`},
+		{"int8", pgtype.Int8OID, "9007199254740993", `9007199254740993`},
+		{"float4", pgtype.Float4OID, "1.5", `1.5`},
+		{"float4 infinity", pgtype.Float4OID, "-Infinity", `"-Infinity"`},
+		{"float8", pgtype.Float8OID, "0.1", `0.1`},
+		{"float8 nan", pgtype.Float8OID, "NaN", `"NaN"`},
+		{"numeric", pgtype.NumericOID, "12345678901234567890.123", `12345678901234567890.123`},
+		{"numeric nan", pgtype.NumericOID, "NaN", `"NaN"`},
+		{"numeric infinity", pgtype.NumericOID, "Infinity", `"Infinity"`},
+		{"text", pgtype.TextOID, "hello", `"hello"`},
+		{"varchar", pgtype.VarcharOID, "hello", `"hello"`},
+		{"uuid", pgtype.UUIDOID, "a0eebc99-9c0b-4ef8-bb6d-6bb9bd380a11", `"a0eebc99-9c0b-4ef8-bb6d-6bb9bd380a11"`},
+		{"inet", pgtype.InetOID, "192.168.0.1", `"192.168.0.1"`},
+		{"cidr", pgtype.CIDROID, "10.0.0.0/8", `"10.0.0.0/8"`},
+		{"interval", pgtype.IntervalOID, "1 day 02:00:00", `"1 day 02:00:00"`},
+		{"time", pgtype.TimeOID, "04:05:06", `"04:05:06"`},
+		{"json", pgtype.JSONOID, `{"a":[1,2]}`, `{"a":[1,2]}`},
+		{"jsonb", pgtype.JSONBOID, `{"a": "b"}`, `{"a":"b"}`},
+		{"bytea", pgtype.ByteaOID, `\xdeadbeef`, `"3q2+7w=="`},
+		{"date", pgtype.DateOID, "2023-11-14", `"2023-11-14T00:00:00Z"`},
+		{"date infinity", pgtype.DateOID, "infinity", `"infinity"`},
+		{"timestamp", pgtype.TimestampOID, "2023-11-14 22:13:20.5", `"2023-11-14T22:13:20.5Z"`},
+		{"timestamptz", pgtype.TimestamptzOID, "2023-11-14 22:13:20+02", `"2023-11-14T22:13:20+02:00"`},
+		{"timestamp infinity", pgtype.TimestampOID, "-infinity", `"-infinity"`},
+		{"int4 array", pgtype.Int4ArrayOID, "{1,2}", `"{1,2}"`},
+		{"unknown type", 999999, "x", `"x"`},
+	}
+	r := newReplication(nil, config{}, logr.Discard())
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			v, err := r.decodeText([]byte(tt.data), tt.oid)
+			if err != nil {
+				t.Fatalf("decodeText() error = %v", err)
+			}
+			got, err := json.Marshal(v)
+			if err != nil {
+				t.Fatalf("failed to encode %#v: %v", v, err)
+			}
+			if string(got) != tt.want {
+				t.Errorf("decodeText() = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestHandleEmptyCopyData(t *testing.T) {
+	r := newReplication(nil, config{}, logr.Discard())
+	if err := r.handleCopyData(context.Background(), nil); err == nil {
+		t.Error("handleCopyData() of an empty message succeeded")
+	}
+}
+
+func TestDrain(t *testing.T) {
+	r := newReplication(nil, config{MaxBatchSize: 2}, logr.Discard())
+	r.changes <- &change{lsn: 1}
+	r.changes <- &change{lsn: 2}
+
+	// the changes buffered before the stream failed are delivered again after reconnecting, so they're dropped
+	r.drain()
+	sub := &subscription{replication: r}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	dms, err := sub.ReceiveBatch(ctx, 10)
+	if err != nil {
+		t.Fatalf("ReceiveBatch() error = %v", err)
+	}
+	if len(dms) != 0 {
+		t.Errorf("ReceiveBatch() returned %d changes after draining", len(dms))
+	}
+
+	r.changes <- &change{lsn: 3}
+	if dms, err = sub.ReceiveBatch(ctx, 10); err != nil || len(dms) != 1 || dms[0].LoggableID != pglogrepl.LSN(3).String() {
+		t.Errorf("ReceiveBatch() = %v, %v, want the change after draining", dms, err)
+	}
+}
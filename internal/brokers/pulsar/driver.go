@@ -0,0 +1,112 @@
+/*
+Copyright (c) 2022 RaptorML authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package pulsar
+
+import (
+	"context"
+	"errors"
+	"github.com/apache/pulsar-client-go/pulsar"
+	"github.com/raptor-ml/streaming-runner/internal/brokers/receive"
+	"gocloud.dev/gcerrors"
+	"gocloud.dev/pubsub/driver"
+)
+
+// subscription implements driver.Subscription on top of a Pulsar consumer
+type subscription struct {
+	consumer pulsar.Consumer
+}
+
+func (s *subscription) ReceiveBatch(ctx context.Context, maxMessages int) ([]*driver.Message, error) {
+	return receive.Batch(ctx, s.consumer.Chan(), nil, maxMessages, func(cm pulsar.ConsumerMessage) *driver.Message {
+		return toDriverMessage(cm.Message)
+	})
+}
+
+func toDriverMessage(m pulsar.Message) *driver.Message {
+	return &driver.Message{
+		LoggableID: m.ID().String(),
+		Body:       m.Payload(),
+		Metadata:   m.Properties(),
+		AckID:      m,
+		AsFunc: func(i any) bool {
+			p, ok := i.(*pulsar.Message)
+			if !ok {
+				return false
+			}
+			*p = m
+			return true
+		},
+	}
+}
+
+func (s *subscription) SendAcks(_ context.Context, ackIDs []driver.AckID) error {
+	for _, id := range ackIDs {
+		if err := s.consumer.Ack(id.(pulsar.Message)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *subscription) CanNack() bool {
+	return true
+}
+
+// SendNacks marks the messages for redelivery after the configured redelivery delay
+func (s *subscription) SendNacks(_ context.Context, ackIDs []driver.AckID) error {
+	for _, id := range ackIDs {
+		s.consumer.Nack(id.(pulsar.Message))
+	}
+	return nil
+}
+
+func (s *subscription) IsRetryable(error) bool {
+	return false
+}
+
+func (s *subscription) As(i any) bool {
+	p, ok := i.(*pulsar.Consumer)
+	if !ok {
+		return false
+	}
+	*p = s.consumer
+	return true
+}
+
+func (s *subscription) ErrorAs(err error, i any) bool {
+	return errors.As(err, i)
+}
+
+func (s *subscription) ErrorCode(err error) gcerrors.ErrorCode {
+	var pErr *pulsar.Error
+	if !errors.As(err, &pErr) {
+		return gcerrors.Unknown
+	}
+	switch pErr.Result() {
+	case pulsar.TimeoutError:
+		return gcerrors.DeadlineExceeded
+	case pulsar.AuthenticationError, pulsar.AuthorizationError:
+		return gcerrors.PermissionDenied
+	case pulsar.TopicNotFound, pulsar.SubscriptionNotFound:
+		return gcerrors.NotFound
+	}
+	return gcerrors.Internal
+}
+
+func (s *subscription) Close() error {
+	return nil
+}
@@ -0,0 +1,171 @@
+/*
+Copyright (c) 2022 RaptorML authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package pulsar
+
+import (
+	"context"
+	"fmt"
+	"github.com/apache/pulsar-client-go/pulsar"
+	"github.com/raptor-ml/raptor/api/v1alpha1"
+	"github.com/raptor-ml/streaming-runner/pkg/brokers"
+	"gocloud.dev/pubsub"
+	"gocloud.dev/pubsub/batcher"
+	"strings"
+	"time"
+)
+
+func init() {
+	brokers.Register("pulsar", &provider{})
+}
+
+type provider struct{}
+
+func (p *provider) Metadata(_ context.Context, msg *pubsub.Message) brokers.Metadata {
+	var md brokers.Metadata
+	var m pulsar.Message
+	if ok := msg.As(&m); ok {
+		md.Topic = m.Topic()
+		md.ID = m.ID().String()
+		md.Key = m.Key()
+		md.Timestamp = m.EventTime()
+		if md.Timestamp.IsZero() {
+			md.Timestamp = m.PublishTime()
+		}
+		md.Attributes = map[string]string{
+			"publish_time": m.PublishTime().Format(time.RFC3339Nano),
+		}
+		if !m.EventTime().IsZero() {
+			md.Attributes["event_time"] = m.EventTime().Format(time.RFC3339Nano)
+		}
+	}
+	return md
+}
+
+type config struct {
+	ServiceURL    string   `mapstructure:"service_url"`
+	Topics        []string `mapstructure:"topics"`
+	TopicsPattern string   `mapstructure:"topics_pattern"`
+	Subscription  string   `mapstructure:"subscription"`
+	// SubscriptionType is one of `shared` (default), `key_shared`, `failover` or `exclusive`.
+	SubscriptionType string `mapstructure:"subscription_type"`
+	// InitialPosition is either `latest` (default) or `earliest`.
+	InitialPosition     string        `mapstructure:"initial_position"`
+	NackRedeliveryDelay time.Duration `mapstructure:"nack_redelivery_delay"`
+
+	AuthToken         string `mapstructure:"auth_token"`
+	TLSTrustCertsFile string `mapstructure:"tls_trust_certs_file"`
+	TLSSkipVerify     bool   `mapstructure:"tls_skip_verify"`
+
+	MaxBatchSize int `mapstructure:"max_batch_size"`
+}
+
+func (p *provider) Subscribe(ctx context.Context, c v1alpha1.ParsedConfig) (context.Context, *pubsub.Subscription, error) {
+	cfg := config{}
+	err := c.Unmarshal(&cfg)
+	if err != nil {
+		return ctx, nil, fmt.Errorf("failed to unmarshal config: %w", err)
+	}
+
+	if cfg.ServiceURL == "" {
+		return ctx, nil, fmt.Errorf("service_url required to connect to pulsar")
+	}
+	if len(cfg.Topics) == 0 && cfg.TopicsPattern == "" {
+		return ctx, nil, fmt.Errorf("topics or topics_pattern required to connect to pulsar")
+	}
+	if cfg.MaxBatchSize == 0 {
+		cfg.MaxBatchSize = 100
+	}
+
+	if cfg.Subscription == "" {
+		dc := brokers.DataSourceFromContext(ctx)
+		if dc == nil {
+			panic("no DataSource in context")
+		}
+		cfg.Subscription = fmt.Sprintf("%s.%s", dc.Name, dc.Namespace)
+	}
+
+	st, err := parseSubscriptionType(cfg.SubscriptionType)
+	if err != nil {
+		return ctx, nil, err
+	}
+	ip, err := parseInitialPosition(cfg.InitialPosition)
+	if err != nil {
+		return ctx, nil, err
+	}
+
+	opts := pulsar.ClientOptions{
+		URL:                        cfg.ServiceURL,
+		TLSTrustCertsFilePath:      cfg.TLSTrustCertsFile,
+		TLSAllowInsecureConnection: cfg.TLSSkipVerify,
+	}
+	if cfg.AuthToken != "" {
+		opts.Authentication = pulsar.NewAuthenticationToken(cfg.AuthToken)
+	}
+	client, err := pulsar.NewClient(opts)
+	if err != nil {
+		return ctx, nil, fmt.Errorf("failed to create pulsar client: %w", err)
+	}
+
+	consumer, err := client.Subscribe(pulsar.ConsumerOptions{
+		Topics:                      cfg.Topics,
+		TopicsPattern:               cfg.TopicsPattern,
+		SubscriptionName:            cfg.Subscription,
+		Type:                        st,
+		SubscriptionInitialPosition: ip,
+		NackRedeliveryDelay:         cfg.NackRedeliveryDelay,
+		Name:                        "consumer.k8s.raptor.ml",
+	})
+	if err != nil {
+		client.Close()
+		return ctx, nil, fmt.Errorf("failed to subscribe: %w", err)
+	}
+	go func() {
+		<-ctx.Done()
+		consumer.Close()
+		client.Close()
+	}()
+
+	sub := pubsub.NewSubscription(&subscription{consumer: consumer}, &batcher.Options{
+		MaxBatchSize: cfg.MaxBatchSize,
+		MaxHandlers:  1,
+	}, nil)
+	return ctx, sub, nil
+}
+
+func parseSubscriptionType(value string) (pulsar.SubscriptionType, error) {
+	switch strings.ToLower(value) {
+	case "", "shared":
+		return pulsar.Shared, nil
+	case "key_shared":
+		return pulsar.KeyShared, nil
+	case "failover":
+		return pulsar.Failover, nil
+	case "exclusive":
+		return pulsar.Exclusive, nil
+	}
+	return 0, fmt.Errorf("pulsar error: invalid subscription_type: %s", value)
+}
+
+func parseInitialPosition(value string) (pulsar.SubscriptionInitialPosition, error) {
+	switch strings.ToLower(value) {
+	case "", "latest":
+		return pulsar.SubscriptionPositionLatest, nil
+	case "earliest":
+		return pulsar.SubscriptionPositionEarliest, nil
+	}
+	return 0, fmt.Errorf("pulsar error: invalid initial_position: %s", value)
+}
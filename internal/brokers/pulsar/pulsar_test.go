@@ -0,0 +1,224 @@
+/*
+Copyright (c) 2022 RaptorML authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package pulsar
+
+import (
+	"context"
+	"github.com/apache/pulsar-client-go/pulsar"
+	"github.com/raptor-ml/raptor/api/v1alpha1"
+	"github.com/raptor-ml/streaming-runner/internal/brokers/brokertest"
+	"gocloud.dev/pubsub"
+	"gocloud.dev/pubsub/batcher"
+	"sync"
+	"testing"
+	"time"
+)
+
+type fakeID struct {
+	pulsar.MessageID
+	id string
+}
+
+func (id fakeID) String() string {
+	return id.id
+}
+
+type fakeMessage struct {
+	pulsar.Message
+	id          string
+	payload     string
+	eventTime   time.Time
+	publishTime time.Time
+}
+
+func (m *fakeMessage) ID() pulsar.MessageID {
+	return fakeID{id: m.id}
+}
+
+func (m *fakeMessage) Payload() []byte {
+	return []byte(m.payload)
+}
+
+func (m *fakeMessage) Properties() map[string]string {
+	return map[string]string{"source": "test"}
+}
+
+func (m *fakeMessage) Topic() string {
+	return "persistent://public/default/orders"
+}
+
+func (m *fakeMessage) Key() string {
+	return "key-" + m.id
+}
+
+func (m *fakeMessage) EventTime() time.Time {
+	return m.eventTime
+}
+
+func (m *fakeMessage) PublishTime() time.Time {
+	return m.publishTime
+}
+
+// fakeConsumer redelivers nacked messages right away, as if the nack redelivery delay elapsed
+type fakeConsumer struct {
+	pulsar.Consumer
+	ch chan pulsar.ConsumerMessage
+
+	mu     sync.Mutex
+	acked  []string
+	nacked []string
+}
+
+func newFakeConsumer(msgs ...*fakeMessage) *fakeConsumer {
+	c := &fakeConsumer{ch: make(chan pulsar.ConsumerMessage, 10)}
+	for _, m := range msgs {
+		c.ch <- pulsar.ConsumerMessage{Consumer: c, Message: m}
+	}
+	return c
+}
+
+func (c *fakeConsumer) Chan() <-chan pulsar.ConsumerMessage {
+	return c.ch
+}
+
+func (c *fakeConsumer) Ack(m pulsar.Message) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.acked = append(c.acked, m.ID().String())
+	return nil
+}
+
+func (c *fakeConsumer) Nack(m pulsar.Message) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.nacked = append(c.nacked, m.ID().String())
+	c.ch <- pulsar.ConsumerMessage{Consumer: c, Message: m}
+}
+
+func open(t *testing.T, c *fakeConsumer) *pubsub.Subscription {
+	sub := pubsub.NewSubscription(&subscription{consumer: c}, &batcher.Options{MaxBatchSize: 10, MaxHandlers: 1}, nil)
+	t.Cleanup(func() { _ = sub.Shutdown(context.Background()) })
+	return sub
+}
+
+func TestReceiveAndAck(t *testing.T) {
+	published := time.UnixMilli(1700000000000)
+	c := newFakeConsumer(
+		&fakeMessage{id: "1:0:0", payload: `{"a":1}`, publishTime: published},
+		&fakeMessage{id: "1:1:0", payload: `{"a":2}`, publishTime: published, eventTime: published.Add(-time.Minute)},
+	)
+	sub := open(t, c)
+	ctx, cancel := context.WithTimeout(context.Background(), brokertest.Timeout)
+	defer cancel()
+
+	wantTimestamps := []time.Time{published, published.Add(-time.Minute)}
+	for i, want := range []string{`{"a":1}`, `{"a":2}`} {
+		msg, err := sub.Receive(ctx)
+		if err != nil {
+			t.Fatalf("Receive() error = %v", err)
+		}
+		if string(msg.Body) != want || msg.Metadata["source"] != "test" {
+			t.Errorf("message = %s %v, want %s", msg.Body, msg.Metadata, want)
+		}
+		md := (&provider{}).Metadata(ctx, msg)
+		if md.ID != msg.LoggableID || md.Key != "key-"+md.ID || md.Topic != "persistent://public/default/orders" {
+			t.Errorf("Metadata() = %+v", md)
+		}
+		// the event time takes precedence over the publish time
+		if !md.Timestamp.Equal(wantTimestamps[i]) {
+			t.Errorf("Metadata() timestamp = %v, want %v", md.Timestamp, wantTimestamps[i])
+		}
+		msg.Ack()
+	}
+	brokertest.Eventually(t, &c.mu, func() bool { return len(c.acked) == 2 })
+}
+
+func TestNackRedelivers(t *testing.T) {
+	c := newFakeConsumer(&fakeMessage{id: "1:0:0", payload: `{"a":1}`})
+	sub := open(t, c)
+	ctx, cancel := context.WithTimeout(context.Background(), brokertest.Timeout)
+	defer cancel()
+
+	msg, err := sub.Receive(ctx)
+	if err != nil {
+		t.Fatalf("Receive() error = %v", err)
+	}
+	msg.Nack()
+
+	again, err := sub.Receive(ctx)
+	if err != nil {
+		t.Fatalf("Receive() error = %v", err)
+	}
+	if again.LoggableID != msg.LoggableID {
+		t.Errorf("redelivered %s, want %s", again.LoggableID, msg.LoggableID)
+	}
+	again.Ack()
+	brokertest.Eventually(t, &c.mu, func() bool { return len(c.acked) == 1 })
+	if len(c.nacked) != 1 {
+		t.Errorf("nacked = %v, want the first delivery", c.nacked)
+	}
+}
+
+func TestSubscribeConfig(t *testing.T) {
+	tests := []struct {
+		name   string
+		config v1alpha1.ParsedConfig
+	}{
+		{name: "missing service url", config: v1alpha1.ParsedConfig{"topics": "orders"}},
+		{name: "missing topics", config: v1alpha1.ParsedConfig{"service_url": "pulsar://localhost:6650"}},
+		{
+			name:   "invalid subscription type",
+			config: v1alpha1.ParsedConfig{"service_url": "pulsar://localhost:6650", "topics": "orders", "subscription": "s", "subscription_type": "fanout"},
+		},
+		{
+			name:   "invalid initial position",
+			config: v1alpha1.ParsedConfig{"service_url": "pulsar://localhost:6650", "topics": "orders", "subscription": "s", "initial_position": "oldest"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, _, err := (&provider{}).Subscribe(context.Background(), tt.config); err == nil {
+				t.Errorf("Subscribe() succeeded, want an error")
+			}
+		})
+	}
+}
+
+func TestParseSubscriptionType(t *testing.T) {
+	tests := []struct {
+		value   string
+		want    pulsar.SubscriptionType
+		wantErr bool
+	}{
+		{value: "", want: pulsar.Shared},
+		{value: "Key_Shared", want: pulsar.KeyShared},
+		{value: "failover", want: pulsar.Failover},
+		{value: "exclusive", want: pulsar.Exclusive},
+		{value: "fanout", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.value, func(t *testing.T) {
+			got, err := parseSubscriptionType(tt.value)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("parseSubscriptionType() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err == nil && got != tt.want {
+				t.Errorf("parseSubscriptionType() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,174 @@
+/*
+Copyright (c) 2022 RaptorML authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package push implements a subscription driver for brokers that receive messages pushed by clients (i.e. servers).
+// A client pushing a message waits until the message is acknowledged by the subscriber.
+package push
+
+import (
+	"context"
+	"errors"
+	"github.com/raptor-ml/streaming-runner/internal/brokers/receive"
+	"gocloud.dev/gcerrors"
+	"gocloud.dev/pubsub"
+	"gocloud.dev/pubsub/batcher"
+	"gocloud.dev/pubsub/driver"
+	"sync"
+	"time"
+)
+
+// ErrNacked is returned by Push when a message was not handled successfully
+var ErrNacked = errors.New("message was not handled successfully")
+
+// ErrClosed is returned by Push once the subscription is closed
+var ErrClosed = errors.New("subscription is closed")
+
+// Message is a message pushed by a client
+type Message struct {
+	ID        string
+	Body      []byte
+	Timestamp time.Time
+	Metadata  map[string]string
+
+	acked chan bool
+}
+
+// Subscription receives pushed messages
+type Subscription struct {
+	messages chan *Message
+	// closed is closed along with the subscription, and never receives an error
+	closed    chan error
+	closeOnce sync.Once
+}
+
+// New creates a push Subscription, buffering up to `buffer` messages that weren't received yet
+func New(buffer int) *Subscription {
+	return &Subscription{messages: make(chan *Message, buffer), closed: make(chan error)}
+}
+
+// Open returns a pubsub.Subscription delivering the pushed messages. Shutting it down closes the Subscription.
+func (s *Subscription) Open(maxBatchSize int) *pubsub.Subscription {
+	return pubsub.NewSubscription(&subscription{sub: s}, &batcher.Options{
+		MaxBatchSize: maxBatchSize,
+		MaxHandlers:  1,
+	}, nil)
+}
+
+// Close stops the subscription. Pending and later calls to Push return ErrClosed, since nothing receives their
+// messages anymore.
+func (s *Subscription) Close() {
+	s.closeOnce.Do(func() {
+		close(s.closed)
+	})
+}
+
+// Push queues the messages and blocks until all of them are acknowledged.
+// It returns ErrNacked if any of the messages was nacked, or ErrClosed if the subscription was closed meanwhile.
+func (s *Subscription) Push(ctx context.Context, msgs ...*Message) error {
+	for _, m := range msgs {
+		m.acked = make(chan bool, 1)
+		select {
+		case s.messages <- m:
+		case <-s.closed:
+			return ErrClosed
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+
+	var err error
+	for _, m := range msgs {
+		select {
+		case ok := <-m.acked:
+			if !ok {
+				err = ErrNacked
+			}
+		case <-s.closed:
+			return ErrClosed
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	return err
+}
+
+// subscription implements driver.Subscription on top of the pushed messages
+type subscription struct {
+	sub *Subscription
+}
+
+func (s *subscription) ReceiveBatch(ctx context.Context, maxMessages int) ([]*driver.Message, error) {
+	return receive.Batch(ctx, s.sub.messages, s.sub.closed, maxMessages, toDriverMessage)
+}
+
+func toDriverMessage(m *Message) *driver.Message {
+	return &driver.Message{
+		LoggableID: m.ID,
+		Body:       m.Body,
+		Metadata:   m.Metadata,
+		AckID:      m,
+		AsFunc: func(i any) bool {
+			p, ok := i.(**Message)
+			if !ok {
+				return false
+			}
+			*p = m
+			return true
+		},
+	}
+}
+
+func (s *subscription) SendAcks(_ context.Context, ackIDs []driver.AckID) error {
+	for _, id := range ackIDs {
+		id.(*Message).acked <- true
+	}
+	return nil
+}
+
+func (s *subscription) CanNack() bool {
+	return true
+}
+
+func (s *subscription) SendNacks(_ context.Context, ackIDs []driver.AckID) error {
+	for _, id := range ackIDs {
+		id.(*Message).acked <- false
+	}
+	return nil
+}
+
+func (s *subscription) IsRetryable(error) bool {
+	return false
+}
+
+func (s *subscription) As(any) bool {
+	return false
+}
+
+func (s *subscription) ErrorAs(error, any) bool {
+	return false
+}
+
+func (s *subscription) ErrorCode(err error) gcerrors.ErrorCode {
+	if errors.Is(err, receive.ErrClosed) {
+		return gcerrors.FailedPrecondition
+	}
+	return gcerrors.Unknown
+}
+
+func (s *subscription) Close() error {
+	s.sub.Close()
+	return nil
+}
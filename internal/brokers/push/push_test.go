@@ -0,0 +1,133 @@
+/*
+Copyright (c) 2022 RaptorML authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package push
+
+import (
+	"context"
+	"errors"
+	"gocloud.dev/pubsub"
+	"testing"
+	"time"
+)
+
+// pushAsync pushes the messages in the background, returning the result of Push
+func pushAsync(s *Subscription, msgs ...*Message) <-chan error {
+	done := make(chan error, 1)
+	go func() {
+		done <- s.Push(context.Background(), msgs...)
+	}()
+	return done
+}
+
+func receiveMessage(t *testing.T, sub *pubsub.Subscription) *pubsub.Message {
+	t.Helper()
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	msg, err := sub.Receive(ctx)
+	if err != nil {
+		t.Fatalf("Receive() error = %v", err)
+	}
+	return msg
+}
+
+func waitPush(t *testing.T, done <-chan error) error {
+	t.Helper()
+	select {
+	case err := <-done:
+		return err
+	case <-time.After(10 * time.Second):
+		t.Fatal("Push() didn't return")
+		return nil
+	}
+}
+
+func TestPush(t *testing.T) {
+	tests := []struct {
+		name    string
+		acks    []bool
+		wantErr error
+	}{
+		{name: "acked", acks: []bool{true, true}},
+		{name: "nacked", acks: []bool{false}, wantErr: ErrNacked},
+		{name: "partially nacked", acks: []bool{true, false}, wantErr: ErrNacked},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := New(10)
+			sub := s.Open(10)
+			defer func() { _ = sub.Shutdown(context.Background()) }()
+
+			var msgs []*Message
+			for i := range tt.acks {
+				msgs = append(msgs, &Message{ID: string(rune('a' + i)), Body: []byte("{}")})
+			}
+			done := pushAsync(s, msgs...)
+
+			for range tt.acks {
+				msg := receiveMessage(t, sub)
+				var m *Message
+				if !msg.As(&m) {
+					t.Fatal("As() failed to return the pushed message")
+				}
+				if tt.acks[m.ID[0]-'a'] {
+					msg.Ack()
+				} else {
+					msg.Nack()
+				}
+			}
+			if err := waitPush(t, done); !errors.Is(err, tt.wantErr) {
+				t.Errorf("Push() error = %v, want %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestCloseUnblocksPush(t *testing.T) {
+	s := New(1)
+	sub := s.Open(1)
+
+	// the first message is received, and waits for its ack, while the second waits to be queued
+	waiting := pushAsync(s, &Message{ID: "a"})
+	receiveMessage(t, sub)
+	queued := pushAsync(s, &Message{ID: "b"}, &Message{ID: "c"})
+
+	if err := sub.Shutdown(context.Background()); err != nil {
+		t.Fatalf("Shutdown() error = %v", err)
+	}
+	if err := waitPush(t, waiting); !errors.Is(err, ErrClosed) {
+		t.Errorf("Push() waiting for an ack error = %v, want ErrClosed", err)
+	}
+	if err := waitPush(t, queued); !errors.Is(err, ErrClosed) {
+		t.Errorf("Push() waiting to queue error = %v, want ErrClosed", err)
+	}
+	if err := s.Push(context.Background(), &Message{ID: "d"}); !errors.Is(err, ErrClosed) {
+		t.Errorf("Push() after Close error = %v, want ErrClosed", err)
+	}
+}
+
+func TestReceiveAfterClose(t *testing.T) {
+	s := New(1)
+	sub := s.Open(1)
+	defer func() { _ = sub.Shutdown(context.Background()) }()
+	s.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if _, err := sub.Receive(ctx); err == nil || ctx.Err() != nil {
+		t.Errorf("Receive() after Close error = %v, want the subscription to fail", err)
+	}
+}
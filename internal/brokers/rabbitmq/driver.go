@@ -0,0 +1,352 @@
+/*
+Copyright (c) 2022 RaptorML authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package rabbitmq
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/go-logr/logr"
+	amqp "github.com/rabbitmq/amqp091-go"
+	"github.com/raptor-ml/streaming-runner/internal/brokers/receive"
+	"gocloud.dev/gcerrors"
+	"gocloud.dev/pubsub/driver"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	minReconnectDelay = time.Second
+	maxReconnectDelay = 30 * time.Second
+
+	// retriesHeader counts the times a message was retried
+	retriesHeader = "x-raptor-retries"
+	// routingKeyHeader holds the routing key a retried message was first delivered with
+	routingKeyHeader = "x-raptor-routing-key"
+)
+
+// publisher publishes the retries of failed messages, and is implemented by *amqp.Channel
+type publisher interface {
+	PublishWithDeferredConfirmWithContext(ctx context.Context, exchange, key string, mandatory, immediate bool, msg amqp.Publishing) (*amqp.DeferredConfirmation, error)
+}
+
+// message is a delivery along with the channel it was received on, since retries are published on the same channel
+type message struct {
+	delivery amqp.Delivery
+	channel  publisher
+}
+
+// connection is a single consumer of the queue. done is closed once the channel is lost.
+type connection struct {
+	conn *amqp.Connection
+	ch   *amqp.Channel
+	lost chan *amqp.Error
+	done chan struct{}
+}
+
+// subscription implements driver.Subscription on top of an AMQP consumer.
+// The connection is re-established, and the queue consumed again, whenever the channel is lost.
+//
+// Failed messages are retried by publishing them again to the end of the queue, with a header counting the retries,
+// rather than by requeueing them, since RabbitMQ can't tell a failure from a delivery that was lost along with the
+// consumer. Once a message failed more than max_retries times, it's rejected, and routed to the dead-letter exchange.
+type subscription struct {
+	ctx      context.Context
+	cfg      config
+	logger   logr.Logger
+	messages chan *message
+
+	mu   sync.Mutex
+	conn *connection
+}
+
+// connect dials the broker, declares the queue and starts consuming it
+func (s *subscription) connect() (*connection, error) {
+	conn, err := amqp.DialConfig(s.cfg.URL, amqp.Config{
+		Properties: amqp.Table{"connection_name": "consumer.k8s.raptor.ml"},
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to rabbitmq: %w", err)
+	}
+
+	c, err := s.consume(conn)
+	if err != nil {
+		_ = conn.Close()
+		return nil, err
+	}
+
+	s.mu.Lock()
+	s.conn = c
+	s.mu.Unlock()
+	return c, nil
+}
+
+func (s *subscription) consume(conn *amqp.Connection) (*connection, error) {
+	ch, err := declare(conn, s.cfg, s.logger)
+	if err != nil {
+		return nil, err
+	}
+	if err := ch.Qos(s.cfg.Prefetch, 0, false); err != nil {
+		return nil, fmt.Errorf("failed to set prefetch: %w", err)
+	}
+	if err := ch.Confirm(false); err != nil {
+		return nil, fmt.Errorf("failed to enable publisher confirms: %w", err)
+	}
+	deliveries, err := ch.Consume(s.cfg.Queue, "", false, false, false, false, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to consume queue: %w", err)
+	}
+
+	c := &connection{
+		conn: conn,
+		ch:   ch,
+		lost: ch.NotifyClose(make(chan *amqp.Error, 1)),
+		done: make(chan struct{}),
+	}
+	go func() {
+		for d := range deliveries {
+			select {
+			case s.messages <- &message{delivery: d, channel: ch}:
+			case <-c.done:
+				// the delivery can't be acked anymore, and the broker redelivers it
+				return
+			}
+		}
+	}()
+	return c, nil
+}
+
+// run keeps the subscription connected until the context is done, reconnecting with an exponential backoff
+func (s *subscription) run(c *connection) {
+	delay := minReconnectDelay
+	for {
+		select {
+		case <-s.ctx.Done():
+			close(c.done)
+			_ = c.conn.Close()
+			return
+		case err := <-c.lost:
+			close(c.done)
+			_ = c.conn.Close()
+			reason := "channel closed"
+			if err != nil {
+				reason = err.Error()
+			}
+			s.logger.Info("rabbitmq channel lost, reconnecting", "reason", reason)
+		}
+
+		for {
+			var err error
+			c, err = s.connect()
+			if err == nil {
+				delay = minReconnectDelay
+				break
+			}
+			if s.ctx.Err() != nil {
+				return
+			}
+			s.logger.Error(err, "failed to reconnect to rabbitmq", "retryIn", delay)
+
+			t := time.NewTimer(delay)
+			select {
+			case <-s.ctx.Done():
+				t.Stop()
+				return
+			case <-t.C:
+			}
+			if delay *= 2; delay > maxReconnectDelay {
+				delay = maxReconnectDelay
+			}
+		}
+	}
+}
+
+func (s *subscription) ReceiveBatch(ctx context.Context, maxMessages int) ([]*driver.Message, error) {
+	return receive.Batch(ctx, s.messages, nil, maxMessages, toDriverMessage)
+}
+
+func toDriverMessage(m *message) *driver.Message {
+	d := &m.delivery
+	md := make(map[string]string, len(d.Headers))
+	for k, v := range d.Headers {
+		if s, ok := v.(string); ok {
+			md[k] = s
+		}
+	}
+	return &driver.Message{
+		LoggableID: strconv.FormatUint(d.DeliveryTag, 10),
+		Body:       d.Body,
+		Metadata:   md,
+		AckID:      m,
+		AsFunc: func(i any) bool {
+			p, ok := i.(**amqp.Delivery)
+			if !ok {
+				return false
+			}
+			*p = d
+			return true
+		},
+	}
+}
+
+func (s *subscription) SendAcks(_ context.Context, ackIDs []driver.AckID) error {
+	for _, id := range ackIDs {
+		// acks on a channel that was already lost are dropped, and the broker redelivers the message
+		if err := id.(*message).delivery.Ack(false); err != nil && !errors.Is(err, amqp.ErrClosed) {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *subscription) CanNack() bool {
+	return true
+}
+
+// SendNacks publishes the messages again to the end of the queue, and acks the failed deliveries. Messages that
+// already failed more than max_retries times are rejected without requeue, so they're routed to the dead-letter
+// exchange if one is configured, or dropped otherwise.
+func (s *subscription) SendNacks(ctx context.Context, ackIDs []driver.AckID) error {
+	for _, id := range ackIDs {
+		m := id.(*message)
+		d := &m.delivery
+		retries := retries(d.Headers)
+		if retries >= s.cfg.MaxRetries {
+			if err := d.Nack(false, false); err != nil && !errors.Is(err, amqp.ErrClosed) {
+				return err
+			}
+			continue
+		}
+
+		err := s.retry(ctx, m, retries+1)
+		if err == nil {
+			err = d.Ack(false)
+		} else {
+			// the retry wasn't published, so the message is requeued as is instead
+			s.logger.Error(err, "failed to publish the retry of a rabbitmq message, requeueing it", "deliveryTag", d.DeliveryTag)
+			err = d.Nack(false, true)
+		}
+		if err != nil && !errors.Is(err, amqp.ErrClosed) {
+			return err
+		}
+	}
+	return nil
+}
+
+// retry publishes a copy of the message to the queue, and waits for the broker to confirm it
+func (s *subscription) retry(ctx context.Context, m *message, retries int) error {
+	d := &m.delivery
+	headers := make(amqp.Table, len(d.Headers)+2)
+	for k, v := range d.Headers {
+		headers[k] = v
+	}
+	headers[retriesHeader] = int32(retries)
+	if _, ok := headers[routingKeyHeader]; !ok {
+		headers[routingKeyHeader] = d.RoutingKey
+	}
+
+	dc, err := m.channel.PublishWithDeferredConfirmWithContext(ctx, "", s.cfg.Queue, false, false, amqp.Publishing{
+		Headers:         headers,
+		ContentType:     d.ContentType,
+		ContentEncoding: d.ContentEncoding,
+		DeliveryMode:    d.DeliveryMode,
+		Priority:        d.Priority,
+		CorrelationId:   d.CorrelationId,
+		ReplyTo:         d.ReplyTo,
+		Expiration:      d.Expiration,
+		MessageId:       d.MessageId,
+		Timestamp:       d.Timestamp,
+		Type:            d.Type,
+		UserId:          d.UserId,
+		AppId:           d.AppId,
+		Body:            d.Body,
+	})
+	if err != nil {
+		return err
+	}
+	// the confirmation is nil when the channel isn't in confirm mode
+	if dc == nil {
+		return nil
+	}
+	acked, err := dc.WaitContext(ctx)
+	if err != nil {
+		return err
+	}
+	if !acked {
+		return errors.New("retry was nacked by the broker")
+	}
+	return nil
+}
+
+// retries returns the number of times a message was retried, according to its headers
+func retries(headers amqp.Table) int {
+	switch v := headers[retriesHeader].(type) {
+	case int32:
+		return int(v)
+	case int64:
+		return int(v)
+	case int16:
+		return int(v)
+	case int8:
+		return int(v)
+	case int:
+		return v
+	}
+	return 0
+}
+
+func (s *subscription) IsRetryable(error) bool {
+	return false
+}
+
+func (s *subscription) As(i any) bool {
+	p, ok := i.(**amqp.Channel)
+	if !ok {
+		return false
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	*p = s.conn.ch
+	return true
+}
+
+func (s *subscription) ErrorAs(err error, i any) bool {
+	return errors.As(err, i)
+}
+
+func (s *subscription) ErrorCode(err error) gcerrors.ErrorCode {
+	var aErr *amqp.Error
+	if !errors.As(err, &aErr) {
+		return gcerrors.Unknown
+	}
+	switch aErr.Code {
+	case amqp.NotFound:
+		return gcerrors.NotFound
+	case amqp.AccessRefused:
+		return gcerrors.PermissionDenied
+	case amqp.PreconditionFailed:
+		return gcerrors.FailedPrecondition
+	case amqp.ResourceLocked, amqp.ResourceError:
+		return gcerrors.ResourceExhausted
+	}
+	return gcerrors.Internal
+}
+
+func (s *subscription) Close() error {
+	return nil
+}
@@ -0,0 +1,180 @@
+/*
+Copyright (c) 2022 RaptorML authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package rabbitmq
+
+import (
+	"context"
+	"errors"
+	"github.com/go-logr/logr"
+	amqp "github.com/rabbitmq/amqp091-go"
+	"gocloud.dev/pubsub/driver"
+	"testing"
+)
+
+// acknowledger records the acks and nacks of the deliveries
+type acknowledger struct {
+	acked   []uint64
+	requeue map[uint64]bool
+}
+
+func (a *acknowledger) Ack(tag uint64, _ bool) error {
+	a.acked = append(a.acked, tag)
+	return nil
+}
+
+func (a *acknowledger) Nack(tag uint64, _ bool, requeue bool) error {
+	a.requeue[tag] = requeue
+	return nil
+}
+
+func (a *acknowledger) Reject(tag uint64, requeue bool) error {
+	return a.Nack(tag, false, requeue)
+}
+
+// fakePublisher records the published retries, or fails to publish them with err
+type fakePublisher struct {
+	published []amqp.Publishing
+	keys      []string
+	err       error
+}
+
+func (p *fakePublisher) PublishWithDeferredConfirmWithContext(_ context.Context, exchange, key string, _, _ bool, msg amqp.Publishing) (*amqp.DeferredConfirmation, error) {
+	if p.err != nil {
+		return nil, p.err
+	}
+	if exchange != "" {
+		return nil, errors.New("retries must be published to the default exchange")
+	}
+	p.keys = append(p.keys, key)
+	p.published = append(p.published, msg)
+	return nil, nil
+}
+
+func TestSendNacks(t *testing.T) {
+	tests := []struct {
+		name       string
+		headers    amqp.Table
+		publishErr error
+		// wantRetries is the retries header of the published retry, or 0 if it wasn't retried
+		wantRetries int32
+		wantAcked   bool
+		// wantRequeue is set when the delivery is expected to be nacked, to whether it's requeued
+		wantRequeue *bool
+	}{
+		{
+			name:        "first failure",
+			wantRetries: 1,
+			wantAcked:   true,
+		},
+		{
+			name:        "retried before",
+			headers:     amqp.Table{retriesHeader: int32(2)},
+			wantRetries: 3,
+			wantAcked:   true,
+		},
+		{
+			name:        "retries exhausted",
+			headers:     amqp.Table{retriesHeader: int32(3)},
+			wantRequeue: new(bool),
+		},
+		{
+			name:        "retry not published",
+			publishErr:  errors.New("channel closed"),
+			wantRequeue: func() *bool { b := true; return &b }(),
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			a := &acknowledger{requeue: make(map[uint64]bool)}
+			p := &fakePublisher{err: tt.publishErr}
+			messages := make(chan *message, 1)
+			s := &subscription{cfg: config{Queue: "orders", MaxRetries: 3}, logger: logr.Discard(), messages: messages}
+
+			// a delivery that was redelivered after a lost consumer isn't counted as a retry
+			messages <- &message{
+				delivery: amqp.Delivery{
+					Acknowledger: a,
+					DeliveryTag:  1,
+					Body:         []byte("a"),
+					Headers:      tt.headers,
+					RoutingKey:   "orders.created",
+					Redelivered:  true,
+				},
+				channel: p,
+			}
+			dms, err := s.ReceiveBatch(context.Background(), 10)
+			if err != nil || len(dms) != 1 {
+				t.Fatalf("ReceiveBatch() = %d messages, %v", len(dms), err)
+			}
+			if err := s.SendNacks(context.Background(), []driver.AckID{dms[0].AckID}); err != nil {
+				t.Fatalf("SendNacks() error = %v", err)
+			}
+
+			if tt.wantRetries == 0 && len(p.published) != 0 {
+				t.Errorf("published %d retries, want none", len(p.published))
+			}
+			if tt.wantRetries > 0 {
+				if len(p.published) != 1 || p.keys[0] != "orders" {
+					t.Fatalf("published %d retries to %v, want one to the queue", len(p.published), p.keys)
+				}
+				h := p.published[0].Headers
+				if h[retriesHeader] != tt.wantRetries || h[routingKeyHeader] != "orders.created" {
+					t.Errorf("retry headers = %v, want %d retries", h, tt.wantRetries)
+				}
+				if string(p.published[0].Body) != "a" {
+					t.Errorf("retry body = %s, want a", p.published[0].Body)
+				}
+			}
+			if acked := len(a.acked) == 1; acked != tt.wantAcked {
+				t.Errorf("delivery acked = %v, want %v", acked, tt.wantAcked)
+			}
+			requeue, nacked := a.requeue[1]
+			if nacked != (tt.wantRequeue != nil) || (nacked && requeue != *tt.wantRequeue) {
+				t.Errorf("delivery nacked = %v with requeue %v, want %v", nacked, requeue, tt.wantRequeue)
+			}
+		})
+	}
+}
+
+func TestSendAcks(t *testing.T) {
+	a := &acknowledger{requeue: make(map[uint64]bool)}
+	s := &subscription{}
+	m := &message{delivery: amqp.Delivery{Acknowledger: a, DeliveryTag: 7}}
+	if err := s.SendAcks(context.Background(), []driver.AckID{m}); err != nil {
+		t.Fatalf("SendAcks() error = %v", err)
+	}
+	if len(a.acked) != 1 || a.acked[0] != 7 {
+		t.Errorf("acked = %v, want [7]", a.acked)
+	}
+}
+
+func TestRetries(t *testing.T) {
+	tests := []struct {
+		headers amqp.Table
+		want    int
+	}{
+		{headers: nil, want: 0},
+		{headers: amqp.Table{retriesHeader: int32(2)}, want: 2},
+		{headers: amqp.Table{retriesHeader: int64(4)}, want: 4},
+		{headers: amqp.Table{retriesHeader: "5"}, want: 0},
+	}
+	for _, tt := range tests {
+		if got := retries(tt.headers); got != tt.want {
+			t.Errorf("retries(%v) = %d, want %d", tt.headers, got, tt.want)
+		}
+	}
+}
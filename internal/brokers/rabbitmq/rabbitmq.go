@@ -0,0 +1,158 @@
+/*
+Copyright (c) 2022 RaptorML authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package rabbitmq
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/go-logr/logr"
+	amqp "github.com/rabbitmq/amqp091-go"
+	"github.com/raptor-ml/raptor/api/v1alpha1"
+	"github.com/raptor-ml/streaming-runner/pkg/brokers"
+	"gocloud.dev/pubsub"
+	"gocloud.dev/pubsub/batcher"
+	"strconv"
+)
+
+func init() {
+	brokers.Register("rabbitmq", &provider{})
+}
+
+type provider struct{}
+
+func (p *provider) Metadata(_ context.Context, msg *pubsub.Message) brokers.Metadata {
+	var md brokers.Metadata
+	var d *amqp.Delivery
+	if ok := msg.As(&d); ok {
+		md.Timestamp = d.Timestamp
+		md.Topic = d.RoutingKey
+		// retries are published directly to the queue, so they carry the routing key of the first delivery
+		if rk, ok := d.Headers[routingKeyHeader].(string); ok {
+			md.Topic = rk
+		}
+		md.ID = d.MessageId
+		if md.ID == "" {
+			md.ID = strconv.FormatUint(d.DeliveryTag, 10)
+		}
+	}
+	return md
+}
+
+type config struct {
+	URL   string `mapstructure:"url"`
+	Queue string `mapstructure:"queue"`
+
+	Exchange     string `mapstructure:"exchange"`
+	ExchangeType string `mapstructure:"exchange_type"`
+	RoutingKey   string `mapstructure:"routing_key"`
+
+	// DeadLetterExchange is set as the queue's `x-dead-letter-exchange`. Messages that failed more than MaxRetries
+	// times are rejected, so they're routed to the dead-letter exchange, or dropped without one.
+	// RabbitMQ refuses to redeclare an existing queue with different arguments, so such a queue is used as is, and
+	// its dead-letter exchange should be set with a policy instead.
+	DeadLetterExchange string `mapstructure:"dead_letter_exchange"`
+	// MaxRetries is the number of times a failed message is retried, by publishing it again to the end of the queue.
+	MaxRetries int `mapstructure:"max_retries"`
+
+	// Prefetch defaults to the number of workers of the DataSource.
+	Prefetch int `mapstructure:"prefetch"`
+	Workers  int `mapstructure:"workers"`
+}
+
+func (p *provider) Subscribe(ctx context.Context, c v1alpha1.ParsedConfig) (context.Context, *pubsub.Subscription, error) {
+	cfg := config{MaxRetries: 3}
+	err := c.Unmarshal(&cfg)
+	if err != nil {
+		return ctx, nil, fmt.Errorf("failed to unmarshal config: %w", err)
+	}
+
+	if cfg.URL == "" {
+		return ctx, nil, fmt.Errorf("url required to connect to rabbitmq")
+	}
+	if cfg.Queue == "" {
+		return ctx, nil, fmt.Errorf("queue required to connect to rabbitmq")
+	}
+	if cfg.MaxRetries < 0 {
+		return ctx, nil, fmt.Errorf("invalid max_retries: %d", cfg.MaxRetries)
+	}
+	if cfg.Prefetch == 0 {
+		cfg.Prefetch = cfg.Workers
+	}
+	if cfg.Prefetch == 0 {
+		cfg.Prefetch = 1
+	}
+
+	sub := &subscription{
+		ctx:      ctx,
+		cfg:      cfg,
+		logger:   logr.FromContextOrDiscard(ctx),
+		messages: make(chan *message),
+	}
+	conn, err := sub.connect()
+	if err != nil {
+		return ctx, nil, err
+	}
+	go sub.run(conn)
+
+	return ctx, pubsub.NewSubscription(sub, &batcher.Options{
+		MaxBatchSize: cfg.Prefetch,
+		MaxHandlers:  1,
+	}, nil), nil
+}
+
+// declare declares the exchange and the queue, and binds them. A queue that already exists with different
+// arguments is used as is.
+func declare(conn *amqp.Connection, cfg config, logger logr.Logger) (*amqp.Channel, error) {
+	ch, err := conn.Channel()
+	if err != nil {
+		return nil, fmt.Errorf("failed to open channel: %w", err)
+	}
+
+	if cfg.Exchange != "" && cfg.ExchangeType != "" {
+		err = ch.ExchangeDeclare(cfg.Exchange, cfg.ExchangeType, true, false, false, false, nil)
+		if err != nil {
+			return nil, fmt.Errorf("failed to declare exchange: %w", err)
+		}
+	}
+
+	args := amqp.Table{}
+	if cfg.DeadLetterExchange != "" {
+		args["x-dead-letter-exchange"] = cfg.DeadLetterExchange
+	}
+	_, err = ch.QueueDeclare(cfg.Queue, true, false, false, false, args)
+	var aErr *amqp.Error
+	if errors.As(err, &aErr) && aErr.Code == amqp.PreconditionFailed {
+		// the failed declaration closed the channel
+		logger.Info("rabbitmq queue exists with different arguments, using it as is", "queue", cfg.Queue, "reason", aErr.Reason)
+		if ch, err = conn.Channel(); err != nil {
+			return nil, fmt.Errorf("failed to open channel: %w", err)
+		}
+		_, err = ch.QueueDeclarePassive(cfg.Queue, true, false, false, false, nil)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to declare queue: %w", err)
+	}
+
+	if cfg.Exchange != "" {
+		err = ch.QueueBind(cfg.Queue, cfg.RoutingKey, cfg.Exchange, false, nil)
+		if err != nil {
+			return nil, fmt.Errorf("failed to bind queue: %w", err)
+		}
+	}
+	return ch, nil
+}
@@ -0,0 +1,70 @@
+/*
+Copyright (c) 2022 RaptorML authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package receive implements the ReceiveBatch of drivers that are handed their messages over a channel.
+package receive
+
+import (
+	"context"
+	"errors"
+	"gocloud.dev/pubsub/driver"
+	"time"
+)
+
+// ErrClosed is returned once the messages or the errors channel is closed
+var ErrClosed = errors.New("subscription is closed")
+
+// wait is how long Batch waits for the first message
+const wait = time.Second
+
+// Batch waits up to a second for the first message, then drains whatever is already buffered, up to
+// maxMessages. It returns an empty batch when no message arrived in time, so the caller gets to check whether
+// it's shutting down. An error received from errs is returned instead, and errs may be nil.
+func Batch[T any](ctx context.Context, messages <-chan T, errs <-chan error, maxMessages int, toDriverMessage func(T) *driver.Message) ([]*driver.Message, error) {
+	var dms []*driver.Message
+
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case err, ok := <-errs:
+		if !ok {
+			return nil, ErrClosed
+		}
+		return nil, err
+	case <-timer.C:
+		return nil, nil
+	case m, ok := <-messages:
+		if !ok {
+			return nil, ErrClosed
+		}
+		dms = append(dms, toDriverMessage(m))
+	}
+
+	for len(dms) < maxMessages {
+		select {
+		case m, ok := <-messages:
+			if !ok {
+				return dms, nil
+			}
+			dms = append(dms, toDriverMessage(m))
+		default:
+			return dms, nil
+		}
+	}
+	return dms, nil
+}
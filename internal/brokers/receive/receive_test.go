@@ -0,0 +1,108 @@
+/*
+Copyright (c) 2022 RaptorML authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package receive
+
+import (
+	"context"
+	"errors"
+	"gocloud.dev/pubsub/driver"
+	"testing"
+	"time"
+)
+
+func toDriverMessage(s string) *driver.Message {
+	return &driver.Message{LoggableID: s}
+}
+
+func TestBatch(t *testing.T) {
+	errFailed := errors.New("failed")
+	tests := []struct {
+		name string
+		// buffered are the messages that are ready, and closed closes the messages after them
+		buffered    []string
+		closed      bool
+		err         error
+		closeErrs   bool
+		maxMessages int
+		want        int
+		wantErr     error
+	}{
+		{name: "no messages", maxMessages: 10},
+		{name: "drains the buffered messages", buffered: []string{"a", "b", "c"}, maxMessages: 10, want: 3},
+		{name: "up to max messages", buffered: []string{"a", "b", "c"}, maxMessages: 2, want: 2},
+		{name: "closed after messages", buffered: []string{"a", "b"}, closed: true, maxMessages: 10, want: 2},
+		{name: "closed", closed: true, maxMessages: 10, wantErr: ErrClosed},
+		{name: "error", err: errFailed, maxMessages: 10, wantErr: errFailed},
+		{name: "errors closed", closeErrs: true, maxMessages: 10, wantErr: ErrClosed},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			messages := make(chan string, len(tt.buffered))
+			for _, m := range tt.buffered {
+				messages <- m
+			}
+			if tt.closed {
+				close(messages)
+			}
+			errs := make(chan error, 1)
+			if tt.err != nil {
+				errs <- tt.err
+			}
+			if tt.closeErrs {
+				close(errs)
+			}
+
+			start := time.Now()
+			got, err := Batch(context.Background(), messages, errs, tt.maxMessages, toDriverMessage)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("Batch() error = %v, want %v", err, tt.wantErr)
+			}
+			if len(got) != tt.want {
+				t.Errorf("Batch() returned %d messages, want %d", len(got), tt.want)
+			}
+			for i, dm := range got {
+				if dm.LoggableID != tt.buffered[i] {
+					t.Errorf("Batch() message %d = %s, want %s", i, dm.LoggableID, tt.buffered[i])
+				}
+			}
+			// it only waits when nothing is ready
+			if waited := time.Since(start) >= wait; waited != (tt.want == 0 && tt.wantErr == nil) {
+				t.Errorf("Batch() took %s", time.Since(start))
+			}
+		})
+	}
+}
+
+func TestBatchCanceled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := Batch(ctx, make(chan string), nil, 10, toDriverMessage); !errors.Is(err, context.Canceled) {
+		t.Errorf("Batch() error = %v, want %v", err, context.Canceled)
+	}
+}
+
+func TestBatchWaitsForFirstMessage(t *testing.T) {
+	messages := make(chan string)
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		messages <- "a"
+	}()
+	got, err := Batch(context.Background(), messages, nil, 10, toDriverMessage)
+	if err != nil || len(got) != 1 {
+		t.Errorf("Batch() = %v, %v, want the message sent while waiting", got, err)
+	}
+}
@@ -0,0 +1,185 @@
+/*
+Copyright (c) 2022 RaptorML authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package redisstreams
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/go-logr/logr"
+	"github.com/redis/go-redis/v9"
+	"gocloud.dev/gcerrors"
+	"gocloud.dev/pubsub/driver"
+	"time"
+)
+
+// subscription implements driver.Subscription on top of a Redis Streams consumer group.
+// ReceiveBatch is not safe for concurrent use, so the subscription must be created with a single handler.
+type subscription struct {
+	client    *redis.Client
+	stream    string
+	group     string
+	consumer  string
+	bodyField string
+	logger    logr.Logger
+
+	claimMinIdle time.Duration
+	claimCursor  string
+	lastClaim    time.Time
+}
+
+func (s *subscription) ReceiveBatch(ctx context.Context, maxMessages int) ([]*driver.Message, error) {
+	// claim entries that are pending for too long on other consumers (e.g. after a crash)
+	if s.claimCursor != "0-0" || time.Since(s.lastClaim) > s.claimMinIdle {
+		msgs, next, err := s.client.XAutoClaim(ctx, &redis.XAutoClaimArgs{
+			Stream:   s.stream,
+			Group:    s.group,
+			Consumer: s.consumer,
+			MinIdle:  s.claimMinIdle,
+			Start:    s.claimCursor,
+			Count:    int64(maxMessages),
+		}).Result()
+		if err != nil {
+			return nil, err
+		}
+		s.claimCursor = next
+		s.lastClaim = time.Now()
+		if len(msgs) > 0 {
+			return s.toDriverMessages(ctx, msgs)
+		}
+	}
+
+	streams, err := s.client.XReadGroup(ctx, &redis.XReadGroupArgs{
+		Group:    s.group,
+		Consumer: s.consumer,
+		Streams:  []string{s.stream, ">"},
+		Count:    int64(maxMessages),
+		Block:    time.Second,
+	}).Result()
+	if errors.Is(err, redis.Nil) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var msgs []redis.XMessage
+	for _, st := range streams {
+		msgs = append(msgs, st.Messages...)
+	}
+	return s.toDriverMessages(ctx, msgs)
+}
+
+// toDriverMessages converts the stream entries. Entries that can't be converted would fail every consumer that
+// claims them, so they are acked and dropped instead of failing the batch.
+func (s *subscription) toDriverMessages(ctx context.Context, msgs []redis.XMessage) ([]*driver.Message, error) {
+	dms := make([]*driver.Message, 0, len(msgs))
+	var dropped []string
+	for i := range msgs {
+		m := &msgs[i]
+
+		body, err := s.body(m)
+		if err != nil {
+			s.logger.Error(err, "dropping stream entry", "stream", s.stream, "id", m.ID)
+			dropped = append(dropped, m.ID)
+			continue
+		}
+
+		dms = append(dms, &driver.Message{
+			LoggableID: m.ID,
+			Body:       body,
+			AckID:      m.ID,
+			AsFunc: func(i any) bool {
+				p, ok := i.(**redis.XMessage)
+				if !ok {
+					return false
+				}
+				*p = m
+				return true
+			},
+		})
+	}
+	if len(dropped) > 0 {
+		if err := s.client.XAck(ctx, s.stream, s.group, dropped...).Err(); err != nil {
+			return nil, err
+		}
+	}
+	return dms, nil
+}
+
+func (s *subscription) body(m *redis.XMessage) ([]byte, error) {
+	if s.bodyField == "" {
+		body, err := json.Marshal(m.Values)
+		if err != nil {
+			return nil, fmt.Errorf("failed to encode stream entry: %w", err)
+		}
+		return body, nil
+	}
+
+	v, ok := m.Values[s.bodyField]
+	if !ok {
+		return nil, fmt.Errorf("field %s is missing in stream entry", s.bodyField)
+	}
+	return []byte(fmt.Sprint(v)), nil
+}
+
+func (s *subscription) SendAcks(ctx context.Context, ackIDs []driver.AckID) error {
+	ids := make([]string, 0, len(ackIDs))
+	for _, id := range ackIDs {
+		ids = append(ids, id.(string))
+	}
+	return s.client.XAck(ctx, s.stream, s.group, ids...).Err()
+}
+
+func (s *subscription) CanNack() bool {
+	return true
+}
+
+// SendNacks leaves the entries in the pending list, so they are claimed again once they are idle for long enough.
+func (s *subscription) SendNacks(context.Context, []driver.AckID) error {
+	return nil
+}
+
+func (s *subscription) IsRetryable(err error) bool {
+	var netErr interface{ Timeout() bool }
+	return errors.As(err, &netErr) && netErr.Timeout()
+}
+
+func (s *subscription) As(i any) bool {
+	p, ok := i.(**redis.Client)
+	if !ok {
+		return false
+	}
+	*p = s.client
+	return true
+}
+
+func (s *subscription) ErrorAs(error, any) bool {
+	return false
+}
+
+func (s *subscription) ErrorCode(err error) gcerrors.ErrorCode {
+	if errors.Is(err, context.DeadlineExceeded) {
+		return gcerrors.DeadlineExceeded
+	}
+	return gcerrors.Unknown
+}
+
+func (s *subscription) Close() error {
+	return nil
+}
@@ -0,0 +1,159 @@
+/*
+Copyright (c) 2022 RaptorML authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package redisstreams
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"github.com/go-logr/logr"
+	"github.com/raptor-ml/raptor/api/v1alpha1"
+	"github.com/raptor-ml/streaming-runner/pkg/brokers"
+	"github.com/redis/go-redis/v9"
+	"gocloud.dev/pubsub"
+	"gocloud.dev/pubsub/batcher"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+func init() {
+	brokers.Register("redis_streams", &provider{})
+}
+
+type provider struct{}
+type ContextKey string
+
+const StreamContextKey ContextKey = "stream"
+
+func (p *provider) Metadata(ctx context.Context, msg *pubsub.Message) brokers.Metadata {
+	var md brokers.Metadata
+	var m *redis.XMessage
+	if ok := msg.As(&m); ok {
+		md.ID = m.ID
+		md.Topic = ctx.Value(StreamContextKey).(string)
+		md.Timestamp = entryTime(m.ID)
+	}
+	return md
+}
+
+// entryTime extracts the millisecond timestamp embedded in a stream entry ID (`<ms>-<seq>`)
+func entryTime(id string) time.Time {
+	ms, _, _ := strings.Cut(id, "-")
+	ts, err := strconv.ParseInt(ms, 10, 64)
+	if err != nil {
+		return time.Time{}
+	}
+	return time.UnixMilli(ts)
+}
+
+type config struct {
+	Addr      string `mapstructure:"addr"`
+	Username  string `mapstructure:"username"`
+	Password  string `mapstructure:"password"`
+	DB        int    `mapstructure:"db"`
+	TLSEnable bool   `mapstructure:"tls_enable"`
+
+	Stream        string `mapstructure:"stream"`
+	ConsumerGroup string `mapstructure:"consumer_group"`
+	Consumer      string `mapstructure:"consumer"`
+	// StartID is the ID the consumer group starts from when it is created, `$` for new entries or `0` for the whole stream.
+	StartID string `mapstructure:"start_id"`
+	// BodyField is the entry field holding the message body. When empty, all the entry fields are encoded as JSON.
+	BodyField string `mapstructure:"body_field"`
+
+	// ClaimMinIdle is the idle time after which pending entries of other (dead) consumers are claimed.
+	ClaimMinIdle time.Duration `mapstructure:"claim_min_idle"`
+	MaxBatchSize int           `mapstructure:"max_batch_size"`
+}
+
+func (p *provider) Subscribe(ctx context.Context, c v1alpha1.ParsedConfig) (context.Context, *pubsub.Subscription, error) {
+	cfg := config{}
+	err := c.Unmarshal(&cfg)
+	if err != nil {
+		return ctx, nil, fmt.Errorf("failed to unmarshal config: %w", err)
+	}
+
+	if cfg.Addr == "" {
+		return ctx, nil, fmt.Errorf("addr required to connect to redis")
+	}
+	if cfg.Stream == "" {
+		return ctx, nil, fmt.Errorf("stream required to connect to redis")
+	}
+	if cfg.StartID == "" {
+		cfg.StartID = "$"
+	}
+	if cfg.ClaimMinIdle == 0 {
+		cfg.ClaimMinIdle = time.Minute
+	}
+	if cfg.MaxBatchSize == 0 {
+		cfg.MaxBatchSize = 100
+	}
+
+	if cfg.ConsumerGroup == "" {
+		dc := brokers.DataSourceFromContext(ctx)
+		if dc == nil {
+			panic("no DataSource in context")
+		}
+		cfg.ConsumerGroup = fmt.Sprintf("%s.%s", dc.Name, dc.Namespace)
+	}
+	if cfg.Consumer == "" {
+		cfg.Consumer, err = os.Hostname()
+		if err != nil {
+			return ctx, nil, fmt.Errorf("failed to resolve consumer name: %w", err)
+		}
+	}
+
+	ctx = context.WithValue(ctx, StreamContextKey, cfg.Stream)
+
+	opts := &redis.Options{
+		Addr:       cfg.Addr,
+		Username:   cfg.Username,
+		Password:   cfg.Password,
+		DB:         cfg.DB,
+		ClientName: "consumer.k8s.raptor.ml",
+	}
+	if cfg.TLSEnable {
+		opts.TLSConfig = &tls.Config{MinVersion: tls.VersionTLS12}
+	}
+	client := redis.NewClient(opts)
+	go func() {
+		<-ctx.Done()
+		_ = client.Close()
+	}()
+
+	err = client.XGroupCreateMkStream(ctx, cfg.Stream, cfg.ConsumerGroup, cfg.StartID).Err()
+	if err != nil && !strings.HasPrefix(err.Error(), "BUSYGROUP") {
+		return ctx, nil, fmt.Errorf("failed to create consumer group: %w", err)
+	}
+
+	sub := pubsub.NewSubscription(&subscription{
+		client:       client,
+		stream:       cfg.Stream,
+		group:        cfg.ConsumerGroup,
+		consumer:     cfg.Consumer,
+		bodyField:    cfg.BodyField,
+		logger:       logr.FromContextOrDiscard(ctx),
+		claimMinIdle: cfg.ClaimMinIdle,
+		claimCursor:  "0-0",
+	}, &batcher.Options{
+		MaxBatchSize: cfg.MaxBatchSize,
+		MaxHandlers:  1,
+	}, nil)
+	return ctx, sub, nil
+}
@@ -0,0 +1,339 @@
+/*
+Copyright (c) 2022 RaptorML authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package redisstreams
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"github.com/raptor-ml/raptor/api/v1alpha1"
+	"github.com/raptor-ml/streaming-runner/internal/brokers/brokertest"
+	"gocloud.dev/pubsub"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+const testStream = "orders"
+
+type fakeEntry struct {
+	id     string
+	fields []string
+}
+
+type fakePending struct {
+	consumer    string
+	deliveredAt time.Time
+	deliveries  int
+}
+
+type fakeGroup struct {
+	// next is the index of the first entry that wasn't delivered to the group yet
+	next    int
+	pending map[string]*fakePending
+}
+
+// fakeRedis implements the subset of the RESP2 protocol and the stream commands used by the subscription
+type fakeRedis struct {
+	t  *testing.T
+	ln net.Listener
+
+	mu      sync.Mutex
+	entries []fakeEntry
+	groups  map[string]*fakeGroup
+	// created is the number of XGROUP CREATE commands received
+	created int
+	acked   []string
+}
+
+func newFakeRedis(t *testing.T) *fakeRedis {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	f := &fakeRedis{t: t, ln: ln, groups: make(map[string]*fakeGroup)}
+	t.Cleanup(func() { _ = ln.Close() })
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			t.Cleanup(func() { _ = conn.Close() })
+			go f.serve(conn)
+		}
+	}()
+	return f
+}
+
+// add appends entries to the stream, with ids made of their index
+func (f *fakeRedis) add(fields ...[]string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for _, fs := range fields {
+		f.entries = append(f.entries, fakeEntry{id: fmt.Sprintf("1700000000000-%d", len(f.entries)), fields: fs})
+	}
+}
+
+func (f *fakeRedis) serve(conn net.Conn) {
+	r := bufio.NewReader(conn)
+	for {
+		args, err := readCommand(r)
+		if err != nil {
+			return
+		}
+		reply := f.exec(args)
+		if _, err := io.WriteString(conn, reply); err != nil {
+			return
+		}
+	}
+}
+
+func readCommand(r *bufio.Reader) ([]string, error) {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	n, err := strconv.Atoi(strings.TrimSpace(line[1:]))
+	if err != nil || line[0] != '*' {
+		return nil, fmt.Errorf("unexpected command: %q", line)
+	}
+	args := make([]string, n)
+	for i := range args {
+		if _, err := r.ReadString('\n'); err != nil {
+			return nil, err
+		}
+		arg, err := r.ReadString('\n')
+		if err != nil {
+			return nil, err
+		}
+		args[i] = strings.TrimSuffix(arg, "\r\n")
+	}
+	return args, nil
+}
+
+func bulk(s string) string {
+	return fmt.Sprintf("$%d\r\n%s\r\n", len(s), s)
+}
+
+func array(items ...string) string {
+	return fmt.Sprintf("*%d\r\n%s", len(items), strings.Join(items, ""))
+}
+
+func (e fakeEntry) reply() string {
+	var fields []string
+	for _, v := range e.fields {
+		fields = append(fields, bulk(v))
+	}
+	return array(bulk(e.id), array(fields...))
+}
+
+func (f *fakeRedis) exec(args []string) string {
+	if strings.EqualFold(args[0], "XREADGROUP") {
+		// simulates the block of a read without new entries
+		defer func() {
+			time.Sleep(20 * time.Millisecond)
+		}()
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	switch cmd := strings.ToUpper(args[0]); cmd {
+	case "HELLO":
+		return "-ERR unknown command 'HELLO'\r\n"
+	case "CLIENT":
+		return "+OK\r\n"
+	case "XGROUP":
+		// XGROUP CREATE <stream> <group> <id> MKSTREAM
+		f.created++
+		if _, ok := f.groups[args[3]]; ok {
+			return "-BUSYGROUP Consumer Group name already exists\r\n"
+		}
+		g := &fakeGroup{pending: make(map[string]*fakePending)}
+		if args[4] == "$" {
+			g.next = len(f.entries)
+		}
+		f.groups[args[3]] = g
+		return "+OK\r\n"
+	case "XREADGROUP":
+		// XREADGROUP GROUP <group> <consumer> COUNT <n> BLOCK <ms> STREAMS <stream> >
+		g, consumer := f.groups[args[2]], args[3]
+		count, _ := strconv.Atoi(args[5])
+		var msgs []string
+		for ; g.next < len(f.entries) && len(msgs) < count; g.next++ {
+			e := f.entries[g.next]
+			g.pending[e.id] = &fakePending{consumer: consumer, deliveredAt: time.Now(), deliveries: 1}
+			msgs = append(msgs, e.reply())
+		}
+		if len(msgs) == 0 {
+			return "*-1\r\n"
+		}
+		return array(array(bulk(testStream), array(msgs...)))
+	case "XAUTOCLAIM":
+		// XAUTOCLAIM <stream> <group> <consumer> <min-idle> <start> COUNT <n>
+		g, consumer := f.groups[args[2]], args[3]
+		minIdle, _ := strconv.Atoi(args[4])
+		count, _ := strconv.Atoi(args[7])
+		var msgs []string
+		for _, e := range f.entries {
+			p, ok := g.pending[e.id]
+			if !ok || time.Since(p.deliveredAt) < time.Duration(minIdle)*time.Millisecond || len(msgs) == count {
+				continue
+			}
+			p.consumer, p.deliveredAt = consumer, time.Now()
+			p.deliveries++
+			msgs = append(msgs, e.reply())
+		}
+		return array(bulk("0-0"), array(msgs...), array())
+	case "XACK":
+		// XACK <stream> <group> <id>...
+		g := f.groups[args[2]]
+		for _, id := range args[3:] {
+			if _, ok := g.pending[id]; ok {
+				delete(g.pending, id)
+				f.acked = append(f.acked, id)
+			}
+		}
+		return fmt.Sprintf(":%d\r\n", len(args)-3)
+	default:
+		f.t.Errorf("unexpected command: %s", cmd)
+		return "-ERR unknown command\r\n"
+	}
+}
+
+func subscribe(t *testing.T, f *fakeRedis, config v1alpha1.ParsedConfig) (context.Context, *pubsub.Subscription) {
+	t.Helper()
+	config["addr"] = f.ln.Addr().String()
+	config["stream"] = testStream
+	config["consumer"] = "runner-0"
+	return brokertest.Subscribe(t, &provider{}, config)
+}
+
+func receive(ctx context.Context, t *testing.T, sub *pubsub.Subscription) *pubsub.Message {
+	t.Helper()
+	msg, err := sub.Receive(ctx)
+	if err != nil {
+		t.Fatalf("Receive() error = %v", err)
+	}
+	md := (&provider{}).Metadata(ctx, msg)
+	if md.Topic != testStream || md.ID != msg.LoggableID || !md.Timestamp.Equal(time.UnixMilli(1700000000000)) {
+		t.Errorf("Metadata() = %+v", md)
+	}
+	return msg
+}
+
+func TestConsumerGroup(t *testing.T) {
+	f := newFakeRedis(t)
+	f.add([]string{"a", "1"})
+
+	// the group starts from new entries by default, and is named after the DataSource
+	subscribe(t, f, v1alpha1.ParsedConfig{})
+	// an existing group is reused
+	subscribe(t, f, v1alpha1.ParsedConfig{})
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	g, ok := f.groups["test.default"]
+	if !ok || f.created != 2 || len(f.groups) != 1 {
+		t.Fatalf("groups = %v after %d creations, want a single test.default group", f.groups, f.created)
+	}
+	if g.next != 1 {
+		t.Errorf("group starts at entry %d, want the end of the stream", g.next)
+	}
+}
+
+func TestReceiveAndAck(t *testing.T) {
+	f := newFakeRedis(t)
+	f.add([]string{"a", "1"}, []string{"a", "2"})
+	ctx, sub := subscribe(t, f, v1alpha1.ParsedConfig{"start_id": "0", "consumer_group": "group"})
+
+	for _, want := range []string{`{"a":"1"}`, `{"a":"2"}`} {
+		msg := receive(ctx, t, sub)
+		if string(msg.Body) != want {
+			t.Errorf("Body = %s, want %s", msg.Body, want)
+		}
+		msg.Ack()
+	}
+	brokertest.Eventually(t, &f.mu, func() bool { return len(f.acked) == 2 && len(f.groups["group"].pending) == 0 })
+}
+
+func TestNackIsClaimedAgain(t *testing.T) {
+	f := newFakeRedis(t)
+	f.add([]string{"body", "x"})
+	ctx, sub := subscribe(t, f, v1alpha1.ParsedConfig{
+		"start_id":       "0",
+		"consumer_group": "group",
+		"body_field":     "body",
+		"claim_min_idle": "100ms",
+	})
+
+	msg := receive(ctx, t, sub)
+	msg.Nack()
+
+	// the nacked entry stays pending, and is claimed again once it's idle
+	again := receive(ctx, t, sub)
+	if again.LoggableID != msg.LoggableID || string(again.Body) != "x" {
+		t.Errorf("redelivered %s: %s, want %s: x", again.LoggableID, again.Body, msg.LoggableID)
+	}
+	again.Ack()
+	brokertest.Eventually(t, &f.mu, func() bool { return len(f.acked) == 1 })
+	if p := f.groups["group"].pending; len(p) != 0 {
+		t.Errorf("pending = %v after ack", p)
+	}
+}
+
+func TestClaimPendingOfDeadConsumer(t *testing.T) {
+	f := newFakeRedis(t)
+	f.add([]string{"body", "x"}, []string{"body", "y"})
+	// the first entry was delivered to a consumer that crashed before acking it
+	f.groups["group"] = &fakeGroup{
+		next:    1,
+		pending: map[string]*fakePending{"1700000000000-0": {consumer: "runner-1", deliveredAt: time.Now().Add(-time.Hour), deliveries: 1}},
+	}
+	ctx, sub := subscribe(t, f, v1alpha1.ParsedConfig{"consumer_group": "group", "body_field": "body"})
+
+	for _, want := range []string{"x", "y"} {
+		msg := receive(ctx, t, sub)
+		if string(msg.Body) != want {
+			t.Errorf("Body = %s, want %s", msg.Body, want)
+		}
+		msg.Ack()
+	}
+	brokertest.Eventually(t, &f.mu, func() bool { return len(f.acked) == 2 })
+}
+
+func TestDropsEntryWithoutBody(t *testing.T) {
+	f := newFakeRedis(t)
+	f.add([]string{"other", "x"}, []string{"body", "y"})
+	ctx, sub := subscribe(t, f, v1alpha1.ParsedConfig{"start_id": "0", "consumer_group": "group", "body_field": "body"})
+
+	msg := receive(ctx, t, sub)
+	if string(msg.Body) != "y" {
+		t.Errorf("Body = %s, want y", msg.Body)
+	}
+	// the entry without a body is acked, so it isn't claimed again
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if len(f.acked) != 1 || f.acked[0] != "1700000000000-0" {
+		t.Errorf("acked = %v, want the entry without a body", f.acked)
+	}
+}
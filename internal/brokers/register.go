@@ -17,6 +17,20 @@ limitations under the License.
 package brokers
 
 import (
+	_ "github.com/raptor-ml/streaming-runner/internal/brokers/awssqs"
+	_ "github.com/raptor-ml/streaming-runner/internal/brokers/azuresb"
+	_ "github.com/raptor-ml/streaming-runner/internal/brokers/file"
 	_ "github.com/raptor-ml/streaming-runner/internal/brokers/gcppubsub"
+	_ "github.com/raptor-ml/streaming-runner/internal/brokers/ingest"
 	_ "github.com/raptor-ml/streaming-runner/internal/brokers/kafka"
+	_ "github.com/raptor-ml/streaming-runner/internal/brokers/kinesis"
+	_ "github.com/raptor-ml/streaming-runner/internal/brokers/mqtt"
+	_ "github.com/raptor-ml/streaming-runner/internal/brokers/mysqlbinlog"
+	_ "github.com/raptor-ml/streaming-runner/internal/brokers/nats"
+	_ "github.com/raptor-ml/streaming-runner/internal/brokers/postgrescdc"
+	_ "github.com/raptor-ml/streaming-runner/internal/brokers/pulsar"
+	_ "github.com/raptor-ml/streaming-runner/internal/brokers/rabbitmq"
+	_ "github.com/raptor-ml/streaming-runner/internal/brokers/redisstreams"
+	_ "github.com/raptor-ml/streaming-runner/internal/brokers/webhook"
+	_ "github.com/raptor-ml/streaming-runner/pkg/brokers/mem"
 )
@@ -0,0 +1,132 @@
+/*
+Copyright (c) 2022 RaptorML authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package txn tracks the transactions of change data capture streams, to find the position that can be safely
+// confirmed to the source: the position of the latest transaction that all of its changes, and the changes of all
+// the transactions before it, were acknowledged.
+package txn
+
+import (
+	"sync"
+)
+
+// Transaction is a transaction that was (or is being) received
+type Transaction[P any] struct {
+	pos       P
+	pending   int
+	committed bool
+}
+
+// Tracker tracks the position of the acknowledged transactions. Positions of type P are merged by the merge function,
+// which returns the position after a transaction at pos was acknowledged, and must not modify its arguments.
+type Tracker[P any] struct {
+	mu      sync.Mutex
+	txns    []*Transaction[P]
+	merge   func(current, pos P) P
+	current P
+	dirty   bool
+}
+
+// New creates a Tracker starting at the initial position
+func New[P any](initial P, merge func(current, pos P) P) *Tracker[P] {
+	return &Tracker[P]{current: initial, merge: merge}
+}
+
+// Begin starts tracking the next transaction of the stream
+func (t *Tracker[P]) Begin() *Transaction[P] {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	tx := &Transaction[P]{}
+	t.txns = append(t.txns, tx)
+	return tx
+}
+
+// Add adds a change of the transaction, which must be acknowledged before the transaction is
+func (t *Tracker[P]) Add(tx *Transaction[P]) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	tx.pending++
+}
+
+// Commit ends the transaction at pos. A nil transaction, e.g. a commit of a transaction that began before the stream
+// did, is ignored.
+func (t *Tracker[P]) Commit(tx *Transaction[P], pos P) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if tx == nil {
+		return
+	}
+	tx.pos = pos
+	tx.committed = true
+	t.advance()
+}
+
+// Ack acknowledges a change of the transaction
+func (t *Tracker[P]) Ack(tx *Transaction[P]) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	tx.pending--
+	t.advance()
+}
+
+// Reset drops the transactions in flight, which are streamed again after reconnecting, and returns the position to
+// resume from. Acks of changes of the dropped transactions are ignored.
+func (t *Tracker[P]) Reset() P {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.txns = nil
+	return t.current
+}
+
+// Idle advances the position to pos when there are no transactions in flight
+func (t *Tracker[P]) Idle(pos P) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if len(t.txns) == 0 {
+		t.update(pos)
+	}
+}
+
+// Position returns the position that can be confirmed
+func (t *Tracker[P]) Position() P {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.current
+}
+
+// Flush returns the position, if it has changed since the last flush
+func (t *Tracker[P]) Flush() (P, bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if !t.dirty {
+		var zero P
+		return zero, false
+	}
+	t.dirty = false
+	return t.current, true
+}
+
+func (t *Tracker[P]) advance() {
+	for len(t.txns) > 0 && t.txns[0].committed && t.txns[0].pending == 0 {
+		t.update(t.txns[0].pos)
+		t.txns = t.txns[1:]
+	}
+}
+
+func (t *Tracker[P]) update(pos P) {
+	t.current = t.merge(t.current, pos)
+	t.dirty = true
+}
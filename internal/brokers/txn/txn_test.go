@@ -0,0 +1,124 @@
+/*
+Copyright (c) 2022 RaptorML authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package txn
+
+import (
+	"testing"
+)
+
+func latest(current, pos int) int {
+	if pos > current {
+		return pos
+	}
+	return current
+}
+
+func TestTracker(t *testing.T) {
+	tr := New(0, latest)
+
+	// the second transaction is acknowledged first, but can't be confirmed before the first one
+	first, second := tr.Begin(), tr.Begin()
+	tr.Add(first)
+	tr.Add(first)
+	tr.Add(second)
+	tr.Commit(first, 100)
+	tr.Commit(second, 200)
+	tr.Ack(second)
+	tr.Ack(first)
+	if pos := tr.Position(); pos != 0 {
+		t.Fatalf("Position() = %d while the first transaction is pending", pos)
+	}
+	tr.Ack(first)
+	if pos := tr.Position(); pos != 200 {
+		t.Fatalf("Position() = %d, want 200", pos)
+	}
+
+	// a transaction isn't confirmed before its commit, even when all of its changes were acknowledged
+	open := tr.Begin()
+	tr.Add(open)
+	tr.Ack(open)
+	tr.Idle(300)
+	if pos := tr.Position(); pos != 200 {
+		t.Errorf("Position() = %d before the commit", pos)
+	}
+	tr.Commit(open, 300)
+	if pos := tr.Position(); pos != 300 {
+		t.Errorf("Position() = %d, want 300", pos)
+	}
+
+	// a commit of a transaction that began before the stream is ignored
+	tr.Commit(nil, 400)
+	if pos := tr.Position(); pos != 300 {
+		t.Errorf("Position() = %d after a commit without a transaction", pos)
+	}
+
+	// idle streams advance to the given position
+	tr.Idle(500)
+	if pos := tr.Position(); pos != 500 {
+		t.Errorf("Position() = %d, want the idle position 500", pos)
+	}
+}
+
+func TestReset(t *testing.T) {
+	tr := New(0, latest)
+
+	// the first transaction is fully acknowledged, the second is in flight when the stream fails
+	tx := tr.Begin()
+	tr.Add(tx)
+	tr.Commit(tx, 100)
+	tr.Ack(tx)
+	inflight := tr.Begin()
+	tr.Add(inflight)
+
+	if pos := tr.Reset(); pos != 100 {
+		t.Fatalf("Reset() = %d, want 100", pos)
+	}
+
+	// the transaction is streamed again after reconnecting, and acks of the previous delivery are ignored
+	again := tr.Begin()
+	tr.Add(again)
+	tr.Commit(again, 200)
+	tr.Ack(inflight)
+	if pos := tr.Position(); pos != 100 {
+		t.Errorf("Position() = %d before the redelivered transaction was acknowledged", pos)
+	}
+	tr.Ack(again)
+	if pos := tr.Position(); pos != 200 {
+		t.Errorf("Position() = %d, want 200", pos)
+	}
+}
+
+func TestFlush(t *testing.T) {
+	tr := New(0, latest)
+	if _, ok := tr.Flush(); ok {
+		t.Error("Flush() of a new tracker reported a change")
+	}
+
+	tx := tr.Begin()
+	tr.Add(tx)
+	tr.Commit(tx, 100)
+	if _, ok := tr.Flush(); ok {
+		t.Error("Flush() reported a change before the transaction was acknowledged")
+	}
+	tr.Ack(tx)
+	if pos, ok := tr.Flush(); !ok || pos != 100 {
+		t.Errorf("Flush() = %d, %v, want 100", pos, ok)
+	}
+	if _, ok := tr.Flush(); ok {
+		t.Error("Flush() reported a change twice")
+	}
+}
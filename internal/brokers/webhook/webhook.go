@@ -0,0 +1,209 @@
+/*
+Copyright (c) 2022 RaptorML authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package webhook implements the `http` broker, ingesting messages POSTed to an HTTP endpoint.
+package webhook
+
+import (
+	"bytes"
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/google/uuid"
+	"github.com/raptor-ml/raptor/api/v1alpha1"
+	"github.com/raptor-ml/streaming-runner/internal/brokers/listener"
+	"github.com/raptor-ml/streaming-runner/internal/brokers/push"
+	"github.com/raptor-ml/streaming-runner/pkg/brokers"
+	"gocloud.dev/pubsub"
+	"io"
+	"net/http"
+	"time"
+)
+
+func init() {
+	brokers.Register("http", &provider{})
+}
+
+// shutdownTimeout bounds the time requests in progress have to complete once the subscription ends
+const shutdownTimeout = 10 * time.Second
+
+type provider struct{}
+type ContextKey string
+
+const PathContextKey ContextKey = "path"
+
+func (p *provider) Metadata(ctx context.Context, msg *pubsub.Message) brokers.Metadata {
+	var md brokers.Metadata
+	var m *push.Message
+	if ok := msg.As(&m); ok {
+		md.ID = m.ID
+		md.Timestamp = m.Timestamp
+		md.Topic = ctx.Value(PathContextKey).(string)
+	}
+	return md
+}
+
+type config struct {
+	Addr string `mapstructure:"addr"`
+	Path string `mapstructure:"path"`
+	// AuthToken requires requests to carry an `Authorization: Bearer <token>` header
+	AuthToken   string `mapstructure:"auth_token"`
+	MaxBodySize int64  `mapstructure:"max_body_size"`
+
+	MaxBatchSize int `mapstructure:"max_batch_size"`
+}
+
+func (p *provider) Subscribe(ctx context.Context, c v1alpha1.ParsedConfig) (context.Context, *pubsub.Subscription, error) {
+	cfg := config{}
+	err := c.Unmarshal(&cfg)
+	if err != nil {
+		return ctx, nil, fmt.Errorf("failed to unmarshal config: %w", err)
+	}
+
+	if cfg.Addr == "" {
+		cfg.Addr = ":8080"
+	}
+	if cfg.Path == "" {
+		cfg.Path = "/"
+	}
+	if cfg.MaxBodySize == 0 {
+		cfg.MaxBodySize = 10 << 20
+	}
+	if cfg.MaxBatchSize == 0 {
+		cfg.MaxBatchSize = 100
+	}
+
+	ctx = context.WithValue(ctx, PathContextKey, cfg.Path)
+
+	l, err := listener.Listen(cfg.Addr)
+	if err != nil {
+		return ctx, nil, fmt.Errorf("failed to listen on %s: %w", cfg.Addr, err)
+	}
+
+	ps := push.New(cfg.MaxBatchSize)
+	mux := http.NewServeMux()
+	mux.Handle(cfg.Path, &handler{cfg: cfg, sub: ps})
+	srv := &http.Server{
+		Handler:           mux,
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+	go func() {
+		_ = srv.Serve(l)
+	}()
+	go func() {
+		<-ctx.Done()
+		// requests waiting for their messages to be handled fail right away, so the shutdown doesn't wait for them
+		ps.Close()
+		sctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+		defer cancel()
+		if err := srv.Shutdown(sctx); err != nil {
+			_ = srv.Close()
+		}
+	}()
+
+	return ctx, ps.Open(cfg.MaxBatchSize), nil
+}
+
+type handler struct {
+	cfg config
+	sub *push.Subscription
+}
+
+// ServeHTTP pushes the messages of the body, and responds only after all of them were handled
+func (h *handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if h.cfg.AuthToken != "" {
+		expected := []byte("Bearer " + h.cfg.AuthToken)
+		if subtle.ConstantTimeCompare([]byte(r.Header.Get("Authorization")), expected) != 1 {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+	}
+
+	body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, h.cfg.MaxBodySize))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusRequestEntityTooLarge)
+		return
+	}
+	bodies, err := split(body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if len(bodies) == 0 {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	reqID := r.Header.Get("X-Request-ID")
+	if reqID == "" {
+		reqID = uuid.New().String()
+	}
+	now := time.Now()
+	msgs := make([]*push.Message, 0, len(bodies))
+	for i, b := range bodies {
+		id := reqID
+		if len(bodies) > 1 {
+			id = fmt.Sprintf("%s-%d", reqID, i)
+		}
+		msgs = append(msgs, &push.Message{ID: id, Body: b, Timestamp: now})
+	}
+
+	err = h.sub.Push(r.Context(), msgs...)
+	switch {
+	case errors.Is(err, push.ErrNacked):
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	case err != nil:
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+	default:
+		w.WriteHeader(http.StatusAccepted)
+	}
+}
+
+// split extracts the messages of a body that is either a single JSON value, a JSON array or NDJSON
+func split(body []byte) ([][]byte, error) {
+	body = bytes.TrimSpace(body)
+	if len(body) > 0 && body[0] == '[' {
+		var arr []json.RawMessage
+		if err := json.Unmarshal(body, &arr); err != nil {
+			return nil, fmt.Errorf("invalid json array: %w", err)
+		}
+		ret := make([][]byte, 0, len(arr))
+		for _, m := range arr {
+			ret = append(ret, m)
+		}
+		return ret, nil
+	}
+
+	var ret [][]byte
+	dec := json.NewDecoder(bytes.NewReader(body))
+	for {
+		var m json.RawMessage
+		err := dec.Decode(&m)
+		if errors.Is(err, io.EOF) {
+			return ret, nil
+		}
+		if err != nil {
+			return nil, fmt.Errorf("invalid json: %w", err)
+		}
+		ret = append(ret, m)
+	}
+}
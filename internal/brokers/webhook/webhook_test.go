@@ -0,0 +1,179 @@
+/*
+Copyright (c) 2022 RaptorML authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package webhook
+
+import (
+	"context"
+	"github.com/raptor-ml/raptor/api/v1alpha1"
+	"github.com/raptor-ml/streaming-runner/internal/brokers/brokertest"
+	"gocloud.dev/pubsub"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+func freeAddr(t *testing.T) string {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = ln.Close() }()
+	return ln.Addr().String()
+}
+
+func request(t *testing.T, method, addr, token, body string) int {
+	t.Helper()
+	req, err := http.NewRequest(method, "http://"+addr+"/events", strings.NewReader(body))
+	if err != nil {
+		t.Error(err)
+		return 0
+	}
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		// requests are also sent in the background, where the test can't stop
+		t.Errorf("%s error = %v", method, err)
+		return 0
+	}
+	_ = resp.Body.Close()
+	return resp.StatusCode
+}
+
+// handle acks the received messages, except those with a `"fail"` body which are nacked
+func handle(ctx context.Context, sub *pubsub.Subscription) {
+	for {
+		msg, err := sub.Receive(ctx)
+		if err != nil {
+			return
+		}
+		if string(msg.Body) == `"fail"` {
+			msg.Nack()
+		} else {
+			msg.Ack()
+		}
+	}
+}
+
+func TestServeHTTP(t *testing.T) {
+	addr := freeAddr(t)
+	ctx, sub := brokertest.Subscribe(t, &provider{}, v1alpha1.ParsedConfig{
+		"addr":       addr,
+		"path":       "/events",
+		"auth_token": "secret",
+	})
+	go handle(ctx, sub)
+
+	tests := []struct {
+		name   string
+		method string
+		token  string
+		body   string
+		want   int
+	}{
+		{name: "single", method: http.MethodPost, token: "secret", body: `{"a":1}`, want: http.StatusAccepted},
+		{name: "array", method: http.MethodPost, token: "secret", body: `[{"a":1},{"a":2}]`, want: http.StatusAccepted},
+		{name: "ndjson", method: http.MethodPost, token: "secret", body: "{\"a\":1}\n{\"a\":2}\n", want: http.StatusAccepted},
+		{name: "nacked", method: http.MethodPost, token: "secret", body: `[{"a":1},"fail"]`, want: http.StatusInternalServerError},
+		{name: "empty", method: http.MethodPost, token: "secret", want: http.StatusNoContent},
+		{name: "invalid json", method: http.MethodPost, token: "secret", body: `{"a":`, want: http.StatusBadRequest},
+		{name: "wrong token", method: http.MethodPost, token: "other", body: `{"a":1}`, want: http.StatusUnauthorized},
+		{name: "no token", method: http.MethodPost, body: `{"a":1}`, want: http.StatusUnauthorized},
+		{name: "get", method: http.MethodGet, token: "secret", want: http.StatusMethodNotAllowed},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := request(t, tt.method, addr, tt.token, tt.body); got != tt.want {
+				t.Errorf("%s status = %d, want %d", tt.method, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestMetadata(t *testing.T) {
+	addr := freeAddr(t)
+	ctx, sub := brokertest.Subscribe(t, &provider{}, v1alpha1.ParsedConfig{"addr": addr, "path": "/events"})
+
+	done := make(chan int, 1)
+	go func() {
+		done <- request(t, http.MethodPost, addr, "", `[{"a":1},{"a":2}]`)
+	}()
+	for i := 0; i < 2; i++ {
+		msg, err := sub.Receive(ctx)
+		if err != nil {
+			t.Fatalf("Receive() error = %v", err)
+		}
+		md := (&provider{}).Metadata(ctx, msg)
+		if !strings.HasSuffix(md.ID, "-"+string(rune('0'+i))) || md.Topic != "/events" || md.Timestamp.IsZero() {
+			t.Errorf("Metadata() = %+v", md)
+		}
+		msg.Ack()
+	}
+	if code := <-done; code != http.StatusAccepted {
+		t.Errorf("POST status = %d, want %d", code, http.StatusAccepted)
+	}
+}
+
+func TestShutdownWithPendingRequest(t *testing.T) {
+	addr := freeAddr(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	if _, _, err := (&provider{}).Subscribe(ctx, v1alpha1.ParsedConfig{"addr": addr, "path": "/events"}); err != nil {
+		t.Fatalf("Subscribe() error = %v", err)
+	}
+
+	// nothing receives the message, so the request waits until the subscription ends
+	done := make(chan int, 1)
+	go func() {
+		done <- request(t, http.MethodPost, addr, "", `{"a":1}`)
+	}()
+	time.Sleep(100 * time.Millisecond)
+	cancel()
+
+	select {
+	case code := <-done:
+		if code != http.StatusServiceUnavailable {
+			t.Errorf("POST status = %d, want %d", code, http.StatusServiceUnavailable)
+		}
+	case <-time.After(shutdownTimeout / 2):
+		t.Fatal("the shutdown waited for the pending request")
+	}
+}
+
+func TestAddrAcrossUpdates(t *testing.T) {
+	addr := freeAddr(t)
+	config := v1alpha1.ParsedConfig{"addr": addr, "path": "/events"}
+
+	oldCtx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	if _, _, err := (&provider{}).Subscribe(oldCtx, config); err != nil {
+		t.Fatalf("Subscribe() error = %v", err)
+	}
+
+	// an update subscribes again right after cancelling the previous subscription, which shuts down in the background
+	cancel()
+	ctx, sub := brokertest.Subscribe(t, &provider{}, config)
+	go handle(ctx, sub)
+
+	if code := request(t, http.MethodPost, addr, "", `{"a":1}`); code != http.StatusAccepted {
+		t.Errorf("POST status = %d, want %d", code, http.StatusAccepted)
+	}
+}
@@ -0,0 +1,85 @@
+/*
+Copyright (c) 2022 RaptorML authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package checkpoint
+
+import (
+	"context"
+	"fmt"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/util/retry"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+type configMap struct {
+	client client.Client
+	key    client.ObjectKey
+	field  string
+}
+
+// NewConfigMap returns a Store that keeps the checkpoint under the given field of a Kubernetes ConfigMap.
+// The ConfigMap is created on the first save, so the runner's role must allow to get, create and update configmaps.
+func NewConfigMap(c client.Client, key client.ObjectKey, field string) Store {
+	return &configMap{client: c, key: key, field: field}
+}
+
+func (s *configMap) Load(ctx context.Context) ([]byte, error) {
+	cm := &corev1.ConfigMap{}
+	err := s.client.Get(ctx, s.key, cm)
+	if apierrors.IsNotFound(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to get checkpoint configmap: %w", err)
+	}
+	if data, ok := cm.Data[s.field]; ok {
+		return []byte(data), nil
+	}
+	return nil, nil
+}
+
+func (s *configMap) Save(ctx context.Context, data []byte) error {
+	// retry when racing with another writer, including one that has just created the configmap
+	retriable := func(err error) bool {
+		return apierrors.IsConflict(err) || apierrors.IsAlreadyExists(err)
+	}
+	err := retry.OnError(retry.DefaultRetry, retriable, func() error {
+		cm := &corev1.ConfigMap{}
+		err := s.client.Get(ctx, s.key, cm)
+		if apierrors.IsNotFound(err) {
+			cm = &corev1.ConfigMap{
+				ObjectMeta: metav1.ObjectMeta{Name: s.key.Name, Namespace: s.key.Namespace},
+				Data:       map[string]string{s.field: string(data)},
+			}
+			return s.client.Create(ctx, cm)
+		}
+		if err != nil {
+			return err
+		}
+
+		if cm.Data == nil {
+			cm.Data = make(map[string]string)
+		}
+		cm.Data[s.field] = string(data)
+		return s.client.Update(ctx, cm)
+	})
+	if err != nil {
+		return fmt.Errorf("failed to save checkpoint configmap: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,78 @@
+/*
+Copyright (c) 2022 RaptorML authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package checkpoint
+
+import (
+	"context"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+	"testing"
+)
+
+func TestConfigMap(t *testing.T) {
+	ctx := context.Background()
+	key := client.ObjectKey{Name: "checkpoints", Namespace: "default"}
+	c := fake.NewClientBuilder().Build()
+	orders := NewConfigMap(c, key, "orders")
+
+	if data, err := orders.Load(ctx); err != nil || data != nil {
+		t.Fatalf("Load() of a missing configmap = %q, %v", data, err)
+	}
+	if err := orders.Save(ctx, []byte("1")); err != nil {
+		t.Fatalf("Save() creating the configmap error = %v", err)
+	}
+	if err := orders.Save(ctx, []byte("2")); err != nil {
+		t.Fatalf("Save() updating the configmap error = %v", err)
+	}
+	if data, err := orders.Load(ctx); err != nil || string(data) != "2" {
+		t.Errorf("Load() = %q, %v, want 2", data, err)
+	}
+
+	// stores of other fields share the configmap
+	users := NewConfigMap(c, key, "users")
+	if data, err := users.Load(ctx); err != nil || data != nil {
+		t.Fatalf("Load() of a missing field = %q, %v", data, err)
+	}
+	if err := users.Save(ctx, []byte("a")); err != nil {
+		t.Fatalf("Save() error = %v", err)
+	}
+	cm := &corev1.ConfigMap{}
+	if err := c.Get(ctx, key, cm); err != nil {
+		t.Fatal(err)
+	}
+	if cm.Data["orders"] != "2" || cm.Data["users"] != "a" {
+		t.Errorf("configmap data = %v", cm.Data)
+	}
+}
+
+func TestConfigMapWithoutData(t *testing.T) {
+	ctx := context.Background()
+	key := client.ObjectKey{Name: "checkpoints", Namespace: "default"}
+	c := fake.NewClientBuilder().WithObjects(&corev1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{Name: key.Name, Namespace: key.Namespace},
+	}).Build()
+	s := NewConfigMap(c, key, "orders")
+
+	if err := s.Save(ctx, []byte("1")); err != nil {
+		t.Fatalf("Save() error = %v", err)
+	}
+	if data, err := s.Load(ctx); err != nil || string(data) != "1" {
+		t.Errorf("Load() = %q, %v, want 1", data, err)
+	}
+}
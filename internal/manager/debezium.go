@@ -0,0 +1,206 @@
+/*
+Copyright (c) 2022 RaptorML authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package manager
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"github.com/linkedin/goavro/v2"
+	"github.com/pkg/errors"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+)
+
+// DebeziumOptions configures the unwrapping of Debezium change event envelopes.
+// When enabled, the row is the `after` image of the change (or the `before` image for deletes), and the envelope
+// is exposed using the special fields `__op`, `__ts_ms`, `__source.*` and `__deleted`.
+// Unwrapped messages are always JSON (or Avro) envelopes, so unwrapping can't be combined with a protobuf schema.
+type DebeziumOptions struct {
+	Unwrap bool `mapstructure:"debezium_unwrap"`
+	// Format is either `json` (default) or `avro`
+	Format string `mapstructure:"debezium_format"`
+	// SchemaRegistry is the URL of the Confluent compatible schema registry holding the Avro schemas
+	SchemaRegistry *url.URL `mapstructure:"debezium_schema_registry"`
+	// SkipTombstones acknowledges the tombstones that follow deletes on compacted topics, rather than failing them.
+	// Defaults to true.
+	SkipTombstones *bool `mapstructure:"debezium_skip_tombstones"`
+	SkipDeletes    bool  `mapstructure:"debezium_skip_deletes"`
+}
+
+// errSchemaWithUnwrap rejects a protobuf schema along with debezium_unwrap
+var errSchemaWithUnwrap = errors.New("a protobuf schema can't be used with debezium_unwrap")
+
+// errSkip is returned for change events that should be acknowledged without being processed
+var errSkip = errors.New("skipped change event")
+
+// avroMagicByte prefixes messages serialized with the schema registry wire format
+const avroMagicByte = 0
+
+type unwrapper struct {
+	opts           DebeziumOptions
+	skipTombstones bool
+	client         *http.Client
+	codecs         sync.Map
+}
+
+func newUnwrapper(opts DebeziumOptions) (*unwrapper, error) {
+	switch opts.Format {
+	case "", "json":
+	case "avro":
+		if opts.SchemaRegistry == nil {
+			return nil, fmt.Errorf("debezium_schema_registry is required for avro")
+		}
+	default:
+		return nil, fmt.Errorf("unsupported debezium format: %s", opts.Format)
+	}
+	return &unwrapper{
+		opts:           opts,
+		skipTombstones: opts.SkipTombstones == nil || *opts.SkipTombstones,
+		client:         &http.Client{Timeout: 10 * time.Second},
+	}, nil
+}
+
+// unwrap returns the JSON encoded row of the change event
+func (u *unwrapper) unwrap(ctx context.Context, body []byte) ([]byte, error) {
+	if len(body) == 0 || bytes.Equal(bytes.TrimSpace(body), []byte("null")) {
+		return nil, u.tombstone()
+	}
+
+	if u.opts.Format == "avro" {
+		var err error
+		body, err = u.avroToJSON(ctx, body)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	var envelope map[string]any
+	if err := json.Unmarshal(body, &envelope); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal envelope: %w", err)
+	}
+	// the JSON converter wraps the envelope with its schema when `schemas.enable` is set
+	if payload, ok := envelope["payload"]; ok {
+		if _, ok := envelope["schema"]; ok {
+			if payload == nil {
+				return nil, u.tombstone()
+			}
+			envelope, ok = payload.(map[string]any)
+			if !ok {
+				return nil, fmt.Errorf("unexpected payload type %T", payload)
+			}
+		}
+	}
+
+	op, ok := envelope["op"].(string)
+	if !ok {
+		return nil, fmt.Errorf("not a debezium change event")
+	}
+
+	var image any
+	switch op {
+	case "c", "r", "u":
+		image = envelope["after"]
+	case "d":
+		if u.opts.SkipDeletes {
+			return nil, errSkip
+		}
+		image = envelope["before"]
+	default:
+		// truncate and message events don't carry a row
+		return nil, errSkip
+	}
+
+	row, ok := image.(map[string]any)
+	if !ok {
+		return nil, fmt.Errorf("change event has no row image")
+	}
+	row["__op"] = op
+	row["__ts_ms"] = envelope["ts_ms"]
+	row["__source"] = envelope["source"]
+	row["__deleted"] = op == "d"
+
+	return json.Marshal(row)
+}
+
+func (u *unwrapper) tombstone() error {
+	if u.skipTombstones {
+		return errSkip
+	}
+	return fmt.Errorf("received a tombstone")
+}
+
+func (u *unwrapper) avroToJSON(ctx context.Context, body []byte) ([]byte, error) {
+	if len(body) < 5 || body[0] != avroMagicByte {
+		return nil, fmt.Errorf("message is not in the schema registry wire format")
+	}
+	codec, err := u.codec(ctx, binary.BigEndian.Uint32(body[1:5]))
+	if err != nil {
+		return nil, err
+	}
+
+	native, _, err := codec.NativeFromBinary(body[5:])
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode avro message: %w", err)
+	}
+	return codec.TextualFromNative(nil, native)
+}
+
+func (u *unwrapper) codec(ctx context.Context, id uint32) (*goavro.Codec, error) {
+	if c, ok := u.codecs.Load(id); ok {
+		return c.(*goavro.Codec), nil
+	}
+
+	ref := u.opts.SchemaRegistry.JoinPath("schemas", "ids", fmt.Sprint(id))
+	ref.User = nil
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, ref.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	if user := u.opts.SchemaRegistry.User; user != nil {
+		pass, _ := user.Password()
+		req.SetBasicAuth(user.Username(), pass)
+	}
+
+	resp, err := u.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch schema %d: %w", id, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("failed to fetch schema %d: %s", id, resp.Status)
+	}
+
+	var s struct {
+		Schema string `json:"schema"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&s); err != nil {
+		return nil, fmt.Errorf("failed to decode schema %d: %w", id, err)
+	}
+
+	// the standard JSON codec encodes unions as plain values, rather than {"type": value}
+	c, err := goavro.NewCodecForStandardJSONFull(s.Schema)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse schema %d: %w", id, err)
+	}
+	u.codecs.Store(id, c)
+	return c, nil
+}
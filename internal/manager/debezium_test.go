@@ -0,0 +1,224 @@
+/*
+Copyright (c) 2022 RaptorML authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package manager
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"github.com/linkedin/goavro/v2"
+	"github.com/raptor-ml/raptor/api/v1alpha1"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"sync/atomic"
+	"testing"
+)
+
+func TestUnwrapJSON(t *testing.T) {
+	f := false
+	tests := []struct {
+		name string
+		opts DebeziumOptions
+		body string
+		// want is the JSON encoding of the row, if the event isn't skipped or failed
+		want    string
+		wantErr error
+		fail    bool
+	}{
+		{
+			name: "create",
+			body: `{"op":"c","ts_ms":1700000000000,"source":{"table":"orders"},"before":null,"after":{"id":1}}`,
+			want: `{"__deleted":false,"__op":"c","__source":{"table":"orders"},"__ts_ms":1700000000000,"id":1}`,
+		},
+		{
+			name: "update",
+			body: `{"op":"u","ts_ms":1,"before":{"id":1,"v":1},"after":{"id":1,"v":2}}`,
+			want: `{"__deleted":false,"__op":"u","__source":null,"__ts_ms":1,"id":1,"v":2}`,
+		},
+		{
+			name: "delete",
+			body: `{"op":"d","ts_ms":1,"before":{"id":1},"after":null}`,
+			want: `{"__deleted":true,"__op":"d","__source":null,"__ts_ms":1,"id":1}`,
+		},
+		{
+			name:    "skipped delete",
+			opts:    DebeziumOptions{SkipDeletes: true},
+			body:    `{"op":"d","ts_ms":1,"before":{"id":1},"after":null}`,
+			wantErr: errSkip,
+		},
+		{
+			name: "envelope with schema",
+			body: `{"schema":{"type":"struct"},"payload":{"op":"r","ts_ms":1,"after":{"id":1}}}`,
+			want: `{"__deleted":false,"__op":"r","__source":null,"__ts_ms":1,"id":1}`,
+		},
+		{name: "truncate", body: `{"op":"t","ts_ms":1}`, wantErr: errSkip},
+		{name: "tombstone", body: ``, wantErr: errSkip},
+		{name: "null tombstone", body: `null`, wantErr: errSkip},
+		{name: "tombstone with schema", body: `{"schema":{"type":"struct"},"payload":null}`, wantErr: errSkip},
+		{name: "failed tombstone", opts: DebeziumOptions{SkipTombstones: &f}, body: ``, fail: true},
+		{name: "not a change event", body: `{"id":1}`, fail: true},
+		{name: "no row image", body: `{"op":"c","after":null}`, fail: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			u, err := newUnwrapper(tt.opts)
+			if err != nil {
+				t.Fatalf("newUnwrapper() error = %v", err)
+			}
+			got, err := u.unwrap(context.Background(), []byte(tt.body))
+			if tt.fail {
+				if err == nil || errors.Is(err, errSkip) {
+					t.Fatalf("unwrap() error = %v, want a failure", err)
+				}
+				return
+			}
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("unwrap() error = %v, want %v", err, tt.wantErr)
+			}
+			if err == nil && string(got) != tt.want {
+				t.Errorf("unwrap() = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+const envelopeSchema = `{
+	"type": "record",
+	"name": "Envelope",
+	"fields": [
+		{"name": "before", "type": ["null", {"type": "record", "name": "Value", "fields": [{"name": "id", "type": "long"}]}]},
+		{"name": "after", "type": ["null", "Value"]},
+		{"name": "op", "type": "string"},
+		{"name": "ts_ms", "type": ["null", "long"]}
+	]
+}`
+
+func TestUnwrapAvro(t *testing.T) {
+	var fetches atomic.Int32
+	registry := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if user, pass, _ := r.BasicAuth(); r.URL.Path != "/schemas/ids/7" || user != "user" || pass != "pass" {
+			http.NotFound(w, r)
+			return
+		}
+		fetches.Add(1)
+		_ = json.NewEncoder(w).Encode(map[string]string{"schema": envelopeSchema})
+	}))
+	defer registry.Close()
+
+	ref, err := url.Parse(registry.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ref.User = url.UserPassword("user", "pass")
+	u, err := newUnwrapper(DebeziumOptions{Unwrap: true, Format: "avro", SchemaRegistry: ref})
+	if err != nil {
+		t.Fatalf("newUnwrapper() error = %v", err)
+	}
+
+	codec, err := goavro.NewCodecForStandardJSONFull(envelopeSchema)
+	if err != nil {
+		t.Fatal(err)
+	}
+	encode := func(event string) []byte {
+		native, _, err := codec.NativeFromTextual([]byte(event))
+		if err != nil {
+			t.Fatal(err)
+		}
+		body := []byte{avroMagicByte, 0, 0, 0, 0}
+		binary.BigEndian.PutUint32(body[1:], 7)
+		body, err = codec.BinaryFromNative(body, native)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return body
+	}
+
+	tests := []struct {
+		name  string
+		event string
+		want  map[string]any
+	}{
+		{
+			name:  "create",
+			event: `{"before":null,"after":{"id":1},"op":"c","ts_ms":5}`,
+			want:  map[string]any{"id": 1.0, "__op": "c", "__ts_ms": 5.0, "__source": nil, "__deleted": false},
+		},
+		{
+			name:  "delete",
+			event: `{"before":{"id":2},"after":null,"op":"d","ts_ms":null}`,
+			want:  map[string]any{"id": 2.0, "__op": "d", "__ts_ms": nil, "__source": nil, "__deleted": true},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := u.unwrap(context.Background(), encode(tt.event))
+			if err != nil {
+				t.Fatalf("unwrap() error = %v", err)
+			}
+			var row map[string]any
+			if err := json.Unmarshal(got, &row); err != nil {
+				t.Fatalf("unwrap() = %s, which isn't a JSON object", got)
+			}
+			if !reflect.DeepEqual(row, tt.want) {
+				t.Errorf("unwrap() = %v, want %v", row, tt.want)
+			}
+		})
+	}
+	if n := fetches.Load(); n != 1 {
+		t.Errorf("the schema was fetched %d times, want once", n)
+	}
+
+	if _, err := u.unwrap(context.Background(), []byte(`{"op":"c"}`)); err == nil {
+		t.Error("unwrap() of a message without the wire format succeeded")
+	}
+}
+
+func TestDebeziumOptions(t *testing.T) {
+	tests := []struct {
+		name               string
+		cfg                v1alpha1.ParsedConfig
+		wantSkipTombstones bool
+		wantErr            bool
+	}{
+		{name: "defaults", cfg: v1alpha1.ParsedConfig{"debezium_unwrap": "true"}, wantSkipTombstones: true},
+		{
+			name:               "failing tombstones",
+			cfg:                v1alpha1.ParsedConfig{"debezium_unwrap": "true", "debezium_skip_tombstones": "false"},
+			wantSkipTombstones: false,
+		},
+		{name: "avro without registry", cfg: v1alpha1.ParsedConfig{"debezium_format": "avro"}, wantErr: true},
+		{name: "unknown format", cfg: v1alpha1.ParsedConfig{"debezium_format": "xml"}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			bs := BaseStreaming{}
+			if err := tt.cfg.Unmarshal(&bs); err != nil {
+				t.Fatalf("Unmarshal() error = %v", err)
+			}
+			u, err := newUnwrapper(bs.Debezium)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("newUnwrapper() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err == nil && u.skipTombstones != tt.wantSkipTombstones {
+				t.Errorf("skipTombstones = %v, want %v", u.skipTombstones, tt.wantSkipTombstones)
+			}
+		})
+	}
+}
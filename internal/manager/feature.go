@@ -80,6 +80,9 @@ func (m *manager) getFeature(ctx context.Context, ref raptorApi.ResourceReferenc
 	if ft.Schema == "" && bs.Schema != nil {
 		ft.Schema = bs.Schema.String()
 	}
+	if ft.Schema != "" && bs.unwrapper != nil {
+		return nil, errSchemaWithUnwrap
+	}
 	if ft.Schema != "" {
 		u, err := url.Parse(ft.Schema)
 		if err == nil && u.Scheme != "" && u.Host != "" && u.Fragment != "" {
@@ -104,6 +107,18 @@ func (m *manager) getFeature(ctx context.Context, ref raptorApi.ResourceReferenc
 }
 
 func (m *manager) handle(ctx context.Context, msg *pubsub.Message, md brokers.Metadata, bs BaseStreaming) error {
+	body := msg.Body
+	if bs.unwrapper != nil {
+		var err error
+		body, err = bs.unwrapper.unwrap(ctx, msg.Body)
+		if errors.Is(err, errSkip) {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("failed to unwrap debezium envelope: %w", err)
+		}
+	}
+
 	for _, ft := range bs.features {
 
 		var jsonMsg []byte
@@ -146,7 +161,7 @@ func (m *manager) handle(ctx context.Context, msg *pubsub.Message, md brokers.Me
 				return fmt.Errorf("failed to marshal proto to json: %w", err)
 			}
 		} else {
-			jsonMsg = msg.Body
+			jsonMsg = body
 		}
 
 		// if schema is not provided, we assume that the message is a json
@@ -156,6 +171,7 @@ func (m *manager) handle(ctx context.Context, msg *pubsub.Message, md brokers.Me
 			return fmt.Errorf("failed to unmarshal message: %w", err)
 		}
 		row = flattenMap(row)
+		addMetadataFields(row, md)
 
 		keys := api.Keys{}
 		for _, k := range ft.Keys {
@@ -173,6 +189,22 @@ func (m *manager) handle(ctx context.Context, msg *pubsub.Message, md brokers.Me
 	return nil
 }
 
+// addMetadataFields exposes the message metadata to the feature programs as reserved fields
+func addMetadataFields(row map[string]any, md brokers.Metadata) {
+	if md.Key != "" {
+		row["__key"] = md.Key
+	}
+	if md.Partition != nil {
+		row["__partition"] = *md.Partition
+	}
+	for k, v := range md.Headers {
+		row[fmt.Sprintf("__headers.%s", k)] = v
+	}
+	for k, v := range md.Attributes {
+		row[fmt.Sprintf("__attributes.%s", k)] = v
+	}
+}
+
 func flattenMap(row map[string]any) map[string]any {
 	//flatten maps
 	ret := make(map[string]any)
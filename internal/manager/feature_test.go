@@ -0,0 +1,56 @@
+/*
+Copyright (c) 2022 RaptorML authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package manager
+
+import (
+	"github.com/raptor-ml/streaming-runner/pkg/brokers"
+	"reflect"
+	"testing"
+)
+
+func TestAddMetadataFields(t *testing.T) {
+	partition := int32(0)
+	tests := []struct {
+		name string
+		md   brokers.Metadata
+		want map[string]any
+	}{
+		{
+			name: "partitioned broker",
+			md: brokers.Metadata{
+				Key:       "user-1",
+				Partition: &partition,
+				Headers:   map[string]string{"trace": "abc"},
+			},
+			want: map[string]any{"a": 1, "__key": "user-1", "__partition": int32(0), "__headers.trace": "abc"},
+		},
+		{
+			name: "broker without partitions",
+			md:   brokers.Metadata{Attributes: map[string]string{"shard_id": "shard-0"}},
+			want: map[string]any{"a": 1, "__attributes.shard_id": "shard-0"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			row := map[string]any{"a": 1}
+			addMetadataFields(row, tt.md)
+			if !reflect.DeepEqual(row, tt.want) {
+				t.Errorf("addMetadataFields() = %v, want %v", row, tt.want)
+			}
+		})
+	}
+}
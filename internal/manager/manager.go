@@ -46,6 +46,9 @@ type manager struct {
 	runtimeManager api.RuntimeManager
 	bs             *BaseStreaming
 	ready          bool
+
+	// kubeClient reads and writes resources the cache doesn't watch, e.g. the checkpoints of brokers
+	kubeClient client.Client
 }
 
 func New(src client.ObjectKey, rm api.RuntimeManager, cfg *rest.Config, logger logr.Logger) (Manager, error) {
@@ -59,9 +62,14 @@ func New(src client.ObjectKey, rm api.RuntimeManager, cfg *rest.Config, logger l
 	if err != nil {
 		return nil, fmt.Errorf("failed to create controler cache client: %w", err)
 	}
+	kc, err := client.New(cfg, client.Options{})
+	if err != nil {
+		return nil, fmt.Errorf("failed to create kubernetes client: %w", err)
+	}
 
 	return &manager{
 		client:         c,
+		kubeClient:     kc,
 		logger:         logger,
 		runtimeManager: rm,
 	}, nil
@@ -111,10 +119,12 @@ type BaseStreaming struct {
 	BrokerKind string `mapstructure:"kind"`
 	Workers    int
 	Schema     *url.URL
+	Debezium   DebeziumOptions `mapstructure:",squash"`
 
 	subscription *pubsub.Subscription
 	mdExtractor  brokers.MetadataExtractor
 	features     []*Feature
+	unwrapper    *unwrapper
 }
 
 func (m *manager) Add(ctx context.Context, in *raptorApi.DataSource) {
@@ -149,6 +159,18 @@ func (m *manager) Add(ctx context.Context, in *raptorApi.DataSource) {
 		}
 	}
 
+	if bs.Debezium.Unwrap {
+		if bs.Schema != nil {
+			m.logger.Error(errSchemaWithUnwrap, "invalid debezium options")
+			return
+		}
+		bs.unwrapper, err = newUnwrapper(bs.Debezium)
+		if err != nil {
+			m.logger.Error(err, "invalid debezium options")
+			return
+		}
+	}
+
 	broker := brokers.Get(bs.BrokerKind)
 	if broker == nil {
 		m.logger.Error(fmt.Errorf("broker %s not found", bs.BrokerKind), "invalid broker kind")
@@ -163,6 +185,8 @@ func (m *manager) Add(ctx context.Context, in *raptorApi.DataSource) {
 
 	// Create a new subscription
 	ctx = brokers.ContextWithDataSource(ctx, in)
+	ctx = brokers.ContextWithClient(ctx, m.kubeClient)
+	ctx = logr.NewContext(ctx, m.logger.WithName(bs.BrokerKind))
 	ctx, bs.subscription, err = broker.Subscribe(ctx, cfg)
 	if err != nil {
 		m.logger.Error(err, "failed to create subscription")
@@ -208,10 +232,11 @@ func (m *manager) subscribe(ctx context.Context, bs BaseStreaming) {
 					}
 					md := bs.mdExtractor(ctx, msg)
 					if err := m.handle(ctx, msg, md, bs); err != nil {
+						m.logger.Error(err, "failed to handle message")
 						if msg.Nackable() {
 							msg.Nack()
+							continue
 						}
-						m.logger.Error(err, "failed to handle message")
 					}
 
 					msg.Ack()
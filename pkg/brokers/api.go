@@ -20,6 +20,7 @@ import (
 	"context"
 	raptorApi "github.com/raptor-ml/raptor/api/v1alpha1"
 	"gocloud.dev/pubsub"
+	"sigs.k8s.io/controller-runtime/pkg/client"
 	"time"
 )
 
@@ -27,6 +28,14 @@ type Metadata struct {
 	Topic     string
 	Timestamp time.Time
 	ID        string
+	// Key is the key the broker uses for partitioning or ordering, if any
+	Key string
+	// Partition is the partition the message was read from, or nil for brokers without partitions
+	Partition *int32
+	// Headers holds the headers the message was published with
+	Headers map[string]string
+	// Attributes holds additional broker specific metadata
+	Attributes map[string]string
 }
 
 type MetadataExtractor func(ctx context.Context, msg *pubsub.Message) Metadata
@@ -40,6 +49,7 @@ type Broker interface {
 type ctxKey string
 
 const dataSourceCtxKey ctxKey = "DataSource"
+const clientCtxKey ctxKey = "Client"
 
 func ContextWithDataSource(ctx context.Context, dc *raptorApi.DataSource) context.Context {
 	return context.WithValue(ctx, dataSourceCtxKey, dc)
@@ -51,3 +61,15 @@ func DataSourceFromContext(ctx context.Context) *raptorApi.DataSource {
 	}
 	return v.(*raptorApi.DataSource)
 }
+
+// ContextWithClient carries the runner's Kubernetes client, for brokers that keep their state in the cluster
+func ContextWithClient(ctx context.Context, c client.Client) context.Context {
+	return context.WithValue(ctx, clientCtxKey, c)
+}
+func ClientFromContext(ctx context.Context) client.Client {
+	v := ctx.Value(clientCtxKey)
+	if v == nil {
+		return nil
+	}
+	return v.(client.Client)
+}
@@ -0,0 +1,118 @@
+/*
+Copyright (c) 2022 RaptorML authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package mem
+
+import (
+	"context"
+	"errors"
+	"github.com/go-logr/logr"
+	"github.com/raptor-ml/streaming-runner/internal/brokers/receive"
+	"gocloud.dev/gcerrors"
+	"gocloud.dev/pubsub/driver"
+	"time"
+)
+
+type message struct {
+	id        string
+	body      []byte
+	published time.Time
+	// retries is the number of times the message was nacked
+	retries int
+}
+
+// topic holds the published messages of a subscription. done is closed once the subscription ends.
+type topic struct {
+	messages chan *message
+	done     chan struct{}
+}
+
+// subscription implements driver.Subscription on top of a topic.
+// Nacked messages are published again to the topic after nack_delay, which doubles on every retry, and dropped once
+// they were retried max_retries times.
+type subscription struct {
+	topic  *topic
+	closed chan error
+	cfg    config
+	logger logr.Logger
+}
+
+func (s *subscription) ReceiveBatch(ctx context.Context, maxMessages int) ([]*driver.Message, error) {
+	return receive.Batch(ctx, s.topic.messages, s.closed, maxMessages, toDriverMessage)
+}
+
+func toDriverMessage(m *message) *driver.Message {
+	return &driver.Message{
+		LoggableID: m.id,
+		Body:       m.body,
+		Metadata: map[string]string{
+			idMetadataKey:          m.id,
+			publishTimeMetadataKey: m.published.Format(time.RFC3339Nano),
+		},
+		AckID: m,
+	}
+}
+
+func (s *subscription) SendAcks(context.Context, []driver.AckID) error {
+	return nil
+}
+
+func (s *subscription) CanNack() bool {
+	return true
+}
+
+func (s *subscription) SendNacks(_ context.Context, ackIDs []driver.AckID) error {
+	for _, id := range ackIDs {
+		m := id.(*message)
+		if m.retries >= s.cfg.MaxRetries {
+			s.logger.Error(errors.New("message was nacked too many times"), "dropping message", "id", m.id, "retries", m.retries)
+			continue
+		}
+
+		delay := s.cfg.NackDelay << m.retries
+		m.retries++
+		time.AfterFunc(delay, func() {
+			select {
+			case s.topic.messages <- m:
+			case <-s.topic.done:
+			}
+		})
+	}
+	return nil
+}
+
+func (s *subscription) IsRetryable(error) bool {
+	return false
+}
+
+func (s *subscription) As(any) bool {
+	return false
+}
+
+func (s *subscription) ErrorAs(error, any) bool {
+	return false
+}
+
+func (s *subscription) ErrorCode(err error) gcerrors.ErrorCode {
+	if errors.Is(err, receive.ErrClosed) {
+		return gcerrors.FailedPrecondition
+	}
+	return gcerrors.Unknown
+}
+
+func (s *subscription) Close() error {
+	return nil
+}
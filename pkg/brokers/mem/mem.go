@@ -0,0 +1,193 @@
+/*
+Copyright (c) 2022 RaptorML authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package mem implements an in-memory broker for local development and tests.
+// Messages are pushed using Publish, or via a local HTTP endpoint when `http_addr` is configured.
+package mem
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/go-logr/logr"
+	"github.com/google/uuid"
+	"github.com/raptor-ml/raptor/api/v1alpha1"
+	"github.com/raptor-ml/streaming-runner/internal/brokers/listener"
+	"github.com/raptor-ml/streaming-runner/pkg/brokers"
+	"gocloud.dev/pubsub"
+	"gocloud.dev/pubsub/batcher"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+)
+
+func init() {
+	brokers.Register("mem", &provider{})
+}
+
+const (
+	idMetadataKey          = "id"
+	publishTimeMetadataKey = "publish_time"
+	defaultTopic           = "default"
+	maxBodySize            = 10 << 20
+	// bufferSize is the number of published messages a topic holds before Publish blocks
+	bufferSize      = 100
+	shutdownTimeout = 10 * time.Second
+)
+
+// ErrNoSubscribers is returned by Publish when nothing subscribes to the topic
+var ErrNoSubscribers = errors.New("topic has no subscribers")
+
+var (
+	topics   = make(map[string]*topic)
+	topicsMu sync.RWMutex
+)
+
+// Publish sends a message to an in-memory topic, and blocks while the topic is full.
+// Messages sent before a subscription to the topic exists are rejected with ErrNoSubscribers.
+func Publish(ctx context.Context, topicName string, body []byte) error {
+	topicsMu.RLock()
+	t, ok := topics[topicName]
+	topicsMu.RUnlock()
+	if !ok {
+		return fmt.Errorf("%w: %s", ErrNoSubscribers, topicName)
+	}
+
+	m := &message{id: uuid.New().String(), body: body, published: time.Now()}
+	select {
+	case t.messages <- m:
+		return nil
+	case <-t.done:
+		return fmt.Errorf("%w: %s", ErrNoSubscribers, topicName)
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+type provider struct{}
+type ContextKey string
+
+const TopicContextKey ContextKey = "topic"
+
+func (p *provider) Metadata(ctx context.Context, msg *pubsub.Message) brokers.Metadata {
+	var md brokers.Metadata
+	md.ID = msg.Metadata[idMetadataKey]
+	md.Topic = ctx.Value(TopicContextKey).(string)
+	if ts, err := time.Parse(time.RFC3339Nano, msg.Metadata[publishTimeMetadataKey]); err == nil {
+		md.Timestamp = ts
+	}
+	return md
+}
+
+type config struct {
+	Topic string `mapstructure:"topic"`
+	// HTTPAddr starts a local HTTP endpoint (e.g. `localhost:8080`) publishing POSTed bodies to the topic.
+	HTTPAddr string `mapstructure:"http_addr"`
+	// NackDelay is how long a nacked message waits before it's redelivered, doubled on every retry.
+	NackDelay time.Duration `mapstructure:"nack_delay"`
+	// MaxRetries is the number of times a nacked message is redelivered, before it's dropped.
+	MaxRetries int `mapstructure:"max_retries"`
+}
+
+func (p *provider) Subscribe(ctx context.Context, c v1alpha1.ParsedConfig) (context.Context, *pubsub.Subscription, error) {
+	cfg := config{MaxRetries: 3}
+	err := c.Unmarshal(&cfg)
+	if err != nil {
+		return ctx, nil, fmt.Errorf("failed to unmarshal config: %w", err)
+	}
+
+	if cfg.Topic == "" {
+		cfg.Topic = defaultTopic
+	}
+	if cfg.NackDelay == 0 {
+		cfg.NackDelay = time.Second
+	}
+	if cfg.MaxRetries < 0 {
+		return ctx, nil, fmt.Errorf("invalid max_retries: %d", cfg.MaxRetries)
+	}
+
+	ctx = context.WithValue(ctx, TopicContextKey, cfg.Topic)
+
+	if cfg.HTTPAddr != "" {
+		l, err := listener.Listen(cfg.HTTPAddr)
+		if err != nil {
+			return ctx, nil, fmt.Errorf("failed to listen on %s: %w", cfg.HTTPAddr, err)
+		}
+		srv := &http.Server{
+			Handler:           publishHandler(cfg.Topic),
+			ReadHeaderTimeout: 10 * time.Second,
+		}
+		go func() {
+			_ = srv.Serve(l)
+		}()
+		go func() {
+			<-ctx.Done()
+			sctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+			defer cancel()
+			if err := srv.Shutdown(sctx); err != nil {
+				_ = srv.Close()
+			}
+		}()
+	}
+
+	// a fresh topic replaces the previous one, so subscriptions of a replaced DataSource won't keep receiving messages
+	t := &topic{messages: make(chan *message, bufferSize), done: make(chan struct{})}
+	topicsMu.Lock()
+	topics[cfg.Topic] = t
+	topicsMu.Unlock()
+
+	closed := make(chan error)
+	go func() {
+		<-ctx.Done()
+		topicsMu.Lock()
+		if topics[cfg.Topic] == t {
+			delete(topics, cfg.Topic)
+		}
+		topicsMu.Unlock()
+		close(t.done)
+		close(closed)
+	}()
+
+	return ctx, pubsub.NewSubscription(&subscription{
+		topic:  t,
+		closed: closed,
+		cfg:    cfg,
+		logger: logr.FromContextOrDiscard(ctx),
+	}, &batcher.Options{
+		MaxBatchSize: bufferSize,
+		MaxHandlers:  1,
+	}, nil), nil
+}
+
+func publishHandler(topic string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxBodySize))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if err := Publish(r.Context(), topic, body); err != nil {
+			http.Error(w, err.Error(), http.StatusServiceUnavailable)
+			return
+		}
+		w.WriteHeader(http.StatusAccepted)
+	})
+}
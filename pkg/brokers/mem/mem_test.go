@@ -0,0 +1,146 @@
+/*
+Copyright (c) 2022 RaptorML authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package mem
+
+import (
+	"context"
+	"errors"
+	"github.com/raptor-ml/raptor/api/v1alpha1"
+	"github.com/raptor-ml/streaming-runner/internal/brokers/brokertest"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestPublishAndReceive(t *testing.T) {
+	if err := Publish(context.Background(), "orders", []byte("a")); !errors.Is(err, ErrNoSubscribers) {
+		t.Fatalf("Publish() without subscribers error = %v, want ErrNoSubscribers", err)
+	}
+
+	ctx, sub := brokertest.Subscribe(t, &provider{}, v1alpha1.ParsedConfig{"topic": "orders"})
+	before := time.Now()
+	if err := Publish(ctx, "orders", []byte(`{"a":1}`)); err != nil {
+		t.Fatalf("Publish() error = %v", err)
+	}
+
+	msg, err := sub.Receive(ctx)
+	if err != nil {
+		t.Fatalf("Receive() error = %v", err)
+	}
+	if string(msg.Body) != `{"a":1}` {
+		t.Errorf("Body = %s", msg.Body)
+	}
+	md := (&provider{}).Metadata(ctx, msg)
+	if md.ID == "" || md.Topic != "orders" || md.Timestamp.Before(before) {
+		t.Errorf("Metadata() = %+v", md)
+	}
+	msg.Ack()
+}
+
+func TestNackRetries(t *testing.T) {
+	ctx, sub := brokertest.Subscribe(t, &provider{}, v1alpha1.ParsedConfig{
+		"topic":       "retries",
+		"nack_delay":  "20ms",
+		"max_retries": "2",
+	})
+	if err := Publish(ctx, "retries", []byte("a")); err != nil {
+		t.Fatalf("Publish() error = %v", err)
+	}
+
+	// the message is redelivered after a growing delay, rather than right away
+	var id string
+	last := time.Now()
+	for i := 0; i < 3; i++ {
+		msg, err := sub.Receive(ctx)
+		if err != nil {
+			t.Fatalf("Receive() error = %v", err)
+		}
+		if i == 0 {
+			id = msg.LoggableID
+		} else {
+			if msg.LoggableID != id {
+				t.Fatalf("delivery %d is %s, want the nacked message %s", i, msg.LoggableID, id)
+			}
+			if want := 20 * time.Millisecond << (i - 1); time.Since(last) < want {
+				t.Errorf("retry %d was delivered after %v, want at least %v", i, time.Since(last), want)
+			}
+		}
+		last = time.Now()
+		msg.Nack()
+	}
+
+	// the message is dropped once it was retried max_retries times
+	rctx, cancel := context.WithTimeout(ctx, 300*time.Millisecond)
+	defer cancel()
+	if msg, err := sub.Receive(rctx); err == nil {
+		t.Errorf("Receive() = %s after the retries were exhausted", msg.LoggableID)
+	}
+}
+
+func post(t *testing.T, addr, body string) int {
+	t.Helper()
+	resp, err := http.Post("http://"+addr, "application/json", strings.NewReader(body))
+	if err != nil {
+		t.Fatalf("POST error = %v", err)
+	}
+	_ = resp.Body.Close()
+	return resp.StatusCode
+}
+
+func TestHTTPEndpointAcrossUpdates(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := ln.Addr().String()
+	_ = ln.Close()
+	config := v1alpha1.ParsedConfig{"topic": "http", "http_addr": addr}
+
+	oldCtx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	if _, _, err := (&provider{}).Subscribe(oldCtx, config); err != nil {
+		t.Fatalf("Subscribe() error = %v", err)
+	}
+
+	// an update subscribes again right after cancelling the previous subscription, which releases its address in
+	// the background
+	cancel()
+	ctx, sub := brokertest.Subscribe(t, &provider{}, config)
+
+	if code := post(t, addr, `{"a":1}`); code != http.StatusAccepted {
+		t.Fatalf("POST status = %d, want %d", code, http.StatusAccepted)
+	}
+	msg, err := sub.Receive(ctx)
+	if err != nil {
+		t.Fatalf("Receive() error = %v", err)
+	}
+	if string(msg.Body) != `{"a":1}` {
+		t.Errorf("Body = %s", msg.Body)
+	}
+	msg.Ack()
+
+	resp, err := http.Get("http://" + addr)
+	if err != nil {
+		t.Fatalf("GET error = %v", err)
+	}
+	_ = resp.Body.Close()
+	if resp.StatusCode != http.StatusMethodNotAllowed {
+		t.Errorf("GET status = %d, want %d", resp.StatusCode, http.StatusMethodNotAllowed)
+	}
+}
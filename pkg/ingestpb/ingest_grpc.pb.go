@@ -0,0 +1,159 @@
+// Copyright (c) 2022 RaptorML authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Code generated by protoc-gen-go-grpc. DO NOT EDIT.
+// versions:
+// - protoc-gen-go-grpc v1.3.0
+// - protoc             (unknown)
+// source: ingest.proto
+
+package ingestpb
+
+import (
+	context "context"
+	grpc "google.golang.org/grpc"
+	codes "google.golang.org/grpc/codes"
+	status "google.golang.org/grpc/status"
+)
+
+// This is a compile-time assertion to ensure that this generated file
+// is compatible with the grpc package it is being compiled against.
+// Requires gRPC-Go v1.32.0 or later.
+const _ = grpc.SupportPackageIsVersion7
+
+const (
+	IngestService_Ingest_FullMethodName = "/raptor.streaming.ingest.v1alpha1.IngestService/Ingest"
+)
+
+// IngestServiceClient is the client API for IngestService service.
+//
+// For semantics around ctx use and closing/ending streaming RPCs, please refer to https://pkg.go.dev/google.golang.org/grpc/?tab=doc#ClientConn.NewStream.
+type IngestServiceClient interface {
+	// Ingest streams events to the runner. Every event is acknowledged with an IngestResponse
+	// once it was handled. Responses may arrive out of order, and are correlated by the event ID.
+	Ingest(ctx context.Context, opts ...grpc.CallOption) (IngestService_IngestClient, error)
+}
+
+type ingestServiceClient struct {
+	cc grpc.ClientConnInterface
+}
+
+func NewIngestServiceClient(cc grpc.ClientConnInterface) IngestServiceClient {
+	return &ingestServiceClient{cc}
+}
+
+func (c *ingestServiceClient) Ingest(ctx context.Context, opts ...grpc.CallOption) (IngestService_IngestClient, error) {
+	stream, err := c.cc.NewStream(ctx, &IngestService_ServiceDesc.Streams[0], IngestService_Ingest_FullMethodName, opts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &ingestServiceIngestClient{stream}
+	return x, nil
+}
+
+type IngestService_IngestClient interface {
+	Send(*IngestRequest) error
+	Recv() (*IngestResponse, error)
+	grpc.ClientStream
+}
+
+type ingestServiceIngestClient struct {
+	grpc.ClientStream
+}
+
+func (x *ingestServiceIngestClient) Send(m *IngestRequest) error {
+	return x.ClientStream.SendMsg(m)
+}
+
+func (x *ingestServiceIngestClient) Recv() (*IngestResponse, error) {
+	m := new(IngestResponse)
+	if err := x.ClientStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// IngestServiceServer is the server API for IngestService service.
+// All implementations must embed UnimplementedIngestServiceServer
+// for forward compatibility
+type IngestServiceServer interface {
+	// Ingest streams events to the runner. Every event is acknowledged with an IngestResponse
+	// once it was handled. Responses may arrive out of order, and are correlated by the event ID.
+	Ingest(IngestService_IngestServer) error
+	mustEmbedUnimplementedIngestServiceServer()
+}
+
+// UnimplementedIngestServiceServer must be embedded to have forward compatible implementations.
+type UnimplementedIngestServiceServer struct {
+}
+
+func (UnimplementedIngestServiceServer) Ingest(IngestService_IngestServer) error {
+	return status.Errorf(codes.Unimplemented, "method Ingest not implemented")
+}
+func (UnimplementedIngestServiceServer) mustEmbedUnimplementedIngestServiceServer() {}
+
+// UnsafeIngestServiceServer may be embedded to opt out of forward compatibility for this service.
+// Use of this interface is not recommended, as added methods to IngestServiceServer will
+// result in compilation errors.
+type UnsafeIngestServiceServer interface {
+	mustEmbedUnimplementedIngestServiceServer()
+}
+
+func RegisterIngestServiceServer(s grpc.ServiceRegistrar, srv IngestServiceServer) {
+	s.RegisterService(&IngestService_ServiceDesc, srv)
+}
+
+func _IngestService_Ingest_Handler(srv interface{}, stream grpc.ServerStream) error {
+	return srv.(IngestServiceServer).Ingest(&ingestServiceIngestServer{stream})
+}
+
+type IngestService_IngestServer interface {
+	Send(*IngestResponse) error
+	Recv() (*IngestRequest, error)
+	grpc.ServerStream
+}
+
+type ingestServiceIngestServer struct {
+	grpc.ServerStream
+}
+
+func (x *ingestServiceIngestServer) Send(m *IngestResponse) error {
+	return x.ServerStream.SendMsg(m)
+}
+
+func (x *ingestServiceIngestServer) Recv() (*IngestRequest, error) {
+	m := new(IngestRequest)
+	if err := x.ServerStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// IngestService_ServiceDesc is the grpc.ServiceDesc for IngestService service.
+// It's only intended for direct use with grpc.RegisterService,
+// and not to be introspected or modified (even as a copy)
+var IngestService_ServiceDesc = grpc.ServiceDesc{
+	ServiceName: "raptor.streaming.ingest.v1alpha1.IngestService",
+	HandlerType: (*IngestServiceServer)(nil),
+	Methods:     []grpc.MethodDesc{},
+	Streams: []grpc.StreamDesc{
+		{
+			StreamName:    "Ingest",
+			Handler:       _IngestService_Ingest_Handler,
+			ServerStreams: true,
+			ClientStreams: true,
+		},
+	},
+	Metadata: "ingest.proto",
+}